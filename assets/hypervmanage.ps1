@@ -1,13 +1,108 @@
+# The interface protocol version. This should match the
+# ScriptVersion constant in the driver.
+$scriptVersion = "0.17"
+
 Function IfNull($a, $b) { if ($null -eq $a) { $b } else { $a } }
 
 Function getresult {
     Return [PSCustomObject]@{
         Success      = $false;
         ErrorMessage = "";
+        ErrorCode    = "";
         PayLoad      = $null;
     }
 }
 
+# geterrorcode classifies an error into one of the error codes
+# understood by the driver. If the name of a machine that the
+# operation needed is specified, and that machine does not exist,
+# the error is classified as MachineNotFound.
+Function geterrorcode {
+    param(
+        [System.Management.Automation.ErrorRecord] $errorRecord,
+        [string] $machineName
+    )
+
+    If ($errorRecord.Exception -is [System.Management.Automation.CommandNotFoundException]) {
+        Return "HyperVNotEnabled"
+    }
+
+    If (-not [string]::IsNullOrEmpty($machineName)) {
+        $vm = Hyper-V\Get-VM -Name $machineName -ErrorAction SilentlyContinue
+        If ($null -eq $vm) {
+            Return "MachineNotFound"
+        }
+    }
+
+    If ($errorRecord.Exception -is [System.UnauthorizedAccessException]) {
+        Return "InsufficientPermissions"
+    }
+
+    # Hyper-V exceptions carry their own error category
+    $category = [string]$errorRecord.Exception.ErrorCategory
+    If ([string]::IsNullOrEmpty($category)) {
+        $category = [string]$errorRecord.CategoryInfo.Category
+    }
+
+    Switch ($category) {
+        { $_ -in "AccessDenied", "PermissionDenied", "SecurityError" } { Return "InsufficientPermissions" }
+        { $_ -in "InvalidState", "InvalidOperation" } { Return "InvalidState" }
+    }
+
+    Return "Unknown"
+}
+
+Function seterror {
+    param(
+        $result,
+        [System.Management.Automation.ErrorRecord] $errorRecord,
+        [string] $machineName
+    )
+
+    $result.ErrorMessage = $errorRecord.ToString()
+    $result.ErrorCode = geterrorcode $errorRecord $machineName
+}
+
+# getvmspec returns the processors and memory of a VM.
+Function getvmspec {
+    param(
+        $vm
+    )
+
+    $disksize = [int64]0
+    $disk = @(Hyper-V\Get-VMHardDiskDrive -VM $vm)[0]
+    If ($null -ne $disk) {
+        $vhd = Hyper-V\Get-VHD -Path $disk.Path -ErrorAction SilentlyContinue
+        If ($null -ne $vhd) {
+            $disksize = $vhd.Size
+        }
+    }
+
+    Return [PSCustomObject]@{
+        ProcessorCount       = $vm.ProcessorCount;
+        MemoryStartupBytes   = $vm.MemoryStartup;
+        DynamicMemoryEnabled = $vm.DynamicMemoryEnabled;
+        MemoryMinimumBytes   = $vm.MemoryMinimum;
+        MemoryMaximumBytes   = $vm.MemoryMaximum;
+        MemoryWeight         = (Hyper-V\Get-VMMemory -VM $vm).Priority;
+        DiskSizeBytes        = $disksize;
+    }
+}
+
+# getvmipaddress returns the first IPv4 address of the first network
+# adapter of a VM. Hyper-V may report an IPv6 link-local address first.
+Function getvmipaddress {
+    param(
+        $vm
+    )
+
+    $ipv4address = $vm.NetworkAdapters[0].IPAddresses |
+    Where-Object { ([System.Net.IPAddress]$_).AddressFamily -eq "InterNetwork" } |
+    Select-Object -First 1
+
+    IfNull $ipv4address ""
+}
+
 Function getkuttivmobject {
     param(
         [string] $machineName
@@ -15,8 +110,9 @@ Function getkuttivmobject {
 
     $vm = Hyper-V\Get-VM -Name $machineName -ErrorAction Stop | 
     Select-Object Name, 
-    @{Name = "IPAddress"; Expression = { IfNull $_.NetworkAdapters[0].IPAddresses[0] "" } }, 
-    @{Name = "State"; Expression = { $_.State.ToString() } } 
+    @{Name = "IPAddress"; Expression = { getvmipaddress $_ } }, 
+    @{Name = "State"; Expression = { $_.State.ToString() } }, 
+    @{Name = "Spec"; Expression = { getvmspec $_ } } 
     
     $vmresult = [PSCustomObject]@{
         Machine = $vm
@@ -25,52 +121,197 @@ Function getkuttivmobject {
     Return $vmresult
 }
 
+# getpermissionlevel returns "administrator" or "hypervadministrator"
+# if the current user can manage Hyper-V, or an empty string.
+Function getpermissionlevel {
+    $isadmin = ([Security.Principal.WindowsPrincipal][Security.Principal.WindowsIdentity]::GetCurrent()).IsInRole([Security.Principal.WindowsBuiltInRole] "Administrator")
+    If ($isadmin) {
+        Return "administrator"
+    }
+
+    $ishypervadmin = @([Security.Principal.WindowsPrincipal][Security.Principal.WindowsIdentity]::GetCurrent()).IsInRole(([System.Security.Principal.SecurityIdentifier]::new("S-1-5-32-578")))
+    If ($ishypervadmin) {
+        Return "hypervadministrator"
+    }
+
+    Return ""
+}
+
 Function Test-Driver {
     $result = getresult
-    $testresult = [PSCustomObject]@{HypervisorPresent = $false; Permissions = $false; PermissionLevel = "" }
+    $testresult = [PSCustomObject]@{HypervisorPresent = $false; Permissions = $false; PermissionLevel = ""; ScriptVersion = $scriptVersion }
 
     $testresult.HypervisorPresent = @(Get-CimInstance Win32_ComputerSystem).HypervisorPresent
 
-    $isadmin = ([Security.Principal.WindowsPrincipal][Security.Principal.WindowsIdentity]::GetCurrent()).IsInRole([Security.Principal.WindowsBuiltInRole] "Administrator")
-    If ($isadmin) {
-        $testresult.Permissions = $true
-        $testresult.PermissionLevel = "administrator"
-    }
-    Else {
-        $ishypervadmin = @([Security.Principal.WindowsPrincipal][Security.Principal.WindowsIdentity]::GetCurrent()).IsInRole(([System.Security.Principal.SecurityIdentifier]::new("S-1-5-32-578")))
-        If ($ishypervadmin) {
-            $testresult.Permissions = $true
-            $testresult.PermissionLevel = "hypervadministrator"
-        }
-    }
+    $testresult.PermissionLevel = getpermissionlevel
+    $testresult.Permissions = $testresult.PermissionLevel -ne ""
 
     $result.Success = $testresult.HypervisorPresent -and $testresult.Permissions
     If (-not $testresult.HypervisorPresent) {
         $result.ErrorMessage = "Hyper-V not enabled"
+        $result.ErrorCode = "HyperVNotEnabled"
     }
     ElseIf (-not $testresult.Permissions) {
         $result.ErrorMessage = "user should be an administrator, or a member of the Hyper-V Administrators group"
+        $result.ErrorCode = "InsufficientPermissions"
     }
     $result.PayLoad = $testresult
 
     $result | ConvertTo-Json 
 }
 
+# getvolumeinfo returns the free and total space on the volume
+# containing a path.
+Function getvolumeinfo {
+    param(
+        [string] $name,
+        [string] $path
+    )
+
+    $volume = [PSCustomObject]@{
+        Name         = $name;
+        Path         = $path;
+        FreeBytes    = [int64]0;
+        TotalBytes   = [int64]0;
+        ErrorMessage = "";
+    }
+
+    Try {
+        $drive = [System.IO.DriveInfo]::new([System.IO.Path]::GetPathRoot($path))
+        $volume.FreeBytes = $drive.AvailableFreeSpace
+        $volume.TotalBytes = $drive.TotalSize
+    }
+    Catch {
+        $volume.ErrorMessage = $_.ToString()
+    }
+
+    Return $volume
+}
+
+# Get-KuttiDiagnosis collects information about the host, for the
+# driver's preflight report. It succeeds even if the host cannot run
+# the driver; the driver interprets the information.
+Function Get-KuttiDiagnosis() {
+    param (
+        [string]
+        $machinePath,
+        [string]
+        $diskPath,
+        [string]
+        $cachePath,
+        [string]
+        $switchName
+    )
+
+    $result = getresult
+    $diagnosis = [PSCustomObject]@{
+        ScriptVersion     = $scriptVersion;
+        PowerShellEdition = IfNull $PSVersionTable.PSEdition "Desktop";
+        PowerShellVersion = $PSVersionTable.PSVersion.ToString();
+        HypervisorPresent = $false;
+        PermissionLevel   = getpermissionlevel;
+        HyperVModule      = $null -ne (Get-Module -ListAvailable -Name Hyper-V);
+        SwitchExists      = $false;
+        Volumes           = @();
+    }
+
+    Try {
+        $diagnosis.HypervisorPresent = [bool]@(Get-CimInstance Win32_ComputerSystem -ErrorAction Stop)[0].HypervisorPresent
+    }
+    Catch {
+        $diagnosis.HypervisorPresent = $false
+    }
+
+    If ($diagnosis.HyperVModule -and -not [string]::IsNullOrEmpty($switchName)) {
+        $vmswitch = Hyper-V\Get-VMSwitch -Name $switchName -ErrorAction SilentlyContinue
+        $diagnosis.SwitchExists = $null -ne $vmswitch
+    }
+
+    $volumes = @(
+        @{ Name = "MachineDir"; Path = $machinePath },
+        @{ Name = "DiskDir"; Path = $diskPath },
+        @{ Name = "CacheDir"; Path = $cachePath }
+    )
+    ForEach ($volume in $volumes) {
+        If (-not [string]::IsNullOrEmpty($volume.Path)) {
+            $diagnosis.Volumes += getvolumeinfo $volume.Name $volume.Path
+        }
+    }
+
+    $result.Success = $true
+    $result.PayLoad = $diagnosis
+
+    $result | ConvertTo-Json -Depth 5
+}
+
+# Get-KuttiHostCapacity returns the free memory and logical processors
+# of the host, and the free space on the volume containing a path, so
+# the driver can check that a machine fits before creating or starting
+# it. If a machine name is specified, the memory and processors assigned
+# to that machine are also returned.
+Function Get-KuttiHostCapacity() {
+    param (
+        [string]
+        $machineName,
+        [string]
+        $diskPath
+    )
+
+    $result = getresult
+    $capacity = [PSCustomObject]@{
+        FreeMemoryBytes       = [int64]0;
+        LogicalProcessors     = 0;
+        Volume                = $null;
+        MachineState          = "";
+        MachineMemoryBytes    = [int64]0;
+        MachineProcessorCount = 0;
+    }
+
+    Try {
+        $os = @(Get-CimInstance Win32_OperatingSystem -ErrorAction Stop)[0]
+        $capacity.FreeMemoryBytes = [int64]$os.FreePhysicalMemory * 1024
+
+        $computer = @(Get-CimInstance Win32_ComputerSystem -ErrorAction Stop)[0]
+        $capacity.LogicalProcessors = [int]$computer.NumberOfLogicalProcessors
+
+        If (-not [string]::IsNullOrEmpty($diskPath)) {
+            $capacity.Volume = getvolumeinfo "DiskDir" $diskPath
+        }
+
+        If (-not [string]::IsNullOrEmpty($machineName)) {
+            $vm = Hyper-V\Get-VM -Name $machineName -ErrorAction Stop
+            $capacity.MachineState = $vm.State.ToString()
+            $capacity.MachineMemoryBytes = [int64]$vm.MemoryStartup
+            $capacity.MachineProcessorCount = [int]$vm.ProcessorCount
+        }
+
+        $result.Success = $true
+        $result.PayLoad = $capacity
+    }
+    Catch {
+        seterror $result $_ $machineName
+    }
+
+    $result | ConvertTo-Json -Depth 5
+}
+
 Function Get-KuttiVMList() {
     $result = getresult
     Try {
         $vmlist = Hyper-V\Get-VM | Select-Object Name,
-                    @{Name = "IPAddress"; Expression = { IfNull $_.NetworkAdapters[0].IPAddresses[0] "" } },
+                    @{Name = "IPAddress"; Expression = { getvmipaddress $_ } },
                     @{Name = "State"; Expression = { $_.State.ToString() } } 
-        $vmresult = [PSCustomObject] @{VMList = $vmlist }
+        # A single VM, or none, should still be returned as a list
+        $vmresult = [PSCustomObject] @{VMList = @($vmlist) }
         $result.Success = $true
         $result.PayLoad = $vmresult
     }
     Catch {
+        seterror $result $_
         $result.ErrorMessage = "could not retrieve VMs"
     }
 
-    $result | ConvertTo-Json
+    $result | ConvertTo-Json -Depth 5
 }
 
 Function Get-KuttiVM() {
@@ -82,6 +323,7 @@ Function Get-KuttiVM() {
     $result = getresult
     If ([string]::IsNullOrEmpty($machineName)) {
         $result.ErrorMessage = "machine name not specified"
+        $result.ErrorCode = "InvalidArgument"
     }
     Else {
         Try {
@@ -91,11 +333,11 @@ Function Get-KuttiVM() {
             $result.PayLoad = $vmresult
         }
         Catch {
-            $result.ErrorMessage = $_.ToString()
+            seterror $result $_ $machineName
         }
     }
 
-    $result | ConvertTo-Json
+    $result | ConvertTo-Json -Depth 5
 }
 
 Function Start-KuttiVM() {
@@ -107,14 +349,22 @@ Function Start-KuttiVM() {
     $result = getresult
     If ([string]::IsNullOrEmpty($machineName)) {
         $result.ErrorMessage = "machine name not specified"
+        $result.ErrorCode = "InvalidArgument"
     }
     Else {
         Try {
-            Hyper-V\Start-VM -Name $machineName -ErrorAction Stop -WarningAction Stop
+            # A paused VM is resumed. A saved VM is restored by Start-VM.
+            $vm = Hyper-V\Get-VM -Name $machineName -ErrorAction Stop
+            If ($vm.State -eq "Paused") {
+                Hyper-V\Resume-VM -Name $machineName -ErrorAction Stop
+            }
+            Else {
+                Hyper-V\Start-VM -Name $machineName -ErrorAction Stop -WarningAction Stop
+            }
             $result.Success = $true
         }
         Catch {
-            $result.ErrorMessage = $_.ToString()
+            seterror $result $_ $machineName
         }
     }
 
@@ -141,14 +391,104 @@ Function Stop-KuttiVM() {
     $result = getresult
     If ([string]::IsNullOrEmpty($machineName)) {
         $result.ErrorMessage = "machine name not specified"
+        $result.ErrorCode = "InvalidArgument"
+    }
+    Else {
+        Try {
+            $vm = Hyper-V\Get-VM -Name $machineName -ErrorAction Stop
+            Switch ($vm.State) {
+                # A saved VM is not running, so its saved state is
+                # discarded to turn it off
+                "Saved" {
+                    Hyper-V\Remove-VMSavedState -VMName $machineName -ErrorAction Stop
+                }
+                # A paused VM cannot shut itself down
+                "Paused" {
+                    If (-not $force) {
+                        Hyper-V\Resume-VM -Name $machineName -ErrorAction Stop
+                    }
+                    Hyper-V\Stop-VM -Name $machineName -ErrorAction Stop -WarningAction Stop @forceparam
+                }
+                Default {
+                    Hyper-V\Stop-VM -Name $machineName -ErrorAction Stop -WarningAction Stop @forceparam
+                }
+            }
+            $result.Success = $true
+        }
+        Catch {
+            seterror $result $_ $machineName
+        }
+    }
+
+    $result | ConvertTo-Json
+}
+
+Function Suspend-KuttiVM() {
+    param (
+        [string]
+        $machineName
+    )
+
+    $result = getresult
+    If ([string]::IsNullOrEmpty($machineName)) {
+        $result.ErrorMessage = "machine name not specified"
+        $result.ErrorCode = "InvalidArgument"
+    }
+    Else {
+        Try {
+            Hyper-V\Suspend-VM -Name $machineName -ErrorAction Stop
+            $result.Success = $true
+        }
+        Catch {
+            seterror $result $_ $machineName
+        }
+    }
+
+    $result | ConvertTo-Json
+}
+
+Function Resume-KuttiVM() {
+    param (
+        [string]
+        $machineName
+    )
+
+    $result = getresult
+    If ([string]::IsNullOrEmpty($machineName)) {
+        $result.ErrorMessage = "machine name not specified"
+        $result.ErrorCode = "InvalidArgument"
     }
     Else {
         Try {
-            Hyper-V\Stop-VM -Name $machineName -ErrorAction Stop -WarningAction Stop @forceparam
+            Hyper-V\Resume-VM -Name $machineName -ErrorAction Stop
             $result.Success = $true
         }
         Catch {
-            $result.ErrorMessage = $_.ToString()
+            seterror $result $_ $machineName
+        }
+    }
+
+    $result | ConvertTo-Json
+}
+
+Function Save-KuttiVM() {
+    param (
+        [string]
+        $machineName
+    )
+
+    $result = getresult
+    If ([string]::IsNullOrEmpty($machineName)) {
+        $result.ErrorMessage = "machine name not specified"
+        $result.ErrorCode = "InvalidArgument"
+    }
+    Else {
+        Try {
+            Hyper-V\Save-VM -Name $machineName -ErrorAction Stop
+            $result.Success = $true
+        }
+        Catch {
+            seterror $result $_ $machineName
         }
     }
 
@@ -162,28 +502,100 @@ Function New-KuttiVM() {
         [string]
         $machinePath,
         [string]
-        $vhdpath
+        $vhdpath,
+        [int64]
+        $memoryBytes,
+        [int]
+        $processorCount,
+        [string]
+        $switchName,
+        [bool]
+        $dynamicMemory,
+        [int64]
+        $memoryMinimumBytes,
+        [int64]
+        $memoryMaximumBytes,
+        [int]
+        $memoryWeight,
+        [int]
+        $generation,
+        [string]
+        $secureBootTemplate,
+        [bool]
+        $enableTPM
     )
 
     $result = getresult
-    If ([string]::IsNullOrEmpty($machineName) -or [string]::IsNullOrEmpty($machinepath) -or [string]::IsNullOrEmpty($vhdpath)) {
-        $result.ErrorMessage = "machine name or machinepath or vhdpath not specified"
+    If ([string]::IsNullOrEmpty($machineName) -or [string]::IsNullOrEmpty($machinepath) -or [string]::IsNullOrEmpty($vhdpath) -or [string]::IsNullOrEmpty($switchName)) {
+        $result.ErrorMessage = "machine name or machinepath or vhdpath or switchname not specified"
+        $result.ErrorCode = "InvalidArgument"
     }
     Else {
         Try {
-            $newvm = Hyper-V\New-VM -Name $machineName -Generation 1 -Path $machinePath -VHDPath $vhdpath -SwitchName "Default Switch"
-            Hyper-V\Set-VM $newvm -StaticMemory -MemoryStartupBytes 2147483648 -ProcessorCount 2 -CheckpointType Disabled
+            $existingvm = Hyper-V\Get-VM -Name $machineName -ErrorAction SilentlyContinue
+            If ($null -ne $existingvm) {
+                $result.ErrorMessage = "machine '$machineName' already exists"
+                $result.ErrorCode = "MachineExists"
+            }
+            Else {
+                $newvm = Hyper-V\New-VM -Name $machineName -Generation $generation -Path $machinePath -VHDPath $vhdpath -SwitchName $switchName
+                If ($generation -eq 2) {
+                    # Secure Boot is on by default for Generation 2 VMs,
+                    # with a template that only boots Windows
+                    If ([string]::IsNullOrEmpty($secureBootTemplate)) {
+                        Hyper-V\Set-VMFirmware -VM $newvm -EnableSecureBoot Off -ErrorAction Stop
+                    }
+                    Else {
+                        Hyper-V\Set-VMFirmware -VM $newvm -EnableSecureBoot On -SecureBootTemplate $secureBootTemplate -ErrorAction Stop
+                    }
+                    If ($enableTPM) {
+                        Hyper-V\Set-VMKeyProtector -VM $newvm -NewLocalKeyProtector -ErrorAction Stop
+                        Hyper-V\Enable-VMTPM -VM $newvm -ErrorAction Stop
+                    }
+                }
+                If ($dynamicMemory) {
+                    Hyper-V\Set-VM $newvm -DynamicMemory -MemoryStartupBytes $memoryBytes -MemoryMinimumBytes $memoryMinimumBytes -MemoryMaximumBytes $memoryMaximumBytes -ProcessorCount $processorCount -CheckpointType Disabled -ErrorAction Stop
+                }
+                Else {
+                    Hyper-V\Set-VM $newvm -StaticMemory -MemoryStartupBytes $memoryBytes -ProcessorCount $processorCount -CheckpointType Disabled -ErrorAction Stop
+                }
+                If ($memoryWeight -gt 0) {
+                    Hyper-V\Set-VMMemory -VM $newvm -Priority $memoryWeight -ErrorAction Stop
+                }
 
-            $result.Success = $true
+                $result.Success = $true
+            }
         }
         Catch {
-            $result.ErrorMessage = $_.ToString()
+            seterror $result $_
         }
     }
 
     $result | ConvertTo-Json
 }
 
+# New-KuttiDifferencingDisk creates a differencing disk. Changes made
+# by a VM using the disk are stored in it, and the parent is unchanged.
+Function New-KuttiDifferencingDisk() {
+    param (
+        [string]
+        $parentPath,
+        [string]
+        $diskPath
+    )
+
+    $result = getresult
+    Try {
+        Hyper-V\New-VHD -Path $diskPath -ParentPath $parentPath -Differencing -ErrorAction Stop | Out-Null
+        $result.Success = $true
+    }
+    Catch {
+        seterror $result $_
+    }
+
+    $result | ConvertTo-Json
+}
+
 Function Wait-KuttiVM() {
     param (
         [string]
@@ -197,6 +609,7 @@ Function Wait-KuttiVM() {
     $result = getresult
     If ([string]::IsNullOrEmpty($machineName) -or [string]::IsNullOrEmpty($machineStatus)) {
         $result.ErrorMessage = "machine name or machinestatus not specified"
+        $result.ErrorCode = "InvalidArgument"
     }
     Else {
         $params = @{}
@@ -210,18 +623,18 @@ Function Wait-KuttiVM() {
         }
 
         Try {
-            Hyper-V\Wait-VM -ErrorAction Stop Hyper-V\-VMName $machineName -Timeout $timeOutSeconds @params
+            Hyper-V\Wait-VM -ErrorAction Stop -VMName $machineName -Timeout $timeOutSeconds @params
 
             $vmresult = getkuttivmobject $machineName
             $result.Success = $true
             $result.PayLoad = $vmresult
         }
         Catch {
-            $result.ErrorMessage = $_.ToString()
+            seterror $result $_ $machineName
         }
     }
 
-    $result | ConvertTo-Json
+    $result | ConvertTo-Json -Depth 5
 }
 
 Function Remove-KuttiVM() {
@@ -233,6 +646,7 @@ Function Remove-KuttiVM() {
     $result = getresult
     If ([string]::IsNullOrEmpty($machineName)) {
         $result.ErrorMessage = "machine name not specified"
+        $result.ErrorCode = "InvalidArgument"
     }
     Else {
         Try {
@@ -241,35 +655,573 @@ Function Remove-KuttiVM() {
             $result.Success = $true
         }
         Catch {
-            $result.ErrorMessage = $_.ToString()
+            seterror $result $_ $machineName
         }
     }
 
     $result | ConvertTo-Json
 }
 
+# Resize-KuttiVMDisk grows the first disk of a stopped VM. Disks cannot
+# be shrunk.
+Function Resize-KuttiVMDisk() {
+    param (
+        [string]
+        $machineName,
+        [int64]
+        $sizeBytes
+    )
+
+    $result = getresult
+    Try {
+        $vm = Hyper-V\Get-VM -Name $machineName -ErrorAction Stop
+        $disk = @(Hyper-V\Get-VMHardDiskDrive -VM $vm)[0]
+        If ($vm.State -ne "Off") {
+            $result.ErrorMessage = "machine '$machineName' should be off to resize its disk"
+            $result.ErrorCode = "InvalidState"
+        }
+        ElseIf ($null -eq $disk) {
+            $result.ErrorMessage = "machine '$machineName' has no disk"
+            $result.ErrorCode = "InvalidState"
+        }
+        Else {
+            $vhd = Hyper-V\Get-VHD -Path $disk.Path -ErrorAction Stop
+            If ($sizeBytes -lt $vhd.Size) {
+                $result.ErrorMessage = "disk of machine '$machineName' is $($vhd.Size) bytes, and cannot be shrunk to $sizeBytes bytes"
+                $result.ErrorCode = "InvalidArgument"
+            }
+            Else {
+                If ($sizeBytes -gt $vhd.Size) {
+                    Hyper-V\Resize-VHD -Path $disk.Path -SizeBytes $sizeBytes -ErrorAction Stop
+                }
+                $result.Success = $true
+                $result.PayLoad = [PSCustomObject]@{
+                    OldSizeBytes = $vhd.Size;
+                    SizeBytes    = $sizeBytes;
+                }
+            }
+        }
+    }
+    Catch {
+        seterror $result $_ $machineName
+    }
+
+    $result | ConvertTo-Json
+}
+
+# New-KuttiDataDisk creates an empty dynamically expanding disk.
+Function New-KuttiDataDisk() {
+    param (
+        [string]
+        $diskPath,
+        [int64]
+        $sizeBytes
+    )
+
+    $result = getresult
+    Try {
+        Hyper-V\New-VHD -Path $diskPath -SizeBytes $sizeBytes -Dynamic -ErrorAction Stop | Out-Null
+        $result.Success = $true
+    }
+    Catch {
+        seterror $result $_
+    }
+
+    $result | ConvertTo-Json
+}
+
+# Get-KuttiVMDisks returns the disks attached to a VM.
+Function Get-KuttiVMDisks() {
+    param (
+        [string]
+        $machineName
+    )
+
+    $result = getresult
+    Try {
+        $disks = @(Hyper-V\Get-VMHardDiskDrive -VMName $machineName -ErrorAction Stop |
+            Select-Object Path,
+            @{Name = "ControllerType"; Expression = { $_.ControllerType.ToString() } },
+            ControllerNumber,
+            ControllerLocation)
+
+        $result.Success = $true
+        $result.PayLoad = [PSCustomObject]@{
+            Disks = $disks
+        }
+    }
+    Catch {
+        seterror $result $_ $machineName
+    }
+
+    $result | ConvertTo-Json -Depth 5
+}
+
+# Add-KuttiVMDisk attaches a disk to the SCSI controller of a VM. This
+# can be done while the VM is running.
+Function Add-KuttiVMDisk() {
+    param (
+        [string]
+        $machineName,
+        [string]
+        $diskPath
+    )
+
+    $result = getresult
+    Try {
+        Hyper-V\Add-VMHardDiskDrive -VMName $machineName -ControllerType SCSI -Path $diskPath -ErrorAction Stop
+        $result.Success = $true
+    }
+    Catch {
+        seterror $result $_ $machineName
+    }
+
+    $result | ConvertTo-Json
+}
+
+# Remove-KuttiVMDisk detaches a disk from a VM. The disk is not deleted.
+Function Remove-KuttiVMDisk() {
+    param (
+        [string]
+        $machineName,
+        [string]
+        $diskPath
+    )
+
+    $result = getresult
+    Try {
+        $drive = Hyper-V\Get-VMHardDiskDrive -VMName $machineName -ErrorAction Stop |
+            Where-Object { $_.Path -eq $diskPath }
+        If ($null -eq $drive) {
+            $result.ErrorMessage = "disk '$diskPath' is not attached to machine '$machineName'"
+            $result.ErrorCode = "InvalidArgument"
+        }
+        Else {
+            Hyper-V\Remove-VMHardDiskDrive -VMHardDiskDrive $drive -ErrorAction Stop
+            $result.Success = $true
+        }
+    }
+    Catch {
+        seterror $result $_ $machineName
+    }
+
+    $result | ConvertTo-Json
+}
+
+# getkuttisnapshot returns the named checkpoint of a VM, or sets a
+# CheckpointNotFound error in the result and returns $null.
+Function getkuttisnapshot {
+    param(
+        $result,
+        [string] $machineName,
+        [string] $checkpointName
+    )
+
+    # Get-VM fails if the machine does not exist
+    Hyper-V\Get-VM -Name $machineName -ErrorAction Stop | Out-Null
+    $snapshot = Hyper-V\Get-VMSnapshot -VMName $machineName -Name $checkpointName -ErrorAction SilentlyContinue
+    If ($null -eq $snapshot) {
+        $result.ErrorMessage = "checkpoint '$checkpointName' of machine '$machineName' not found"
+        $result.ErrorCode = "CheckpointNotFound"
+    }
+
+    Return $snapshot
+}
+
+# New-KuttiVMCheckpoint creates a checkpoint of a VM. Checkpoints are
+# disabled for kutti VMs, so they are enabled with the specified type
+# only while the checkpoint is created. Production checkpoints need
+# guest support; if it is not available, the operation fails.
+Function New-KuttiVMCheckpoint() {
+    param (
+        [string]
+        $machineName,
+        [string]
+        $checkpointName,
+        [string]
+        $checkpointType
+    )
+
+    $result = getresult
+    Try {
+        $vm = Hyper-V\Get-VM -Name $machineName -ErrorAction Stop
+        $existing = Hyper-V\Get-VMSnapshot -VM $vm -Name $checkpointName -ErrorAction SilentlyContinue
+        If ($null -ne $existing) {
+            $result.ErrorMessage = "checkpoint '$checkpointName' of machine '$machineName' already exists"
+            $result.ErrorCode = "InvalidArgument"
+        }
+        Else {
+            $type = "Standard"
+            If ($checkpointType -eq "Production") {
+                $type = "ProductionOnly"
+            }
+
+            Hyper-V\Set-VM -VM $vm -CheckpointType $type -ErrorAction Stop
+            Try {
+                Hyper-V\Checkpoint-VM -VM $vm -SnapshotName $checkpointName -ErrorAction Stop
+            }
+            Finally {
+                Hyper-V\Set-VM -VM $vm -CheckpointType Disabled
+            }
+            $result.Success = $true
+        }
+    }
+    Catch {
+        seterror $result $_ $machineName
+    }
+
+    $result | ConvertTo-Json
+}
+
+# Get-KuttiVMCheckpoints returns the checkpoints of a VM.
+Function Get-KuttiVMCheckpoints() {
+    param (
+        [string]
+        $machineName
+    )
+
+    $result = getresult
+    Try {
+        $checkpoints = @(Hyper-V\Get-VMSnapshot -VMName $machineName -ErrorAction Stop |
+            Select-Object Name,
+            @{Name = "CreationTime"; Expression = { $_.CreationTime.ToUniversalTime().ToString("o") } },
+            @{Name = "ParentName"; Expression = { IfNull $_.ParentSnapshotName "" } })
+
+        $result.Success = $true
+        $result.PayLoad = [PSCustomObject]@{
+            Checkpoints = $checkpoints
+        }
+    }
+    Catch {
+        seterror $result $_ $machineName
+    }
+
+    $result | ConvertTo-Json -Depth 5
+}
+
+# Restore-KuttiVMCheckpoint applies a checkpoint to a VM.
+Function Restore-KuttiVMCheckpoint() {
+    param (
+        [string]
+        $machineName,
+        [string]
+        $checkpointName
+    )
+
+    $result = getresult
+    Try {
+        $snapshot = getkuttisnapshot $result $machineName $checkpointName
+        If ($null -ne $snapshot) {
+            Hyper-V\Restore-VMSnapshot -VMSnapshot $snapshot -Confirm:$false -ErrorAction Stop
+            $result.Success = $true
+        }
+    }
+    Catch {
+        seterror $result $_ $machineName
+    }
+
+    $result | ConvertTo-Json
+}
+
+# Remove-KuttiVMCheckpoint deletes a checkpoint of a VM. Its changes are
+# merged into the parent disk.
+Function Remove-KuttiVMCheckpoint() {
+    param (
+        [string]
+        $machineName,
+        [string]
+        $checkpointName
+    )
+
+    $result = getresult
+    Try {
+        $snapshot = getkuttisnapshot $result $machineName $checkpointName
+        If ($null -ne $snapshot) {
+            Hyper-V\Remove-VMSnapshot -VMSnapshot $snapshot -ErrorAction Stop
+            $result.Success = $true
+        }
+    }
+    Catch {
+        seterror $result $_ $machineName
+    }
+
+    $result | ConvertTo-Json
+}
+
+# The parameters accepted by each command. Each parameter has a type,
+# and may be required. Requests with missing required parameters,
+# parameters of the wrong type or unknown parameters are rejected.
+$commandSchemas = @{
+    "checkdriver"         = @{}
+    "diagnose"            = @{
+        MachinePath = @{ Type = "string"; Required = $false }
+        DiskPath    = @{ Type = "string"; Required = $false }
+        CachePath   = @{ Type = "string"; Required = $false }
+        SwitchName  = @{ Type = "string"; Required = $false }
+    }
+    "hostcapacity"        = @{
+        MachineName = @{ Type = "string"; Required = $false }
+        DiskPath    = @{ Type = "string"; Required = $false }
+    }
+    "listmachines"        = @{}
+    "getmachine"          = @{
+        MachineName = @{ Type = "string"; Required = $true }
+    }
+    "startmachine"        = @{
+        MachineName = @{ Type = "string"; Required = $true }
+    }
+    "stopmachine"         = @{
+        MachineName = @{ Type = "string"; Required = $true }
+    }
+    "forcestopmachine"    = @{
+        MachineName = @{ Type = "string"; Required = $true }
+    }
+    "pausemachine"        = @{
+        MachineName = @{ Type = "string"; Required = $true }
+    }
+    "resumemachine"       = @{
+        MachineName = @{ Type = "string"; Required = $true }
+    }
+    "savemachine"         = @{
+        MachineName = @{ Type = "string"; Required = $true }
+    }
+    "newdifferencingdisk" = @{
+        ParentPath = @{ Type = "string"; Required = $true }
+        DiskPath   = @{ Type = "string"; Required = $true }
+    }
+    "waitmachine"         = @{
+        MachineName    = @{ Type = "string"; Required = $true }
+        MachineStatus  = @{ Type = "string"; Required = $true }
+        TimeoutSeconds = @{ Type = "int"; Required = $false }
+    }
+    "deletemachine"       = @{
+        MachineName = @{ Type = "string"; Required = $true }
+    }
+    "resizedisk"          = @{
+        MachineName = @{ Type = "string"; Required = $true }
+        SizeBytes   = @{ Type = "int"; Required = $true }
+    }
+    "newdatadisk"         = @{
+        DiskPath  = @{ Type = "string"; Required = $true }
+        SizeBytes = @{ Type = "int"; Required = $true }
+    }
+    "listdisks"           = @{
+        MachineName = @{ Type = "string"; Required = $true }
+    }
+    "attachdisk"          = @{
+        MachineName = @{ Type = "string"; Required = $true }
+        DiskPath    = @{ Type = "string"; Required = $true }
+    }
+    "detachdisk"          = @{
+        MachineName = @{ Type = "string"; Required = $true }
+        DiskPath    = @{ Type = "string"; Required = $true }
+    }
+    "newcheckpoint"       = @{
+        MachineName    = @{ Type = "string"; Required = $true }
+        CheckpointName = @{ Type = "string"; Required = $true }
+        CheckpointType = @{ Type = "string"; Required = $true }
+    }
+    "listcheckpoints"     = @{
+        MachineName = @{ Type = "string"; Required = $true }
+    }
+    "restorecheckpoint"   = @{
+        MachineName    = @{ Type = "string"; Required = $true }
+        CheckpointName = @{ Type = "string"; Required = $true }
+    }
+    "deletecheckpoint"    = @{
+        MachineName    = @{ Type = "string"; Required = $true }
+        CheckpointName = @{ Type = "string"; Required = $true }
+    }
+    "newmachine"          = @{
+        MachineName        = @{ Type = "string"; Required = $true }
+        MachinePath        = @{ Type = "string"; Required = $true }
+        VHDPath            = @{ Type = "string"; Required = $true }
+        MemoryBytes        = @{ Type = "int"; Required = $true }
+        ProcessorCount     = @{ Type = "int"; Required = $true }
+        SwitchName         = @{ Type = "string"; Required = $true }
+        DynamicMemory      = @{ Type = "bool"; Required = $false }
+        MemoryMinimumBytes = @{ Type = "int"; Required = $false }
+        MemoryMaximumBytes = @{ Type = "int"; Required = $false }
+        MemoryWeight       = @{ Type = "int"; Required = $false }
+        Generation         = @{ Type = "int"; Required = $false }
+        SecureBootTemplate = @{ Type = "string"; Required = $false }
+        EnableTPM          = @{ Type = "bool"; Required = $false }
+    }
+}
+
+Function testparametertype {
+    param(
+        $value,
+        [string] $type
+    )
+
+    Switch ($type) {
+        "string" { Return $value -is [string] }
+        "int" { Return ($value -is [int]) -or ($value -is [long]) }
+        "bool" { Return $value -is [bool] }
+    }
+
+    Return $false
+}
+
+# Test-KuttiRequest validates a request against the schema of its
+# command. It returns an error message, or an empty string if the
+# request is valid.
+Function Test-KuttiRequest() {
+    param (
+        $request
+    )
+
+    If ($null -eq $request -or -not ($request.Command -is [string])) {
+        Return "command not specified"
+    }
+
+    $schema = $commandSchemas[$request.Command.ToLowerInvariant()]
+    If ($null -eq $schema) {
+        Return "invalid command: " + $request.Command
+    }
+
+    $parameters = @{}
+    If ($null -ne $request.Parameters) {
+        ForEach ($property in $request.Parameters.PSObject.Properties) {
+            $parameters[$property.Name] = $property.Value
+        }
+    }
+
+    ForEach ($name in $parameters.Keys) {
+        If (-not $schema.ContainsKey($name)) {
+            Return "unknown parameter: " + $name
+        }
+        If (-not (testparametertype $parameters[$name] $schema[$name].Type)) {
+            Return "parameter " + $name + " should be of type " + $schema[$name].Type
+        }
+    }
+
+    ForEach ($name in $schema.Keys) {
+        If ($schema[$name].Required -and -not $parameters.ContainsKey($name)) {
+            Return "missing parameter: " + $name
+        }
+    }
+
+    Return ""
+}
+
+Function Invoke-KuttiRequest() {
+    param (
+        $request
+    )
+
+    $validationerror = Test-KuttiRequest $request
+    If ($validationerror -ne "") {
+        $result = getresult
+        $result.ErrorMessage = "invalid request: " + $validationerror
+        $result.ErrorCode = "InvalidArgument"
+
+        Return $result | ConvertTo-Json
+    }
+
+    $p = $request.Parameters
+    Switch ($request.Command.ToLowerInvariant()) {
+        "checkdriver" { Test-Driver }
+        "diagnose" { Get-KuttiDiagnosis $p.MachinePath $p.DiskPath $p.CachePath $p.SwitchName }
+        "hostcapacity" { Get-KuttiHostCapacity $p.MachineName $p.DiskPath }
+        "listmachines" { Get-KuttiVMList }
+        "getmachine" { Get-KuttiVM $p.MachineName }
+        "startmachine" { Start-KuttiVM $p.MachineName }
+        "stopmachine" { Stop-KuttiVM $p.MachineName $false }
+        "forcestopmachine" { Stop-KuttiVM $p.MachineName $true }
+        "pausemachine" { Suspend-KuttiVM $p.MachineName }
+        "resumemachine" { Resume-KuttiVM $p.MachineName }
+        "savemachine" { Save-KuttiVM $p.MachineName }
+        "waitmachine" { Wait-KuttiVM $p.MachineName $p.MachineStatus (IfNull $p.TimeoutSeconds 0) }
+        "deletemachine" { Remove-KuttiVM $p.MachineName }
+        "newdifferencingdisk" { New-KuttiDifferencingDisk $p.ParentPath $p.DiskPath }
+        "resizedisk" { Resize-KuttiVMDisk $p.MachineName $p.SizeBytes }
+        "newdatadisk" { New-KuttiDataDisk $p.DiskPath $p.SizeBytes }
+        "listdisks" { Get-KuttiVMDisks $p.MachineName }
+        "attachdisk" { Add-KuttiVMDisk $p.MachineName $p.DiskPath }
+        "detachdisk" { Remove-KuttiVMDisk $p.MachineName $p.DiskPath }
+        "newcheckpoint" { New-KuttiVMCheckpoint $p.MachineName $p.CheckpointName $p.CheckpointType }
+        "listcheckpoints" { Get-KuttiVMCheckpoints $p.MachineName }
+        "restorecheckpoint" { Restore-KuttiVMCheckpoint $p.MachineName $p.CheckpointName }
+        "deletecheckpoint" { Remove-KuttiVMCheckpoint $p.MachineName $p.CheckpointName }
+        "newmachine" { New-KuttiVM $p.MachineName $p.MachinePath $p.VHDPath $p.MemoryBytes $p.ProcessorCount $p.SwitchName (IfNull $p.DynamicMemory $false) (IfNull $p.MemoryMinimumBytes 0) (IfNull $p.MemoryMaximumBytes 0) (IfNull $p.MemoryWeight 0) (IfNull $p.Generation 1) $p.SecureBootTemplate (IfNull $p.EnableTPM $false) }
+    }
+}
+
+# ConvertFrom-KuttiRequest decodes a request passed on the command line.
+# Requests are passed as base64-encoded UTF-8 JSON documents, like
+# {"Command":"getmachine","Parameters":{"MachineName":"name"}}.
+Function ConvertFrom-KuttiRequest() {
+    param (
+        [string]
+        $encodedRequest
+    )
+
+    $requestjson = [System.Text.Encoding]::UTF8.GetString([Convert]::FromBase64String($encodedRequest))
+    Return $requestjson | ConvertFrom-Json
+}
+
+# Start-KuttiSession reads requests from standard input, one per line,
+# and writes responses to standard output, one per line. A request
+# looks like {"Id":1,"Request":{"Command":"getmachine",...}}, and a
+# response looks like {"Id":1,"Result":{...}}. The session ends when
+# standard input is closed.
+Function Start-KuttiSession() {
+    While ($true) {
+        $line = [Console]::In.ReadLine()
+        If ($null -eq $line) {
+            Break
+        }
+        If ([string]::IsNullOrWhiteSpace($line)) {
+            Continue
+        }
+
+        $response = [PSCustomObject]@{
+            Id     = 0;
+            Result = $null;
+        }
+        Try {
+            $sessionrequest = $line | ConvertFrom-Json
+            $response.Id = $sessionrequest.Id
+            $output = Invoke-KuttiRequest $sessionrequest.Request | Out-String
+            $response.Result = $output | ConvertFrom-Json
+        }
+        Catch {
+            $result = getresult
+            seterror $result $_
+            $response.Result = $result
+        }
+
+        [Console]::Out.WriteLine(($response | ConvertTo-Json -Compress -Depth 10))
+        [Console]::Out.Flush()
+    }
+}
+
 If ($args.Count -eq 0) {
     $result = getresult
     $result.ErrorMessage = "interface arguments not specified"
+    $result.ErrorCode = "InvalidArgument"
     
     $result | ConvertTo-Json
     break
 }
 
-Switch ($args[0].ToString().ToLowerInvariant()) {
-    "checkdriver" { Test-Driver }
-    "listmachines" { Get-KuttiVMList }
-    "getmachine" { Get-KuttiVM $args[1] }
-    "startmachine" { Start-KuttiVM $args[1] }
-    "stopmachine" { Stop-KuttiVM $args[1] $false }
-    "forcestopmachine" { Stop-KuttiVM $args[1] $true }
-    "waitmachine" { Wait-KuttiVM $args[1] $args[2] $args[3] }
-    "deletemachine" { Remove-KuttiVM $args[1] }
-    "newmachine" { New-KuttiVM $args[1] $args[2] $args[3] }
-    Default {
+If ($args[0].ToString() -eq "session") {
+    Start-KuttiSession
+}
+Else {
+    Try {
+        $request = ConvertFrom-KuttiRequest $args[0]
+    }
+    Catch {
         $result = getresult
-        $result.ErrorMessage = "invalid interface argument: " + $args[0]
-        
-        $result | ConvertTo-Json    
+        $result.ErrorMessage = "could not decode request: " + $_.ToString()
+        $result.ErrorCode = "InvalidArgument"
+
+        $result | ConvertTo-Json
+        break
     }
+
+    Invoke-KuttiRequest $request
 }
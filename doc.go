@@ -11,6 +11,13 @@
 // For images, it uses the aforesaid VHDX files, downloading the list
 // from the URL pointed to by the ImagesSourceURL variable.
 //
+// By default, the driver manages Hyper-V on the local machine. It can
+// also manage a remote Hyper-V host over WinRM. See NewRemoteDriver.
+//
+// For troubleshooting, every interaction of the driver with Hyper-V and
+// with machines can be recorded to a trace file, using EnableTrace. A
+// trace file can be replayed using NewReplayExecutor.
+//
 // The details of individual operations can be found in the online
 // documentation. Details about the interface between the driver and
 // a running VM can be found at the driver-hyperv-images project:
@@ -14,6 +14,9 @@ func (vd *Driver) UpdateImageList() error {
 // ValidK8sVersion returns true if the specified Kubernetes version is currently
 // supported.
 func (vd *Driver) ValidK8sVersion(k8sversion string) bool {
+	imagemutex.Lock()
+	defer imagemutex.Unlock()
+
 	err := imageconfigmanager.Load()
 	if err != nil {
 		return false
@@ -25,6 +28,9 @@ func (vd *Driver) ValidK8sVersion(k8sversion string) bool {
 
 // K8sVersions returns all Kubernetes versions currently supported.
 func (vd *Driver) K8sVersions() []string {
+	imagemutex.Lock()
+	defer imagemutex.Unlock()
+
 	err := imageconfigmanager.Load()
 	if err != nil {
 		return []string{}
@@ -42,6 +48,9 @@ func (vd *Driver) K8sVersions() []string {
 
 // ListImages lists the currently available Images.
 func (vd *Driver) ListImages() ([]drivercore.Image, error) {
+	imagemutex.Lock()
+	defer imagemutex.Unlock()
+
 	err := imageconfigmanager.Load()
 	if err != nil {
 		return []drivercore.Image{}, err
@@ -59,6 +68,9 @@ func (vd *Driver) ListImages() ([]drivercore.Image, error) {
 
 // GetImage returns an image corresponding to a Kubernetes version, or an error.
 func (vd *Driver) GetImage(k8sversion string) (drivercore.Image, error) {
+	imagemutex.Lock()
+	defer imagemutex.Unlock()
+
 	err := imageconfigmanager.Load()
 	if err != nil {
 		return nil, err
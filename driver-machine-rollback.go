@@ -0,0 +1,94 @@
+package driverhyperv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kuttiproject/kuttilog"
+)
+
+// creationstep is a completed step in the creation of a machine, and
+// how to undo it.
+type creationstep struct {
+	description string
+	undo        func(ctx context.Context) error
+}
+
+// creationsteps records the completed steps in the creation of a
+// machine, so that they can be undone if a later step fails.
+type creationsteps struct {
+	steps []creationstep
+}
+
+// done records that a step has been completed. The description should
+// complete the sentence "could not ...".
+func (cs *creationsteps) done(description string, undo func(ctx context.Context) error) {
+	cs.steps = append(cs.steps, creationstep{description: description, undo: undo})
+}
+
+// rollback undoes the completed steps, in reverse order. A failure to
+// undo a step does not stop the others from being undone. It does not
+// use the caller's context, because the creation may have failed
+// because that context was done.
+func (cs *creationsteps) rollback() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	var errs []error
+	for i := len(cs.steps) - 1; i >= 0; i-- {
+		step := cs.steps[i]
+		kuttilog.Printf(kuttilog.Debug, "Rolling back: %v...", step.description)
+
+		err := step.undo(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not %v: %w", step.description, err))
+		}
+	}
+	cs.steps = nil
+
+	return errors.Join(errs...)
+}
+
+// undoscriptcommand returns an undo function that runs an interface
+// script command on a machine. Failures because the machine does not
+// exist, or is already in the desired state, are ignored.
+func (vd *Driver) undoscriptcommand(command string, operation string, qualifiedmachinename string) func(context.Context) error {
+	return func(ctx context.Context) error {
+		result, err := vd.runwithresults(
+			ctx,
+			command,
+			scriptparams{
+				"MachineName": qualifiedmachinename,
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		if !result.Success {
+			operr := newoperationerror(operation, qualifiedmachinename, result)
+			if errors.Is(operr, ErrMachineNotFound) || errors.Is(operr, ErrInvalidState) {
+				return nil
+			}
+			return operr
+		}
+
+		return nil
+	}
+}
+
+// undofile returns an undo function that removes a file or directory,
+// if it exists.
+func undofile(path string) func(context.Context) error {
+	return func(context.Context) error {
+		err := os.RemoveAll(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,169 @@
+package driverhyperv_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	driverhyperv "github.com/kuttiproject/driver-hyperv"
+	"github.com/kuttiproject/workspace"
+)
+
+// failingexecutor fails the specified commands, with the specified
+// error codes.
+type failingexecutor struct {
+	*sshfakeexecutor
+	failing map[string]string
+}
+
+func (fe *failingexecutor) Execute(ctx context.Context, request *driverhyperv.ScriptRequest) (*driverhyperv.DriverResult, error) {
+	if errorcode, ok := fe.failing[request.Command]; ok {
+		fe.mutex.Lock()
+		fe.requests = append(fe.requests, request)
+		fe.mutex.Unlock()
+
+		return &driverhyperv.DriverResult{
+			ErrorMessage: "the operation failed",
+			ErrorCode:    errorcode,
+		}, nil
+	}
+
+	return fe.sshfakeexecutor.Execute(ctx, request)
+}
+
+func TestNewMachineRollback(t *testing.T) {
+	newtestworkspace(t)
+
+	fe := &failingexecutor{
+		sshfakeexecutor: &sshfakeexecutor{fakeexecutor: newfakeexecutor()},
+		failing:         map[string]string{"startmachine": "InvalidState"},
+	}
+	driver := driverhyperv.NewDriverWithExecutor(fe)
+	qname := driver.QualifiedMachineName("node1", "test")
+	diskdir, _ := workspace.CacheSubDir("driver-hyperv-disks")
+	diskfile := filepath.Join(diskdir, qname+".vhdx")
+
+	machine, err := driver.NewMachine("node1", "test", "1.27")
+	if !errors.Is(err, driverhyperv.ErrInvalidState) {
+		t.Fatalf("Expected ErrInvalidState creating unstartable machine, got %v", err)
+	}
+	if machine != nil {
+		t.Errorf("Expected no machine to be returned, got %v", machine)
+	}
+
+	// The completed steps should be undone in reverse order
+	var commands []string
+	for _, request := range fe.requests {
+		commands = append(commands, request.Command)
+	}
+	expected := "newmachine,startmachine,forcestopmachine,deletemachine"
+	if !strings.HasSuffix(strings.Join(commands, ","), expected) {
+		t.Errorf("Expected commands to end with %v, got %v", expected, commands)
+	}
+	if _, ok := fe.machines[qname]; ok {
+		t.Errorf("Expected failed machine to be removed")
+	}
+	if _, err := os.Stat(diskfile); !os.IsNotExist(err) {
+		t.Errorf("Expected disk of failed machine to be deleted")
+	}
+
+	// A failure to undo a step is reported along with the original error
+	fe.failing["deletemachine"] = "InsufficientPermissions"
+	_, err = driver.NewMachine("node1", "test", "1.27")
+	if !errors.Is(err, driverhyperv.ErrInvalidState) || !strings.Contains(err.Error(), "could not remove host") {
+		t.Errorf("Expected error reporting the failed cleanup, got %v", err)
+	}
+	if _, err := os.Stat(diskfile); !os.IsNotExist(err) {
+		t.Errorf("Expected disk of failed machine to be deleted after failed cleanup")
+	}
+	delete(fe.failing, "deletemachine")
+	driver.DeleteMachine("node1", "test")
+
+	// An existing machine, or its disk, is neither overwritten nor removed
+	delete(fe.failing, "startmachine")
+	_, err = driver.NewMachine("node1", "test", "1.27")
+	if err != nil {
+		t.Fatalf("Error creating machine: %v", err)
+	}
+	err = os.WriteFile(diskfile, []byte("existing disk"), 0644)
+	if err != nil {
+		t.Fatalf("Error writing disk: %v", err)
+	}
+	checkexisting := func(wantmachine bool) {
+		t.Helper()
+		_, err := driver.NewMachine("node1", "test", "1.27")
+		if !errors.Is(err, driverhyperv.ErrMachineExists) {
+			t.Errorf("Expected ErrMachineExists creating existing machine, got %v", err)
+		}
+		if _, ok := fe.machines[qname]; ok != wantmachine {
+			t.Errorf("Expected existing machine to be left alone")
+		}
+		content, err := os.ReadFile(diskfile)
+		if err != nil || string(content) != "existing disk" {
+			t.Errorf("Expected existing disk to be left alone, got %q, %v", content, err)
+		}
+	}
+	checkexisting(true)
+
+	fe.mutex.Lock()
+	delete(fe.machines, qname)
+	fe.mutex.Unlock()
+	checkexisting(false)
+
+	// A machine that appears while the disk is being imported is not
+	// removed either
+	err = os.Remove(diskfile)
+	if err != nil {
+		t.Fatalf("Error removing disk: %v", err)
+	}
+	fe.mutex.Lock()
+	fe.machines[qname] = "Off"
+	fe.mutex.Unlock()
+	fe.failing["getmachine"] = "MachineNotFound"
+	fe.failing["newmachine"] = "MachineExists"
+	requestcount := len(fe.requests)
+	_, err = driver.NewMachine("node1", "test", "1.27")
+	if !errors.Is(err, driverhyperv.ErrMachineExists) {
+		t.Errorf("Expected ErrMachineExists creating existing machine, got %v", err)
+	}
+	for _, request := range fe.requests[requestcount:] {
+		if request.Command == "deletemachine" {
+			t.Errorf("Expected existing machine not to be deleted")
+		}
+	}
+	if _, ok := fe.machines[qname]; !ok {
+		t.Errorf("Expected existing machine to be left alone")
+	}
+	delete(fe.failing, "getmachine")
+	delete(fe.failing, "newmachine")
+	fe.failing["startmachine"] = "InvalidState"
+	driver.DeleteMachine("node1", "test")
+
+	// Failed machines can be kept for debugging
+	config, err := driver.Config()
+	if err != nil {
+		t.Fatalf("Error loading configuration: %v", err)
+	}
+	config.KeepFailedMachines = true
+	err = driver.SetConfig(config)
+	if err != nil {
+		t.Fatalf("Error setting configuration: %v", err)
+	}
+
+	machine, err = driver.NewMachine("node1", "test", "1.27")
+	if err == nil {
+		t.Fatalf("Expected error creating unstartable machine")
+	}
+	if machine == nil {
+		t.Errorf("Expected the failed machine to be returned")
+	}
+	if _, ok := fe.machines[qname]; !ok {
+		t.Errorf("Expected failed machine to be kept")
+	}
+	if _, err := os.Stat(diskfile); err != nil {
+		t.Errorf("Expected disk of failed machine to be kept: %v", err)
+	}
+}
@@ -1,6 +1,8 @@
 package driverhyperv
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -14,7 +16,12 @@ import (
 func currentusershortname() string {
 	// Windows populates the environment variable USERNAME with the login name of the
 	// current user.
-	return os.ExpandEnv("$USERNAME")
+	username := os.ExpandEnv("$USERNAME")
+	if username == "" {
+		// Linux, including WSL, populates USER instead.
+		username = os.ExpandEnv("$USER")
+	}
+	return username
 }
 
 // QualifiedMachineName returns a name in the form <username>-<clustername>-<machinename>.
@@ -29,7 +36,14 @@ func (vd *Driver) QualifiedMachineName(machinename string, clustername string) s
 //   Get-VM -Name <machinename>
 // through an interface script.
 func (vd *Driver) GetMachine(machinename string, clustername string) (drivercore.Machine, error) {
-	if !vd.validate() {
+	return vd.GetMachineContext(context.Background(), machinename, clustername)
+}
+
+// GetMachineContext returns the named machine, or an error, like GetMachine.
+// If the context is done before the operation completes, the operation is
+// abandoned and the context's error is returned.
+func (vd *Driver) GetMachineContext(ctx context.Context, machinename string, clustername string) (drivercore.Machine, error) {
+	if !vd.validate(ctx) {
 		return nil, vd
 	}
 
@@ -40,7 +54,7 @@ func (vd *Driver) GetMachine(machinename string, clustername string) (drivercore
 		status:      drivercore.MachineStatusUnknown,
 	}
 
-	err := machine.get()
+	err := machine.get(ctx)
 
 	if err != nil {
 		return nil, err
@@ -49,17 +63,40 @@ func (vd *Driver) GetMachine(machinename string, clustername string) (drivercore
 	return machine, nil
 }
 
-func deletemachinefiles(qualifiedmachinename string) error {
-	// Delete machine disk
-	destdir, _ := diskDir()
+func (vd *Driver) deletemachinefiles(qualifiedmachinename string) error {
+	// Delete machine disk. If it is already gone, the other files are
+	// still deleted.
+	destdir, err := vd.diskDir()
+	if err != nil {
+		return err
+	}
 	destfile := filepath.Join(destdir, qualifiedmachinename+".vhdx")
-	err := os.Remove(destfile)
+	err = os.Remove(destfile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	err = removeimagechild(destfile)
+	if err != nil {
+		return err
+	}
+
+	// Delete data disks
+	err = vd.deletedatadisks(qualifiedmachinename)
+	if err != nil {
+		return err
+	}
+
+	// Delete checkpoint disks
+	err = vd.deletecheckpointfiles(qualifiedmachinename)
 	if err != nil {
 		return err
 	}
 
 	// Delete VM directory
-	machinepathbase, _ := machineDir()
+	machinepathbase, err := vd.machineDir()
+	if err != nil {
+		return err
+	}
 	machinepath := filepath.Join(machinepathbase, qualifiedmachinename)
 	err = os.RemoveAll(machinepath)
 	if err != nil {
@@ -73,27 +110,38 @@ func deletemachinefiles(qualifiedmachinename string) error {
 // It does this by running the Cmdlet:
 //   Remove-VM -Name <machinename> -Force
 // through an interface script.
-// It also deletes the VM disk files and the directory containing the VM files.
+// It also deletes the VM disk files, including any data disks and checkpoint
+// disks, and the directory containing the VM files.
 func (vd *Driver) DeleteMachine(machinename string, clustername string) error {
-	if !vd.validate() {
+	return vd.DeleteMachineContext(context.Background(), machinename, clustername)
+}
+
+// DeleteMachineContext completely deletes a Machine, like DeleteMachine.
+// If the context is done before the machine is removed from Hyper-V, the
+// operation is abandoned and the context's error is returned.
+func (vd *Driver) DeleteMachineContext(ctx context.Context, machinename string, clustername string) error {
+	if !vd.validate(ctx) {
 		return vd
 	}
 
 	qualifiedmachinename := vd.QualifiedMachineName(machinename, clustername)
 	output, err := vd.runwithresults(
+		ctx,
 		"deletemachine",
-		qualifiedmachinename,
+		scriptparams{
+			"MachineName": qualifiedmachinename,
+		},
 	)
 
 	if err != nil {
-		return fmt.Errorf("could not delete machine %s: %v", machinename, err)
+		return fmt.Errorf("could not delete machine '%s': %w", machinename, err)
 	}
 
 	if !output.Success {
-		return fmt.Errorf("could not delete machine %s: %v", machinename, output.ErrorMessage)
+		return newoperationerror("delete machine", machinename, output)
 	}
 
-	err = deletemachinefiles(qualifiedmachinename)
+	err = vd.deletemachinefiles(qualifiedmachinename)
 	if err != nil {
 		return err
 	}
@@ -105,22 +153,134 @@ func (vd *Driver) DeleteMachine(machinename string, clustername string) error {
 // It also starts the VM, changes the hostname, saves the IP address, and stops
 // it again.
 // It starts by copying the VHDX file appropriate for the specified k8sversion
-// to the driver cache location for VM disks.
+// to the driver cache location for VM disks. For a remote host, the disk
+// is copied to the storage directory of the host instead. If differencing
+// disks are configured, a differencing disk whose parent is the VHDX file
+// is created instead of the copy. See DriverConfig.DifferencingDisks.
 // It then runs the following Cmdlets, in order:
-//   $newvm = New-VM -Name $machineName -Generation 1 -Path $machinePath -VHDPath $vhdpath -SwitchName "Default Switch"
-//   Set-VM $newvm -StaticMemory -MemoryStartupBytes 2147483648 -ProcessorCount 2 -CheckpointType Disabled
-// through an interface script.
+//   $newvm = New-VM -Name $machineName -Generation 1 -Path $machinePath -VHDPath $vhdpath -SwitchName $switchName
+//   Set-VM $newvm -StaticMemory -MemoryStartupBytes $memoryBytes -ProcessorCount $processorCount -CheckpointType Disabled
+// through an interface script. For a machine with dynamic memory, Set-VM is
+// run with -DynamicMemory and the minimum and maximum memory instead, and for
+// a machine with a memory weight, Set-VMMemory -Priority is also run.
 // The first creates a Hyper-V "Generation 1" VM which uses the VHDX file mentioned
-// above, and connects it to the Hyper-V default network switch.
-// The second turns off dynamic memory and checkpoints on the VM, and sets memory
-// to 2GB and core count to 2 (hardcoded for now).
+// above, and connects it to the configured virtual switch, by default the Hyper-V
+// default network switch. If the image list specifies that the image needs a
+// "Generation 2" VM, one is created instead, with the Secure Boot template and
+// virtual TPM specified for the image. See Image.Generation.
+// The second turns off checkpoints on the VM, and sets memory and core count
+// as configured, by default 2GB of static memory and 2 cores. See DriverConfig.
+// To create a VM with different processors or memory, or with dynamic memory,
+// use NewMachineWithSpec.
+// Before copying the image, it checks that the host has enough free disk
+// space for the copy, and enough free memory and logical processors for
+// the VM, and returns an *InsufficientResourcesError if not.
+// If any step fails, the steps already completed are undone in reverse
+// order: the VM is turned off and removed, and its disk and directory are
+// deleted. No Machine is returned in that case. To keep a failed VM for
+// debugging, set DriverConfig.KeepFailedMachines.
 func (vd *Driver) NewMachine(machinename string, clustername string, k8sversion string) (drivercore.Machine, error) {
-	if !vd.validate() {
+	return vd.NewMachineContext(context.Background(), machinename, clustername, k8sversion)
+}
+
+// NewMachineContext creates a VM, like NewMachine. If the context is done
+// before the operation completes, the operation is abandoned, and the
+// context's error is returned. Any interface script or SSH command that
+// is running at the time is abandoned.
+func (vd *Driver) NewMachineContext(ctx context.Context, machinename string, clustername string, k8sversion string) (drivercore.Machine, error) {
+	if !vd.validate(ctx) {
 		return nil, vd
 	}
 
+	newmachine, err := vd.newmachine(ctx, machinename, clustername, k8sversion, nil, nil)
+	if newmachine == nil {
+		return nil, err
+	}
+
+	return newmachine, err
+}
+
+// NewMachineWithSpec creates a VM like NewMachine, with the virtual
+// processors and memory described by spec instead of the configured
+// defaults. The spec is kept by Hyper-V, and can be inspected later
+// using the Spec method of the Machine.
+func (vd *Driver) NewMachineWithSpec(machinename string, clustername string, k8sversion string, spec MachineSpec) (*Machine, error) {
+	return vd.NewMachineWithSpecContext(context.Background(), machinename, clustername, k8sversion, spec)
+}
+
+// NewMachineWithSpecContext creates a VM like NewMachineWithSpec. If the
+// context is done before the operation completes, the operation is
+// abandoned, and the context's error is returned.
+func (vd *Driver) NewMachineWithSpecContext(ctx context.Context, machinename string, clustername string, k8sversion string, spec MachineSpec) (*Machine, error) {
+	err := spec.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if !vd.validate(ctx) {
+		return nil, vd
+	}
+
+	return vd.newmachine(ctx, machinename, clustername, k8sversion, &spec, nil)
+}
+
+// newmachine creates a VM. If spec is nil, the configured defaults are
+// used. If the stage callback is not nil, it is called as each stage of
+// the operation begins.
+// Each completed step is recorded. If a later step fails, the completed
+// steps are undone in reverse order, and no machine is returned, unless
+// the driver is configured to keep failed machines.
+func (vd *Driver) newmachine(ctx context.Context, machinename string, clustername string, k8sversion string, spec *MachineSpec, stage func(MachineStage)) (created *Machine, err error) {
+	if stage == nil {
+		stage = func(MachineStage) {}
+	}
+
+	config, err := loaddriverconfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var steps creationsteps
+	defer func() {
+		if err == nil || len(steps.steps) == 0 {
+			return
+		}
+
+		if config.KeepFailedMachines {
+			kuttilog.Printf(kuttilog.Info, "Keeping failed host '%v' for debugging.", machinename)
+			return
+		}
+
+		stage(MachineStageCleaningUp)
+		kuttilog.Printf(kuttilog.Info, "Cleaning up failed host '%v'...", machinename)
+		rollbackerr := steps.rollback()
+		if rollbackerr != nil {
+			err = fmt.Errorf("%w (cleanup also failed: %v)", err, rollbackerr)
+		}
+		created = nil
+	}()
+
+	if spec == nil {
+		defaultspec := config.MachineSpec()
+		spec = &defaultspec
+	}
+
 	qualifiedmachinename := vd.QualifiedMachineName(machinename, clustername)
 
+	destdir, err := vd.diskDir()
+	if err != nil {
+		return nil, err
+	}
+	destfile := filepath.Join(destdir, qualifiedmachinename+".vhdx")
+
+	// Nothing that belongs to an existing machine should be overwritten,
+	// or removed if creation fails
+	err = vd.checkmachinenotexists(ctx, machinename, qualifiedmachinename, destfile)
+	if err != nil {
+		return nil, err
+	}
+
+	stage(MachineStageImporting)
 	kuttilog.Println(kuttilog.Info, "Importing image...")
 
 	vhdfile, err := imagepathfromk8sversion(k8sversion)
@@ -128,85 +288,186 @@ func (vd *Driver) NewMachine(machinename string, clustername string, k8sversion
 		return nil, err
 	}
 
-	if _, err = os.Stat(vhdfile); err != nil {
+	vhdinfo, err := os.Stat(vhdfile)
+	if err != nil {
 		return nil, fmt.Errorf("could not retrieve image %s: %v", vhdfile, err)
 	}
 
-	destdir, err := diskDir()
+	// Images added from a file may not be in the image list. They
+	// are treated as Generation 1 images.
+	bootimage := catalogimage(k8sversion)
+	if bootimage == nil {
+		bootimage = &Image{imageK8sVersion: k8sversion}
+	}
+	err = bootimage.validatebootoptions()
 	if err != nil {
 		return nil, err
 	}
 
-	destfile := filepath.Join(destdir, qualifiedmachinename+".vhdx")
-	err = workspace.CopyFile(vhdfile, destfile, 524288000, true)
-	if err != nil {
-		return nil, fmt.Errorf("could not import image %s: %v", vhdfile, err)
+	differencing := config.DifferencingDisks
+	if differencing && vd.remote != nil {
+		kuttilog.Println(kuttilog.Info, "Warning: differencing disks are not supported for remote hosts. Copying image instead.")
+		differencing = false
+	}
+	if differencing {
+		err = vd.checkdifferencingparent(vhdfile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !config.AllowOvercommit {
+		// A new differencing disk takes almost no space
+		imagebytes := vhdinfo.Size()
+		if differencing {
+			imagebytes = 0
+		}
+		err = vd.preflightnewmachine(ctx, machinename, *spec, imagebytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	deletedisk := func(ctx context.Context) error {
+		err := undofile(destfile)(ctx)
+		if err != nil {
+			return err
+		}
+		return removeimagechild(destfile)
+	}
+	if differencing {
+		// The disk was checked not to exist above, and an abandoned
+		// New-VHD may leave a partial disk behind, so the step is
+		// recorded before it is attempted
+		steps.done("delete disk", deletedisk)
+		err = vd.newdifferencingdisk(ctx, k8sversion, vhdfile, destfile)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// The disk file is claimed before the copy, so that a partial
+		// copy is removed, but a file created by anyone else is not
+		err = createexclusive(destfile)
+		if err != nil {
+			return nil, fmt.Errorf("could not import image %s: %w", vhdfile, err)
+		}
+		steps.done("delete disk", deletedisk)
+
+		err = workspace.CopyFile(vhdfile, destfile, 524288000, true)
+		if err != nil {
+			return nil, fmt.Errorf("could not import image %s: %v", vhdfile, err)
+		}
+	}
+
+	// The copy itself cannot be interrupted, so check for
+	// cancellation after it is done.
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
 	}
 
 	// Create new VM
-	machinepath, _ := machineDir()
+	stage(MachineStageCreating)
+	machinepath, _ := vd.machineDir()
+	hostmachinepath, err := vd.hostpath(machinepath)
+	if err != nil {
+		return nil, err
+	}
+	hostdestfile, err := vd.hostpath(destfile)
+	if err != nil {
+		return nil, err
+	}
 
 	newmachine := &Machine{
 		driver:      vd,
 		name:        machinename,
 		clustername: clustername,
 		status:      drivercore.MachineStatus("Creating"),
+		spec:        *spec,
+	}
+
+	params := spec.scriptparams()
+	params["MachineName"] = qualifiedmachinename
+	params["MachinePath"] = hostmachinepath
+	params["VHDPath"] = hostdestfile
+	params["SwitchName"] = config.SwitchName
+	if bootimage.Generation() == 2 {
+		params["Generation"] = 2
+		if bootimage.SecureBootTemplate() != "" {
+			params["SecureBootTemplate"] = bootimage.SecureBootTemplate()
+		}
+		if bootimage.TPM() {
+			params["EnableTPM"] = true
+		}
+	}
+
+	// The VM directory may be left over from an earlier machine
+	vmdir := filepath.Join(machinepath, qualifiedmachinename)
+	_, staterr := os.Stat(vmdir)
+	vmdirexisted := staterr == nil
+
+	result, err := vd.runwithresults(ctx, "newmachine", params)
+
+	// A failed or abandoned New-VM may leave a partial VM behind, unless
+	// it failed because a VM of the same name already exists. That VM
+	// is not ours to remove.
+	if err != nil || !errors.Is(scripterrors[result.ErrorCode], ErrMachineExists) {
+		if !vmdirexisted {
+			steps.done("delete VM directory", undofile(vmdir))
+		}
+		steps.done("remove host", vd.undoscriptcommand("deletemachine", "delete machine", qualifiedmachinename))
 	}
 
-	result, err := vd.runwithresults("newmachine", qualifiedmachinename, machinepath, destfile)
 	if err != nil {
-		return nil, fmt.Errorf("could not create host '%v': %v", machinename, err)
+		return nil, fmt.Errorf("could not create host '%v': %w", machinename, err)
 	}
 
 	if !result.Success {
-		deletemachinefiles(qualifiedmachinename)
+		return nil, newoperationerror("create host", machinename, result)
+	}
 
-		return nil, fmt.Errorf("could not create host '%v': %v", machinename, result.ErrorMessage)
+	if spec.DiskSizeGB > 0 {
+		err = newmachine.resizedisk(ctx, int64(spec.DiskSizeGB)<<30)
+		if err != nil {
+			return newmachine, err
+		}
 	}
 
 	// Start the host
+	stage(MachineStageStarting)
 	kuttilog.Println(kuttilog.Info, "Starting host...")
-	err = newmachine.Start()
+	steps.done("stop host", vd.undoscriptcommand("forcestopmachine", "force stop the host", qualifiedmachinename))
+	err = newmachine.start(ctx)
 	if err != nil {
 		return newmachine, err
 	}
-	// TODO: Try to parameterize the timeout
-	newmachine.WaitForStateChange(25)
-
-	// Save the IP Address
-	// The first IP address should be DHCP-assigned.
-	// This may fail if we check too soon. So, we check
-	// up to three times.
-	ipSet := false
-	for ipretries := 1; ipretries < 4; ipretries++ {
-		kuttilog.Printf(kuttilog.Info, "Fetching IP address (attempt %v/3)...", ipretries)
-
-		if newmachine.savedipaddress != "" {
-			// TODO: verify IP address here
-			kuttilog.Printf(kuttilog.Info, "Obtained IP address '%v'", newmachine.savedipaddress)
-			ipSet = true
-			break
-		}
-
-		kuttilog.Printf(kuttilog.Info, "Failed. Waiting %v seconds before retry...", ipretries*10)
-		time.Sleep(time.Duration(ipretries*10) * time.Second)
-
-		newmachine.get()
+	err = newmachine.WaitForStateChangeContext(ctx, config.WaitTimeoutSeconds)
+	if err != nil && ctx.Err() != nil {
+		return newmachine, err
 	}
 
-	if !ipSet {
-		kuttilog.Printf(0, "Error: Failed to get IP address. You may have to delete this node and recreate it manually.")
+	// Wait for the IP Address
+	// The first IPv4 address should be DHCP-assigned.
+	stage(MachineStageFetchingIP)
+	kuttilog.Println(kuttilog.Info, "Waiting for IP address...")
+	err = newmachine.WaitForReadyContext(ctx, config.ReadyTimeoutSeconds, ProbeRunning, ProbeIPv4)
+	if err != nil {
+		return newmachine, err
 	}
+	kuttilog.Printf(kuttilog.Info, "Obtained IP address '%v'", newmachine.currentipaddress())
 
 	// Change the name
-	for renameretries := 1; renameretries < 4; renameretries++ {
-		kuttilog.Printf(kuttilog.Info, "Renaming host (attempt %v/3)...", renameretries)
-		err = renamemachine(newmachine, machinename)
-		if err == nil {
+	stage(MachineStageRenaming)
+	for renameretries := 1; renameretries <= config.RenameRetries; renameretries++ {
+		kuttilog.Printf(kuttilog.Info, "Renaming host (attempt %v/%v)...", renameretries, config.RenameRetries)
+		err = renamemachinecontext(ctx, newmachine, machinename)
+		if err == nil || ctx.Err() != nil {
 			break
 		}
 		kuttilog.Printf(kuttilog.Info, "Failed. Waiting %v seconds before retry...", renameretries*10)
-		time.Sleep(time.Duration(renameretries*10) * time.Second)
+		err = sleepcontext(ctx, time.Duration(renameretries*10)*time.Second)
+		if err != nil {
+			break
+		}
 	}
 
 	if err != nil {
@@ -214,10 +475,118 @@ func (vd *Driver) NewMachine(machinename string, clustername string, k8sversion
 	}
 	kuttilog.Println(kuttilog.Info, "Host renamed.")
 
+	// If the disk was resized, and the file system was not grown when
+	// the host started, grow it now
+	newmachine.growpendingfilesystem(ctx)
+
+	stage(MachineStageStopping)
 	kuttilog.Println(kuttilog.Info, "Stopping host...")
-	newmachine.Stop()
+	err = newmachine.StopContext(ctx)
+	if err != nil && ctx.Err() != nil {
+		return newmachine, err
+	}
 
-	newmachine.status = drivercore.MachineStatusStopped
+	newmachine.setstatus(drivercore.MachineStatusStopped)
 
 	return newmachine, nil
 }
+
+// checkmachinenotexists returns an error wrapping ErrMachineExists if a
+// VM with the qualified name, or its disk file, already exists.
+func (vd *Driver) checkmachinenotexists(ctx context.Context, machinename string, qualifiedmachinename string, diskfile string) error {
+	result, err := vd.runwithresults(
+		ctx,
+		"getmachine",
+		scriptparams{
+			"MachineName": qualifiedmachinename,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("could not create host '%v': %w", machinename, err)
+	}
+
+	if result.Success {
+		return fmt.Errorf("could not create host '%v': %w", machinename, ErrMachineExists)
+	}
+
+	geterr := newoperationerror("get the host", machinename, result)
+	if !errors.Is(geterr, ErrMachineNotFound) {
+		return geterr
+	}
+
+	_, err = os.Stat(diskfile)
+	if err == nil {
+		return fmt.Errorf("could not create host '%v': %w: disk %v already exists", machinename, ErrMachineExists, diskfile)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// createexclusive creates an empty file, and fails with an error wrapping
+// ErrMachineExists if the file already exists.
+func createexclusive(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%w: disk %v already exists", ErrMachineExists, path)
+	}
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// newdifferencingdisk creates a differencing disk whose parent is the
+// cached image for a Kubernetes version. The disk is recorded as a child
+// of the image before it is created, so that the image cannot be removed
+// while the disk is being created.
+func (vd *Driver) newdifferencingdisk(ctx context.Context, k8sversion string, parentfile string, destfile string) error {
+	hostparentfile, err := vd.hostpath(parentfile)
+	if err != nil {
+		return err
+	}
+	hostdestfile, err := vd.hostpath(destfile)
+	if err != nil {
+		return err
+	}
+
+	err = addimagechild(k8sversion, destfile)
+	if err != nil {
+		return fmt.Errorf("could not use image %s as parent disk: %v", parentfile, err)
+	}
+
+	result, err := vd.runwithresults(
+		ctx,
+		"newdifferencingdisk",
+		scriptparams{
+			"ParentPath": hostparentfile,
+			"DiskPath":   hostdestfile,
+		},
+	)
+	if err == nil && !result.Success {
+		err = newoperationerror("create differencing disk", "", result)
+	}
+	if err != nil {
+		removeimagechild(destfile)
+		return fmt.Errorf("could not import image %s: %w", parentfile, err)
+	}
+
+	return nil
+}
+
+// sleepcontext waits for the specified duration, or until the context
+// is done. In the latter case, it returns the context's error.
+func sleepcontext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,212 @@
+package driverhyperv
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/kuttiproject/drivercore"
+)
+
+// MachineStage is a stage in the creation of a machine.
+type MachineStage string
+
+// The stages in the creation of a machine, in order. A machine ends
+// in either MachineStageDone or MachineStageFailed.
+const (
+	MachineStageQueued     = MachineStage("Queued")
+	MachineStageImporting  = MachineStage("Importing image")
+	MachineStageCreating   = MachineStage("Creating")
+	MachineStageStarting   = MachineStage("Starting")
+	MachineStageFetchingIP = MachineStage("Fetching IP address")
+	MachineStageRenaming   = MachineStage("Renaming")
+	MachineStageStopping   = MachineStage("Stopping")
+	MachineStageCleaningUp = MachineStage("Cleaning up")
+	MachineStageDone       = MachineStage("Done")
+	MachineStageFailed     = MachineStage("Failed")
+)
+
+// MachineProgress reports that the creation of a machine has reached a
+// new stage. Err is set if the stage is MachineStageFailed.
+type MachineProgress struct {
+	MachineName string
+	Stage       MachineStage
+	Err         error
+}
+
+// NewMachineResult is the outcome of creating one machine with
+// NewMachines. Exactly one of Machine and Err is set.
+type NewMachineResult struct {
+	MachineName string
+	Machine     drivercore.Machine
+	Err         error
+}
+
+// NewMachinesError is returned by NewMachines when one or more machines
+// could not be created. It wraps the errors for individual machines,
+// so errors.Is and errors.As can be used to examine them.
+type NewMachinesError struct {
+	// Total is the number of machines that were requested.
+	Total int
+	// Failed holds the results for the machines that were not created.
+	Failed []NewMachineResult
+}
+
+func (nme *NewMachinesError) Error() string {
+	failures := make([]string, len(nme.Failed))
+	for i, result := range nme.Failed {
+		failures[i] = fmt.Sprintf("%v: %v", result.MachineName, result.Err)
+	}
+
+	return fmt.Sprintf(
+		"could not create %v of %v machines: %v",
+		len(nme.Failed),
+		nme.Total,
+		strings.Join(failures, "; "),
+	)
+}
+
+// Unwrap returns the errors for the machines that were not created.
+func (nme *NewMachinesError) Unwrap() []error {
+	result := make([]error, len(nme.Failed))
+	for i, failed := range nme.Failed {
+		result[i] = failed.Err
+	}
+	return result
+}
+
+// NewMachines creates the named machines in a cluster, like NewMachine,
+// creating up to parallelism machines at a time. If parallelism is less
+// than 1, machines are created one at a time.
+// Results are returned in the same order as the names. A machine that
+// could not be created is cleaned up, so that each machine is either
+// fully created or does not exist, unless DriverConfig.KeepFailedMachines
+// is set. If any machine could not be created,
+// a *NewMachinesError is returned along with the results.
+// Before creating any machine, it checks that the host can fit all of
+// them, and returns an *InsufficientResourcesError and no results if
+// not. See NewMachine.
+func (vd *Driver) NewMachines(clustername string, k8sversion string, machinenames []string, parallelism int) ([]NewMachineResult, error) {
+	return vd.NewMachinesContext(context.Background(), clustername, k8sversion, machinenames, parallelism, nil)
+}
+
+// NewMachinesContext creates machines like NewMachines, and reports the
+// progress of each machine through the progress callback, which can be
+// nil. The callback is never called concurrently. If the context is done,
+// machines that are being created are abandoned and cleaned up, and
+// machines that have not been started are not created.
+func (vd *Driver) NewMachinesContext(ctx context.Context, clustername string, k8sversion string, machinenames []string, parallelism int, progress func(MachineProgress)) ([]NewMachineResult, error) {
+	if !vd.validate(ctx) {
+		return nil, vd
+	}
+
+	seen := map[string]bool{}
+	for _, machinename := range machinenames {
+		if seen[machinename] {
+			return nil, fmt.Errorf("machine name '%v' specified more than once", machinename)
+		}
+		seen[machinename] = true
+	}
+
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	// All the machines are checked before any is created, so that
+	// machines created in parallel do not all count on the same free
+	// memory and disk space
+	config, err := loaddriverconfig()
+	if err != nil {
+		return nil, err
+	}
+	if !config.AllowOvercommit {
+		imagebytes, err := vd.newmachinediskbytes(config, k8sversion)
+		if err != nil {
+			return nil, err
+		}
+
+		err = vd.preflightnewmachines(ctx, machinenames, config.MachineSpec(), imagebytes, parallelism)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var progressmutex sync.Mutex
+	report := func(machinename string, stage MachineStage, err error) {
+		if progress == nil {
+			return
+		}
+
+		progressmutex.Lock()
+		defer progressmutex.Unlock()
+
+		progress(MachineProgress{
+			MachineName: machinename,
+			Stage:       stage,
+			Err:         err,
+		})
+	}
+
+	results := make([]NewMachineResult, len(machinenames))
+	for i, machinename := range machinenames {
+		results[i].MachineName = machinename
+		report(machinename, MachineStageQueued, nil)
+	}
+
+	slots := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, machinename := range machinenames {
+		wg.Add(1)
+		go func(result *NewMachineResult) {
+			defer wg.Done()
+
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				result.Err = ctx.Err()
+				report(machinename, MachineStageFailed, result.Err)
+				return
+			}
+
+			newmachine, err := vd.newmachine(
+				ctx,
+				machinename,
+				clustername,
+				k8sversion,
+				nil,
+				func(stage MachineStage) {
+					report(machinename, stage, nil)
+				},
+			)
+			if err != nil {
+				result.Err = err
+				report(machinename, MachineStageFailed, err)
+				return
+			}
+
+			result.Machine = newmachine
+			report(machinename, MachineStageDone, nil)
+		}(&results[i])
+	}
+	wg.Wait()
+
+	var failed []NewMachineResult
+	for _, result := range results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+
+	if len(failed) > 0 {
+		return results, &NewMachinesError{
+			Total:  len(machinenames),
+			Failed: failed,
+		}
+	}
+
+	return results, nil
+}
@@ -0,0 +1,93 @@
+package driverhyperv_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	driverhyperv "github.com/kuttiproject/driver-hyperv"
+	"github.com/kuttiproject/workspace"
+)
+
+// unstartableexecutor fails to start one machine.
+type unstartableexecutor struct {
+	*sshfakeexecutor
+	unstartable string
+}
+
+func (ue *unstartableexecutor) Execute(ctx context.Context, request *driverhyperv.ScriptRequest) (*driverhyperv.DriverResult, error) {
+	if request.Command == "startmachine" && request.Parameter("MachineName") == ue.unstartable {
+		return &driverhyperv.DriverResult{
+			ErrorMessage: "the virtual machine could not be started",
+			ErrorCode:    "InvalidState",
+		}, nil
+	}
+
+	return ue.sshfakeexecutor.Execute(ctx, request)
+}
+
+func TestNewMachines(t *testing.T) {
+	newtestworkspace(t)
+
+	fe := &sshfakeexecutor{fakeexecutor: newfakeexecutor()}
+	ue := &unstartableexecutor{sshfakeexecutor: fe}
+	driver := driverhyperv.NewDriverWithExecutor(ue)
+	ue.unstartable = driver.QualifiedMachineName("node3", "test")
+
+	var progressmutex sync.Mutex
+	finalstages := map[string]driverhyperv.MachineStage{}
+	progress := func(mp driverhyperv.MachineProgress) {
+		progressmutex.Lock()
+		defer progressmutex.Unlock()
+		finalstages[mp.MachineName] = mp.Stage
+	}
+
+	names := []string{"node1", "node2", "node3", "node4"}
+	results, err := driver.NewMachinesContext(context.Background(), "test", "1.27", names, 2, progress)
+
+	var machineserr *driverhyperv.NewMachinesError
+	if !errors.As(err, &machineserr) {
+		t.Fatalf("Expected NewMachinesError, got %v", err)
+	}
+	if len(machineserr.Failed) != 1 || machineserr.Failed[0].MachineName != "node3" {
+		t.Errorf("Expected only node3 to fail, got %v", err)
+	}
+	if !errors.Is(err, driverhyperv.ErrInvalidState) {
+		t.Errorf("Expected error to wrap ErrInvalidState, got %v", err)
+	}
+
+	if len(results) != len(names) {
+		t.Fatalf("Expected %v results, got %v", len(names), len(results))
+	}
+	for i, result := range results {
+		if result.MachineName != names[i] {
+			t.Errorf("Expected result %v for %v, got %v", i, names[i], result.MachineName)
+		}
+
+		expectedstage := driverhyperv.MachineStageDone
+		if result.MachineName == "node3" {
+			expectedstage = driverhyperv.MachineStageFailed
+			if result.Machine != nil || result.Err == nil {
+				t.Errorf("Expected node3 to have failed, got %v", result)
+			}
+		} else if result.Machine == nil || result.Err != nil {
+			t.Errorf("Expected %v to be created, got error %v", result.MachineName, result.Err)
+		}
+
+		if finalstages[result.MachineName] != expectedstage {
+			t.Errorf("Expected final stage of %v to be %v, got %v", result.MachineName, expectedstage, finalstages[result.MachineName])
+		}
+	}
+
+	// The failed machine should have been cleaned up
+	if _, ok := fe.machines[ue.unstartable]; ok {
+		t.Errorf("Expected failed machine to be deleted")
+	}
+	diskdir, _ := workspace.CacheSubDir("driver-hyperv-disks")
+	if _, err := os.Stat(filepath.Join(diskdir, ue.unstartable+".vhdx")); !os.IsNotExist(err) {
+		t.Errorf("Expected disk of failed machine to be deleted")
+	}
+}
@@ -0,0 +1,478 @@
+package driverhyperv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// OrphanKind is the kind of an orphaned machine artifact.
+type OrphanKind string
+
+// The OrphanKind* constants are the kinds of orphaned artifacts.
+// OrphanDisk is a disk file, or the directory holding the data disks of
+// a machine, and OrphanMachineDirectory is a VM directory, whose Hyper-V
+// VM no longer exists. OrphanMachine is a
+// Hyper-V VM none of whose attached disks exist any more.
+const (
+	OrphanDisk             = OrphanKind("Disk")
+	OrphanMachineDirectory = OrphanKind("MachineDirectory")
+	OrphanMachine          = OrphanKind("Machine")
+)
+
+// Orphan is a machine artifact that has lost its counterpart.
+type Orphan struct {
+	Kind OrphanKind
+	// MachineName is the qualified name of the Hyper-V VM that the
+	// artifact belongs to.
+	MachineName string
+	// Path is the path of the file or directory, as seen by the driver.
+	// It is empty for an OrphanMachine.
+	Path string
+	// SizeBytes is the size of the file or directory. For an
+	// OrphanMachine, it is the size of the VM directory, data disks and
+	// checkpoint disks that are removed along with it.
+	SizeBytes int64
+}
+
+// FindOrphans cross-references the Hyper-V VMs of the current user with
+// the files in the driver's disk and VM directories, and returns the
+// artifacts that have lost their counterparts, in order of kind and
+// machine name. Only artifacts named for the current user are
+// considered. See QualifiedMachineName. Because cluster names can
+// contain hyphens, the artifacts of a user whose name is the current
+// user's name followed by a hyphen and more cannot be told apart from
+// those of the current user.
+// It should not be called while machines are being created, because
+// the disk of a machine is created before its VM.
+func (vd *Driver) FindOrphans() ([]Orphan, error) {
+	return vd.FindOrphansContext(context.Background())
+}
+
+// FindOrphansContext finds orphaned artifacts, like FindOrphans. If the
+// context is done before the operation completes, the operation is
+// abandoned and the context's error is returned.
+func (vd *Driver) FindOrphansContext(ctx context.Context) ([]Orphan, error) {
+	if !vd.validate(ctx) {
+		return nil, vd
+	}
+
+	return vd.findorphans(ctx)
+}
+
+// CleanupOrphans finds orphaned artifacts like FindOrphans, and removes
+// them. An orphaned disk file or VM directory is deleted. An orphaned VM
+// is turned off and removed from Hyper-V, and its VM directory, data
+// disks and checkpoint disks are deleted.
+// If dryrun is true, nothing is removed. The orphans that were removed,
+// or would have been, are returned. If some could not be removed, the
+// others are still removed, and an error describing the failures is
+// returned along with the ones that were.
+func (vd *Driver) CleanupOrphans(dryrun bool) ([]Orphan, error) {
+	return vd.CleanupOrphansContext(context.Background(), dryrun)
+}
+
+// CleanupOrphansContext removes orphaned artifacts, like CleanupOrphans.
+// If the context is done before the operation completes, the operation
+// is abandoned and the context's error is returned.
+func (vd *Driver) CleanupOrphansContext(ctx context.Context, dryrun bool) ([]Orphan, error) {
+	if !vd.validate(ctx) {
+		return nil, vd
+	}
+
+	orphans, err := vd.findorphans(ctx)
+	if err != nil || dryrun {
+		return orphans, err
+	}
+
+	removed := []Orphan{}
+	var errs []error
+	for _, orphan := range orphans {
+		if ctx.Err() != nil {
+			return removed, ctx.Err()
+		}
+
+		err = vd.removeorphan(ctx, orphan)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed = append(removed, orphan)
+	}
+
+	return removed, errors.Join(errs...)
+}
+
+func (vd *Driver) findorphans(ctx context.Context) ([]Orphan, error) {
+	machinenames, err := vd.listmachinenames(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	diskdir, err := vd.diskDir()
+	if err != nil {
+		return nil, err
+	}
+	machinedir, err := vd.machineDir()
+	if err != nil {
+		return nil, err
+	}
+
+	// Only VMs named <user>-<cluster>-<machine> belong to the driver
+	userprefix := currentusershortname() + "-"
+	machines := map[string][]string{}
+	for _, machinename := range machinenames {
+		if !isqualifiedname(machinename, userprefix) {
+			continue
+		}
+
+		diskpaths, err := vd.listattacheddisks(ctx, machinename)
+		if errors.Is(err, ErrMachineNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		machines[machinename] = diskpaths
+	}
+
+	hostdiskdir, err := vd.hostpath(diskdir)
+	if err != nil {
+		return nil, err
+	}
+
+	// attachedpaths returns the disks in the disk directory, at or below
+	// a path, that are attached to a VM of the current user
+	attachedpaths := func(path string) []string {
+		relpath, _ := filepath.Rel(diskdir, path)
+		attached := []string{}
+		for _, diskpaths := range machines {
+			for _, diskpath := range diskpaths {
+				diskrelpath, ok := hostrelpath(hostdiskdir, diskpath)
+				if ok && (strings.EqualFold(diskrelpath, relpath) || hasprefixfold(diskrelpath, relpath+string(filepath.Separator))) {
+					attached = append(attached, diskpath)
+				}
+			}
+		}
+		return attached
+	}
+
+	orphans := []Orphan{}
+
+	diskentries, err := os.ReadDir(diskdir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range diskentries {
+		owner := artifactowner(entry.Name(), entry.IsDir(), userprefix)
+		if owner == "" {
+			continue
+		}
+		if _, ok := machines[owner]; ok {
+			continue
+		}
+
+		diskpath := filepath.Join(diskdir, entry.Name())
+		if len(attachedpaths(diskpath)) > 0 {
+			continue
+		}
+
+		orphans = append(orphans, Orphan{
+			Kind:        OrphanDisk,
+			MachineName: owner,
+			Path:        diskpath,
+			SizeBytes:   pathsize(diskpath),
+		})
+	}
+
+	machineentries, err := os.ReadDir(machinedir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range machineentries {
+		if !entry.IsDir() || !isqualifiedname(entry.Name(), userprefix) {
+			continue
+		}
+		if _, ok := machines[entry.Name()]; ok {
+			continue
+		}
+
+		dirpath := filepath.Join(machinedir, entry.Name())
+		orphans = append(orphans, Orphan{
+			Kind:        OrphanMachineDirectory,
+			MachineName: entry.Name(),
+			Path:        dirpath,
+			SizeBytes:   pathsize(dirpath),
+		})
+	}
+
+	for machinename, diskpaths := range machines {
+		if anydiskexists(diskdir, hostdiskdir, diskpaths) {
+			continue
+		}
+
+		sizebytes := pathsize(filepath.Join(machinedir, machinename))
+		sizebytes += pathsize(filepath.Join(diskdir, machinename+datadiskdirsuffix))
+		diskfiles, _ := vd.checkpointfiles(machinename)
+		for _, diskfile := range diskfiles {
+			sizebytes += pathsize(diskfile)
+		}
+
+		orphans = append(orphans, Orphan{
+			Kind:        OrphanMachine,
+			MachineName: machinename,
+			SizeBytes:   sizebytes,
+		})
+	}
+
+	sort.Slice(orphans, func(i, j int) bool {
+		if orphans[i].Kind != orphans[j].Kind {
+			return orphans[i].Kind < orphans[j].Kind
+		}
+		if orphans[i].MachineName != orphans[j].MachineName {
+			return orphans[i].MachineName < orphans[j].MachineName
+		}
+		return orphans[i].Path < orphans[j].Path
+	})
+
+	return orphans, nil
+}
+
+func (vd *Driver) removeorphan(ctx context.Context, orphan Orphan) error {
+	switch orphan.Kind {
+	case OrphanDisk:
+		err := os.RemoveAll(orphan.Path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return removeimagechild(orphan.Path)
+	case OrphanMachineDirectory:
+		return os.RemoveAll(orphan.Path)
+	case OrphanMachine:
+		params := scriptparams{
+			"MachineName": orphan.MachineName,
+		}
+
+		// A running machine has to be turned off before it can be removed.
+		// A machine that is already off, or already gone, is fine.
+		result, err := vd.runwithresults(ctx, "forcestopmachine", params)
+		if err != nil {
+			return fmt.Errorf("could not force stop machine '%s': %w", orphan.MachineName, err)
+		}
+		if !result.Success {
+			operr := newoperationerror("force stop machine", orphan.MachineName, result)
+			if !errors.Is(operr, ErrMachineNotFound) && !errors.Is(operr, ErrInvalidState) {
+				return operr
+			}
+		}
+
+		result, err = vd.runwithresults(ctx, "deletemachine", params)
+		if err != nil {
+			return fmt.Errorf("could not delete machine '%s': %w", orphan.MachineName, err)
+		}
+		if !result.Success {
+			return newoperationerror("delete machine", orphan.MachineName, result)
+		}
+
+		// The disk is already gone, but it may still be recorded as
+		// the child of an image
+		diskdir, err := vd.diskDir()
+		if err != nil {
+			return err
+		}
+		err = removeimagechild(filepath.Join(diskdir, orphan.MachineName+".vhdx"))
+		if err != nil {
+			return err
+		}
+
+		err = vd.deletedatadisks(orphan.MachineName)
+		if err != nil {
+			return err
+		}
+		err = vd.deletecheckpointfiles(orphan.MachineName)
+		if err != nil {
+			return err
+		}
+
+		machinedir, err := vd.machineDir()
+		if err != nil {
+			return err
+		}
+		return os.RemoveAll(filepath.Join(machinedir, orphan.MachineName))
+	default:
+		return fmt.Errorf("unknown orphan kind '%v'", orphan.Kind)
+	}
+}
+
+// listmachinenames returns the names of all Hyper-V VMs on the host.
+func (vd *Driver) listmachinenames(ctx context.Context) ([]string, error) {
+	result, err := vd.runwithresults(ctx, "listmachines", nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not list machines: %w", err)
+	}
+
+	if !result.Success {
+		return nil, newoperationerror("list machines", "", result)
+	}
+
+	var machinedata struct {
+		VMList []struct {
+			Name string
+		}
+	}
+	err = decodepayload(result.Payload, &machinedata)
+	if err != nil {
+		return nil, fmt.Errorf("could not list machines: %v", err)
+	}
+
+	machinenames := make([]string, len(machinedata.VMList))
+	for i, vm := range machinedata.VMList {
+		machinenames[i] = vm.Name
+	}
+
+	return machinenames, nil
+}
+
+// listattacheddisks returns the paths, as seen by the host, of the disks
+// attached to a Hyper-V VM.
+func (vd *Driver) listattacheddisks(ctx context.Context, qualifiedmachinename string) ([]string, error) {
+	result, err := vd.runwithresults(
+		ctx,
+		"listdisks",
+		scriptparams{
+			"MachineName": qualifiedmachinename,
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not list disks of machine '%s': %w", qualifiedmachinename, err)
+	}
+
+	if !result.Success {
+		return nil, newoperationerror("list disks of machine", qualifiedmachinename, result)
+	}
+
+	var diskdata struct {
+		Disks []struct {
+			Path string
+		}
+	}
+	err = decodepayload(result.Payload, &diskdata)
+	if err != nil {
+		return nil, fmt.Errorf("could not list disks of machine '%s': %v", qualifiedmachinename, err)
+	}
+
+	diskpaths := make([]string, len(diskdata.Disks))
+	for i, disk := range diskdata.Disks {
+		diskpaths[i] = disk.Path
+	}
+
+	return diskpaths, nil
+}
+
+// anydiskexists returns true if any of the disks attached to a VM still
+// exists. The disks are checked through the driver's disk directory.
+// A disk stored anywhere else cannot be checked, and is assumed to
+// exist.
+func anydiskexists(diskdir string, hostdiskdir string, hostdiskpaths []string) bool {
+	for _, hostdiskpath := range hostdiskpaths {
+		relpath, ok := hostrelpath(hostdiskdir, hostdiskpath)
+		if !ok {
+			return true
+		}
+
+		_, err := os.Stat(filepath.Join(diskdir, relpath))
+		if !errors.Is(err, os.ErrNotExist) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hostrelpath returns the path of a file relative to a directory, both
+// as seen by the host, using the local path separator. The second
+// return value is false if the file is not in the directory. Hyper-V
+// paths are not case-sensitive, and may use either separator.
+func hostrelpath(hostdir string, hostpath string) (string, bool) {
+	hostdir = strings.TrimRight(hostdir, `\/`)
+	if len(hostpath) <= len(hostdir)+1 || !strings.EqualFold(hostpath[:len(hostdir)], hostdir) {
+		return "", false
+	}
+	if separator := hostpath[len(hostdir)]; separator != '\\' && separator != '/' {
+		return "", false
+	}
+
+	pathparts := strings.FieldsFunc(hostpath[len(hostdir)+1:], func(r rune) bool {
+		return r == '\\' || r == '/'
+	})
+	return filepath.Join(pathparts...), true
+}
+
+// hasprefixfold is strings.HasPrefix, ignoring case.
+func hasprefixfold(s string, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// artifactowner returns the qualified name of the machine that an entry
+// in the disk directory belongs to, or an empty string if it does not
+// belong to a machine of the current user. Disks are named
+// <qualifiedname>.vhdx, the differencing disks of their checkpoints are
+// named <qualifiedname>_<GUID>.avhdx, and data disks are kept in a
+// directory named <qualifiedname>.data.
+func artifactowner(filename string, isdir bool, userprefix string) string {
+	owner := ""
+	switch {
+	case isdir:
+		if strings.HasSuffix(filename, datadiskdirsuffix) {
+			owner = strings.TrimSuffix(filename, datadiskdirsuffix)
+		}
+	case checkpointparent(filename) != "":
+		owner = checkpointparent(filename)
+	case strings.HasSuffix(filename, ".vhdx"):
+		owner = strings.TrimSuffix(filename, ".vhdx")
+	}
+
+	if !isqualifiedname(owner, userprefix) {
+		return ""
+	}
+
+	return owner
+}
+
+// isqualifiedname returns true if a name has the form
+// <user>-<cluster>-<machine>, where <user>- is the specified prefix, and
+// the cluster and machine names are not empty. Cluster and machine names
+// can contain hyphens, so the two cannot be told apart.
+func isqualifiedname(name string, userprefix string) bool {
+	if !strings.HasPrefix(name, userprefix) {
+		return false
+	}
+
+	clusterandmachine := strings.TrimPrefix(name, userprefix)
+	separator := strings.Index(clusterandmachine, "-")
+	return separator > 0 && separator < len(clusterandmachine)-1
+}
+
+// pathsize returns the total size of the files at a path, or zero if it
+// cannot be read.
+func pathsize(path string) int64 {
+	var size int64
+	filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !entry.IsDir() {
+			if info, err := entry.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+
+	return size
+}
@@ -0,0 +1,198 @@
+package driverhyperv_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	driverhyperv "github.com/kuttiproject/driver-hyperv"
+	"github.com/kuttiproject/workspace"
+)
+
+func TestOrphans(t *testing.T) {
+	t.Setenv("USERNAME", "orphan-test")
+
+	driver, fe := newtestdriver(t)
+
+	for _, name := range []string{"node1", "node2", "node3"} {
+		_, err := driver.NewMachine(name, "my-test", "1.27")
+		if err != nil {
+			t.Fatalf("Error creating machine %v: %v", name, err)
+		}
+	}
+
+	diskdir, _ := workspace.CacheSubDir("driver-hyperv-disks")
+	machinedir, _ := workspace.CacheSubDir("driver-hyperv-machines")
+	node1 := driver.QualifiedMachineName("node1", "my-test")
+	node2 := driver.QualifiedMachineName("node2", "my-test")
+	node3 := driver.QualifiedMachineName("node3", "my-test")
+
+	writefile := func(path string, content string) {
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = os.WriteFile(path, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatalf("Error creating %v: %v", path, err)
+		}
+	}
+
+	// node1 is removed from Hyper-V by hand, leaving its files behind
+	writefile(filepath.Join(diskdir, node1+".data", "logs.vhdx"), "data disk")
+	writefile(filepath.Join(diskdir, node1+"_0A1B2C3D-0A1B-0A1B-0A1B-0A1B2C3D4E5F.avhdx"), "checkpoint")
+	writefile(filepath.Join(machinedir, node1, "config.vmcx"), "configuration")
+	fe.mutex.Lock()
+	delete(fe.machines, node1)
+	fe.mutex.Unlock()
+
+	// node2 loses its disk
+	writefile(filepath.Join(diskdir, node2+".data", "logs.vhdx"), "data disk")
+	err := os.Remove(filepath.Join(diskdir, node2+".vhdx"))
+	if err != nil {
+		t.Fatalf("Error removing disk: %v", err)
+	}
+
+	// node3 boots from a disk with another name, which is neither
+	// orphaned nor makes node3 an orphan
+	node3disk := filepath.Join(diskdir, "orphan-test-old-node9.vhdx")
+	err = os.Rename(filepath.Join(diskdir, node3+".vhdx"), node3disk)
+	if err != nil {
+		t.Fatalf("Error renaming disk: %v", err)
+	}
+	fe.mutex.Lock()
+	fe.attached[node3] = []string{node3disk}
+	fe.mutex.Unlock()
+
+	// Artifacts of other users, and other VMs, are left alone
+	writefile(filepath.Join(diskdir, "someoneelse-test-node1.vhdx"), "disk")
+	writefile(filepath.Join(machinedir, "orphan-test-scratch", "config.vmcx"), "configuration")
+	fe.mutex.Lock()
+	fe.machines["SomeOtherVM"] = "Running"
+	fe.machines["orphan-test-scratch"] = "Off"
+	fe.mutex.Unlock()
+
+	expected := []driverhyperv.Orphan{
+		{Kind: driverhyperv.OrphanDisk, MachineName: node1, Path: filepath.Join(diskdir, node1+".data"), SizeBytes: 9},
+		{Kind: driverhyperv.OrphanDisk, MachineName: node1, Path: filepath.Join(diskdir, node1+".vhdx"), SizeBytes: 5},
+		{Kind: driverhyperv.OrphanDisk, MachineName: node1, Path: filepath.Join(diskdir, node1+"_0A1B2C3D-0A1B-0A1B-0A1B-0A1B2C3D4E5F.avhdx"), SizeBytes: 10},
+		{Kind: driverhyperv.OrphanMachine, MachineName: node2, SizeBytes: 9},
+		{Kind: driverhyperv.OrphanMachineDirectory, MachineName: node1, Path: filepath.Join(machinedir, node1), SizeBytes: 13},
+	}
+	checkorphans := func(orphans []driverhyperv.Orphan) {
+		if len(orphans) != len(expected) {
+			t.Fatalf("Expected %v orphans, got %v: %v", len(expected), len(orphans), orphans)
+		}
+		for i := range expected {
+			if orphans[i] != expected[i] {
+				t.Errorf("Expected orphan %+v, got %+v", expected[i], orphans[i])
+			}
+		}
+	}
+
+	orphans, err := driver.FindOrphans()
+	if err != nil {
+		t.Fatalf("Error finding orphans: %v", err)
+	}
+	checkorphans(orphans)
+
+	orphans, err = driver.CleanupOrphans(true)
+	if err != nil {
+		t.Fatalf("Error in dry run cleanup: %v", err)
+	}
+	checkorphans(orphans)
+	if _, err := os.Stat(filepath.Join(diskdir, node1+".vhdx")); err != nil {
+		t.Errorf("Expected dry run to leave orphaned disk: %v", err)
+	}
+
+	orphans, err = driver.CleanupOrphans(false)
+	if err != nil {
+		t.Fatalf("Error cleaning up orphans: %v", err)
+	}
+	checkorphans(orphans)
+
+	for _, path := range []string{
+		filepath.Join(diskdir, node1+".vhdx"),
+		filepath.Join(diskdir, node1+"_0A1B2C3D-0A1B-0A1B-0A1B-0A1B2C3D4E5F.avhdx"),
+		filepath.Join(diskdir, node2+".data", "logs.vhdx"),
+		filepath.Join(machinedir, node1),
+	} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected %v to be removed", path)
+		}
+	}
+	if _, ok := fe.machines[node2]; ok {
+		t.Errorf("Expected orphaned machine to be removed")
+	}
+	for _, name := range []string{node3, "SomeOtherVM", "orphan-test-scratch"} {
+		if _, ok := fe.machines[name]; !ok {
+			t.Errorf("Expected machine %v to be left alone", name)
+		}
+	}
+	for _, path := range []string{
+		filepath.Join(diskdir, "someoneelse-test-node1.vhdx"),
+		filepath.Join(machinedir, "orphan-test-scratch"),
+		node3disk,
+	} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected %v to be left alone: %v", path, err)
+		}
+	}
+
+	orphans, err = driver.FindOrphans()
+	if err != nil {
+		t.Fatalf("Error finding orphans: %v", err)
+	}
+	if len(orphans) != 0 {
+		t.Errorf("Expected no orphans after cleanup, got %v", orphans)
+	}
+}
+
+func TestCleanupOrphansFailure(t *testing.T) {
+	t.Setenv("USERNAME", "orphantest")
+
+	newtestworkspace(t)
+
+	fe := &failingexecutor{
+		sshfakeexecutor: &sshfakeexecutor{fakeexecutor: newfakeexecutor()},
+		failing:         map[string]string{},
+	}
+	driver := driverhyperv.NewDriverWithExecutor(fe)
+
+	_, err := driver.NewMachine("node1", "test", "1.27")
+	if err != nil {
+		t.Fatalf("Error creating machine: %v", err)
+	}
+	node1 := driver.QualifiedMachineName("node1", "test")
+	diskdir, _ := workspace.CacheSubDir("driver-hyperv-disks")
+	err = os.Remove(filepath.Join(diskdir, node1+".vhdx"))
+	if err != nil {
+		t.Fatalf("Error removing disk: %v", err)
+	}
+
+	// A machine that cannot be turned off is not removed
+	fe.failing["forcestopmachine"] = "InsufficientPermissions"
+	removed, err := driver.CleanupOrphans(false)
+	if !errors.Is(err, driverhyperv.ErrInsufficientPermissions) {
+		t.Errorf("Expected ErrInsufficientPermissions cleaning up orphans, got %v", err)
+	}
+	if len(removed) != 0 {
+		t.Errorf("Expected no orphans to be removed, got %v", removed)
+	}
+	if _, ok := fe.machines[node1]; !ok {
+		t.Errorf("Expected machine that could not be turned off to be kept")
+	}
+
+	// A machine that is already off is removed
+	fe.failing["forcestopmachine"] = "InvalidState"
+	removed, err = driver.CleanupOrphans(false)
+	if err != nil {
+		t.Fatalf("Error cleaning up orphans: %v", err)
+	}
+	if len(removed) != 1 {
+		t.Errorf("Expected one orphan to be removed, got %v", removed)
+	}
+	if _, ok := fe.machines[node1]; ok {
+		t.Errorf("Expected orphaned machine to be removed")
+	}
+}
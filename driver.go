@@ -1,17 +1,38 @@
 package driverhyperv
 
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kuttiproject/kuttilog"
+)
+
 const (
 	driverName        = "hyperv"
 	driverDescription = "Kutti driver for Hyper-V"
 )
 
 // Driver implements the drivercore.Driver interface for Hyper-V.
+// A Driver is safe for concurrent use by multiple goroutines.
 type Driver struct {
-	powershellpath string
-	scriptpath     string
-	validated      bool
-	status         string
-	errormessage   string
+	mutex             sync.Mutex
+	executor          Executor
+	customexecutor    bool
+	persistentsession bool
+	remote            *RemoteHost
+	storagedir        string
+	validated         bool
+	checkedat         time.Time
+	validationttl     time.Duration
+	statushistory     []StatusChange
+	status            string
+	errormessage      string
+	lasterror         error
+	tracer            *tracer
 }
 
 // Name returns "hyperv".
@@ -34,56 +55,395 @@ func (vd *Driver) UsesNATNetworking() bool {
 	return false
 }
 
-func (vd *Driver) validate() bool {
-	if vd.validated {
+// The default time for which a successful validation is trusted, and
+// the time for which a failed validation is trusted.
+const (
+	defaultValidationTTL = 5 * time.Minute
+	failedValidationTTL  = 10 * time.Second
+)
+
+// maxStatusHistory is the number of status changes kept by the driver.
+const maxStatusHistory = 50
+
+// StatusChange records a change in the status of the driver.
+type StatusChange struct {
+	Time         time.Time
+	Status       string
+	ErrorMessage string
+}
+
+// validationcurrent returns true if the result of the last validation
+// can still be trusted. It should be called with the mutex held.
+func (vd *Driver) validationcurrent() bool {
+	if vd.checkedat.IsZero() {
+		return false
+	}
+
+	ttl := vd.validationttlvalue()
+	if !vd.validated {
+		if ttl < 0 || ttl > failedValidationTTL {
+			ttl = failedValidationTTL
+		}
+	}
+
+	if ttl < 0 {
 		return true
 	}
 
-	// find PowerShell
-	pspath, err := findPowerShell()
+	return time.Since(vd.checkedat) < ttl
+}
+
+// setvalidation records the result of a validation. The result is not
+// cached if the validation was interrupted by the context.
+func (vd *Driver) setvalidation(ctx context.Context, validated bool, errormessage string, lasterror error) bool {
+	vd.mutex.Lock()
+	defer vd.mutex.Unlock()
+
+	status := "Ready"
+	if !validated {
+		status = "Error"
+	}
+
+	if status != vd.status || errormessage != vd.errormessage {
+		vd.statushistory = append(vd.statushistory, StatusChange{
+			Time:         time.Now(),
+			Status:       status,
+			ErrorMessage: errormessage,
+		})
+		if len(vd.statushistory) > maxStatusHistory {
+			vd.statushistory = vd.statushistory[len(vd.statushistory)-maxStatusHistory:]
+		}
+	}
+
+	vd.status = status
+	vd.errormessage = errormessage
+	vd.lasterror = lasterror
+	vd.validated = validated
+	vd.checkedat = time.Now()
+	if !validated && ctx.Err() != nil {
+		vd.checkedat = time.Time{}
+	}
+
+	return validated
+}
+
+// validate checks the driver status, unless the result of the last check
+// can still be trusted. Concurrent callers may check at the same time.
+func (vd *Driver) validate(ctx context.Context) bool {
+	vd.mutex.Lock()
+	if vd.validationcurrent() {
+		validated := vd.validated
+		vd.mutex.Unlock()
+		return validated
+	}
+	executor := vd.executor
+	vd.mutex.Unlock()
+
+	if executor == nil {
+		err := vd.createexecutor()
+		if err != nil {
+			return vd.setvalidation(ctx, false, err.Error(), err)
+		}
+	}
+
+	// Check driver status
+	driverstatus, err := vd.runwithresults(ctx, "checkdriver", nil)
 	if err != nil {
-		vd.status = "Error"
-		vd.errormessage = err.Error()
-		return false
+		return vd.setvalidation(ctx, false, err.Error(), err)
+	}
+
+	// Check interface script version
+	scriptversion, _ := driverstatus.Payload["ScriptVersion"].(string)
+	if scriptversion != ScriptVersion {
+		return vd.setvalidation(
+			ctx,
+			false,
+			fmt.Sprintf(
+				"interface script version '%v' does not match driver script version '%v'",
+				scriptversion,
+				ScriptVersion,
+			),
+			nil,
+		)
+	}
+
+	if !driverstatus.Success {
+		return vd.setvalidation(
+			ctx,
+			false,
+			driverstatus.ErrorMessage,
+			scripterrors[driverstatus.ErrorCode],
+		)
+	}
+
+	return vd.setvalidation(ctx, true, "", nil)
+}
+
+// createexecutor creates the appropriate executor for the driver's
+// settings, unless another goroutine has already done so.
+func (vd *Driver) createexecutor() error {
+	executor, err := vd.newexecutor()
+	if err != nil {
+		return err
 	}
-	vd.powershellpath = pspath
 
+	vd.mutex.Lock()
+	if vd.executor == nil {
+		vd.executor = executor
+		executor = nil
+	}
+	vd.mutex.Unlock()
+
+	// Discard the new executor if it was not needed
+	closeexecutor(executor)
+
+	return nil
+}
+
+func (vd *Driver) newexecutor() (Executor, error) {
 	// Find hypervmanage script
-	scriptpath, err := findScript()
+	scriptpath, err := vd.findScript()
 	if err != nil {
-		vd.status = "Error"
-		vd.errormessage = err.Error()
-		return false
+		return nil, err
 	}
-	vd.scriptpath = scriptpath
 
-	// Check driver status
-	driverstatus, err := vd.runwithresults("checkdriver")
+	if vd.remote != nil {
+		hostscriptpath, err := vd.hostpath(scriptpath)
+		if err != nil {
+			return nil, err
+		}
+
+		return &winrmexecutor{
+			client: newwinrmclient(
+				vd.remote.Endpoint,
+				vd.remote.Username,
+				vd.remote.Password,
+				vd.remote.Insecure,
+			),
+			scriptpath: hostscriptpath,
+		}, nil
+	}
+
+	// find PowerShell
+	pspath, err := findPowerShell()
 	if err != nil {
-		vd.status = "Error"
-		vd.errormessage = err.Error()
-		return false
+		return nil, err
 	}
 
-	if !driverstatus.Success {
-		vd.status = "Error"
-		vd.errormessage = driverstatus.ErrorMessage
-		return false
+	// PowerShell may not be able to use the script path directly,
+	// for example when running inside WSL
+	hostscriptpath, err := vd.hostpath(scriptpath)
+	if err != nil {
+		return nil, err
+	}
+
+	if runningInWSL() {
+		diskdir, _ := vd.diskDir()
+		if !strings.HasPrefix(diskdir, wslmountroot) {
+			kuttilog.Printf(
+				kuttilog.Info,
+				"Warning: VM disks will be stored in the WSL file system at '%v', which Hyper-V may not be able to use. Consider setting a storage directory on a Windows drive.",
+				diskdir,
+			)
+		}
 	}
 
-	vd.status = "Ready"
-	vd.validated = true
-	return true
+	if vd.PersistentSession() {
+		return &sessionexecutor{
+			powershellpath: pspath,
+			scriptpath:     hostscriptpath,
+		}, nil
+	}
+
+	return &powershellexecutor{
+		powershellpath: pspath,
+		scriptpath:     hostscriptpath,
+	}, nil
 }
 
-// Status returns current driver status.
+// currentexecutor returns the executor in use, or nil.
+func (vd *Driver) currentexecutor() Executor {
+	vd.mutex.Lock()
+	defer vd.mutex.Unlock()
+
+	return vd.executor
+}
+
+// Status returns current driver status. The status is checked when it
+// is first needed, and checked again once the validation TTL has passed.
+// See SetValidationTTL.
 func (vd *Driver) Status() string {
-	vd.validate()
+	vd.validate(context.Background())
+
+	vd.mutex.Lock()
+	defer vd.mutex.Unlock()
+
 	return vd.status
 }
 
 // Error returns the last error returned in the driver.
 func (vd *Driver) Error() string {
-	vd.validate()
+	vd.validate(context.Background())
+
+	vd.mutex.Lock()
+	defer vd.mutex.Unlock()
+
 	return vd.errormessage
 }
+
+// Unwrap returns the cause of the last validation failure, if known.
+// Operations that fail because the driver could not be validated return
+// the driver itself as the error. This allows callers to check for the
+// cause with errors.Is, for example:
+//
+//	errors.Is(err, driverhyperv.ErrHyperVNotEnabled)
+func (vd *Driver) Unwrap() error {
+	vd.mutex.Lock()
+	defer vd.mutex.Unlock()
+
+	return vd.lasterror
+}
+
+// Revalidate checks the driver status immediately, instead of waiting for
+// the validation TTL to pass. It returns nil if the driver is ready, or
+// the driver itself as the error otherwise.
+func (vd *Driver) Revalidate() error {
+	return vd.RevalidateContext(context.Background())
+}
+
+// RevalidateContext checks the driver status like Revalidate. If the
+// context is done before the check completes, the context's error is
+// returned, and the next operation checks again.
+func (vd *Driver) RevalidateContext(ctx context.Context) error {
+	vd.mutex.Lock()
+	vd.checkedat = time.Time{}
+	vd.mutex.Unlock()
+
+	if !vd.validate(ctx) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return vd
+	}
+
+	return nil
+}
+
+// Reset discards all cached driver state, including the location of
+// PowerShell and the interface script, and any persistent session. The
+// next operation finds them again, and checks the driver status. The
+// status history is kept. The executor of a driver created with
+// NewDriverWithExecutor is kept, but the driver status is checked again.
+func (vd *Driver) Reset() {
+	vd.mutex.Lock()
+	var executor Executor
+	if !vd.customexecutor {
+		executor = vd.executor
+		vd.executor = nil
+	}
+	vd.checkedat = time.Time{}
+	vd.validated = false
+	vd.mutex.Unlock()
+
+	closeexecutor(executor)
+}
+
+// SetValidationTTL sets the time for which a successful check of the
+// driver status is trusted. After this time, the next operation checks
+// again. A negative TTL means that a successful check is trusted until
+// Revalidate or Reset is called. A TTL of zero restores the default of 5
+// minutes. A failed check is trusted for at most 10 seconds, so that a
+// driver that was not ready is checked again soon, without checking on
+// every call.
+func (vd *Driver) SetValidationTTL(ttl time.Duration) {
+	vd.mutex.Lock()
+	defer vd.mutex.Unlock()
+
+	vd.validationttl = ttl
+}
+
+// ValidationTTL returns the time for which a successful check of the
+// driver status is trusted.
+func (vd *Driver) ValidationTTL() time.Duration {
+	vd.mutex.Lock()
+	defer vd.mutex.Unlock()
+
+	return vd.validationttlvalue()
+}
+
+func (vd *Driver) validationttlvalue() time.Duration {
+	if vd.validationttl == 0 {
+		return defaultValidationTTL
+	}
+
+	return vd.validationttl
+}
+
+// StatusHistory returns the most recent changes in driver status, oldest
+// first. Up to 50 changes are kept.
+func (vd *Driver) StatusHistory() []StatusChange {
+	vd.mutex.Lock()
+	defer vd.mutex.Unlock()
+
+	result := make([]StatusChange, len(vd.statushistory))
+	copy(result, vd.statushistory)
+	return result
+}
+
+// SetPersistentSession turns persistent session mode on or off.
+// In persistent session mode, the driver runs the interface script in a
+// single PowerShell process, which is started on first use and kept
+// running for subsequent operations. This avoids the cost of starting
+// PowerShell and loading the Hyper-V module for every operation.
+// If the process exits, it is started again automatically.
+// This setting has no effect on a driver created with NewDriverWithExecutor
+// or NewRemoteDriver.
+func (vd *Driver) SetPersistentSession(enabled bool) {
+	vd.mutex.Lock()
+	if vd.persistentsession == enabled || vd.customexecutor {
+		vd.persistentsession = enabled
+		vd.mutex.Unlock()
+		return
+	}
+	vd.persistentsession = enabled
+
+	// Let validate() create the appropriate executor
+	executor := vd.executor
+	vd.executor = nil
+	vd.checkedat = time.Time{}
+	vd.mutex.Unlock()
+
+	closeexecutor(executor)
+}
+
+// PersistentSession returns true if persistent session mode is on.
+func (vd *Driver) PersistentSession() bool {
+	vd.mutex.Lock()
+	defer vd.mutex.Unlock()
+
+	return vd.persistentsession
+}
+
+// Close releases any resources held by the driver, such as a
+// persistent PowerShell session or an open trace file. The driver can
+// still be used after Close; resources will be acquired again as needed.
+// Tracing stays off until EnableTrace is called again.
+func (vd *Driver) Close() error {
+	traceerr := vd.DisableTrace()
+	err := closeexecutor(vd.currentexecutor())
+	if err != nil {
+		return err
+	}
+
+	return traceerr
+}
+
+// closeexecutor releases the resources held by an executor, if any.
+func closeexecutor(executor Executor) error {
+	closer, ok := executor.(io.Closer)
+	if !ok {
+		return nil
+	}
+
+	return closer.Close()
+}
@@ -0,0 +1,172 @@
+package driverhyperv
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// hostcapacity is the payload of the "hostcapacity" command.
+type hostcapacity struct {
+	FreeMemoryBytes   int64
+	LogicalProcessors int64
+	Volume            *struct {
+		Name         string
+		Path         string
+		FreeBytes    int64
+		TotalBytes   int64
+		ErrorMessage string
+	}
+	MachineState          string
+	MachineMemoryBytes    int64
+	MachineProcessorCount int64
+}
+
+func (vd *Driver) gethostcapacity(ctx context.Context, params scriptparams) (*hostcapacity, error) {
+	machinename, _ := params["MachineName"].(string)
+
+	result, err := vd.runwithresults(ctx, "hostcapacity", params)
+	if err != nil {
+		return nil, fmt.Errorf("could not check host capacity: %w", err)
+	}
+
+	if !result.Success {
+		return nil, newoperationerror("check host capacity", machinename, result)
+	}
+
+	var capacity hostcapacity
+	err = decodepayload(result.Payload, &capacity)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse host capacity: %v", err)
+	}
+
+	return &capacity, nil
+}
+
+// check returns an *InsufficientResourcesError if the host does not
+// have the specified memory, logical processors and disk space free.
+// A disk space requirement of zero is not checked.
+func (hc *hostcapacity) check(machinename string, memorybytes int64, processors int64, diskbytes int64) error {
+	if memorybytes > hc.FreeMemoryBytes {
+		return &InsufficientResourcesError{
+			Resource:    ResourceMemory,
+			MachineName: machinename,
+			Required:    memorybytes,
+			Available:   hc.FreeMemoryBytes,
+		}
+	}
+
+	// A machine cannot have more virtual processors than the host has
+	// logical processors.
+	if processors > hc.LogicalProcessors {
+		return &InsufficientResourcesError{
+			Resource:    ResourceProcessors,
+			MachineName: machinename,
+			Required:    processors,
+			Available:   hc.LogicalProcessors,
+		}
+	}
+
+	if diskbytes > 0 && hc.Volume != nil && hc.Volume.ErrorMessage == "" && diskbytes > hc.Volume.FreeBytes {
+		return &InsufficientResourcesError{
+			Resource:    ResourceDiskSpace,
+			MachineName: machinename,
+			Required:    diskbytes,
+			Available:   hc.Volume.FreeBytes,
+		}
+	}
+
+	return nil
+}
+
+// preflightnewmachine checks that the host can fit a new machine with
+// the specified spec, and a copy of the image. A machine with dynamic
+// memory needs its startup memory to start.
+func (vd *Driver) preflightnewmachine(ctx context.Context, machinename string, spec MachineSpec, imagebytes int64) error {
+	return vd.preflightnewmachines(ctx, []string{machinename}, spec, imagebytes, 1)
+}
+
+// preflightnewmachines checks that the host can fit new machines with
+// the specified spec, each with a copy of the image, if they are created
+// parallelism at a time. The disk space of each machine is reserved
+// before the next one is checked. Memory is reserved only for the
+// machines that can be running at the same time, because each machine
+// is stopped once it has been created. Virtual processors are shared,
+// so each machine is checked against all the logical processors.
+func (vd *Driver) preflightnewmachines(ctx context.Context, machinenames []string, spec MachineSpec, imagebytes int64, parallelism int) error {
+	params := scriptparams{}
+
+	diskdir, err := vd.diskDir()
+	if err == nil {
+		diskdir, err = vd.hostpath(diskdir)
+	}
+	if err == nil {
+		params["DiskPath"] = diskdir
+	}
+
+	capacity, err := vd.gethostcapacity(ctx, params)
+	if err != nil {
+		return err
+	}
+
+	for i, machinename := range machinenames {
+		concurrent := min(i+1, parallelism)
+		err = capacity.check(
+			machinename,
+			int64(concurrent)*int64(spec.MemoryStartupMB)<<20,
+			int64(spec.ProcessorCount),
+			int64(i+1)*imagebytes,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newmachinediskbytes returns the disk space needed for the disk of a
+// new machine: the size of the image, or nothing for a new differencing
+// disk, which takes almost no space.
+func (vd *Driver) newmachinediskbytes(config DriverConfig, k8sversion string) (int64, error) {
+	vhdfile, err := imagepathfromk8sversion(k8sversion)
+	if err != nil {
+		return 0, err
+	}
+
+	if config.DifferencingDisks && vd.remote == nil {
+		return 0, vd.checkdifferencingparent(vhdfile)
+	}
+
+	vhdinfo, err := os.Stat(vhdfile)
+	if err != nil {
+		return 0, fmt.Errorf("could not retrieve image %s: %v", vhdfile, err)
+	}
+
+	return vhdinfo.Size(), nil
+}
+
+// preflightstart checks that the host can fit a machine that is about
+// to be started. Machines that are already running are not checked.
+func (vh *Machine) preflightstart(ctx context.Context) error {
+	capacity, err := vh.driver.gethostcapacity(
+		ctx,
+		scriptparams{
+			"MachineName": vh.qname(),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	if capacity.MachineState != "Off" && capacity.MachineState != "Saved" {
+		return nil
+	}
+
+	return capacity.check(
+		vh.Name(),
+		capacity.MachineMemoryBytes,
+		capacity.MachineProcessorCount,
+		0,
+	)
+}
@@ -0,0 +1,101 @@
+package driverhyperv_test
+
+import (
+	"errors"
+	"testing"
+
+	driverhyperv "github.com/kuttiproject/driver-hyperv"
+)
+
+func TestCapacityPreflight(t *testing.T) {
+	driver, fe := newtestdriver(t)
+
+	// Not enough disk space for the image
+	fe.freedisk = 2
+	_, err := driver.NewMachine("node1", "test", "1.27")
+	var resourceerr *driverhyperv.InsufficientResourcesError
+	if !errors.As(err, &resourceerr) || resourceerr.Resource != driverhyperv.ResourceDiskSpace {
+		t.Fatalf("Expected insufficient disk space, got %v", err)
+	}
+	if resourceerr.Required != 5 || resourceerr.Available != 2 {
+		t.Errorf("Expected 5 bytes required and 2 available, got %v and %v", resourceerr.Required, resourceerr.Available)
+	}
+	if _, ok := fe.machines[driver.QualifiedMachineName("node1", "test")]; ok {
+		t.Errorf("Expected machine not to be created")
+	}
+
+	// Not enough logical processors
+	fe.freedisk = 1 << 40
+	fe.logicalprocessors = 1
+	_, err = driver.NewMachine("node1", "test", "1.27")
+	if !errors.As(err, &resourceerr) || resourceerr.Resource != driverhyperv.ResourceProcessors {
+		t.Errorf("Expected insufficient logical processors, got %v", err)
+	}
+
+	fe.logicalprocessors = 16
+	machine, err := driver.NewMachine("node1", "test", "1.27")
+	if err != nil {
+		t.Fatalf("Error creating machine: %v", err)
+	}
+
+	// Not enough memory to start the machine
+	fe.freememory = 1 << 30
+	err = machine.Start()
+	if !errors.Is(err, driverhyperv.ErrInsufficientResources) {
+		t.Fatalf("Expected ErrInsufficientResources, got %v", err)
+	}
+	if !errors.As(err, &resourceerr) || resourceerr.Resource != driverhyperv.ResourceMemory {
+		t.Errorf("Expected insufficient memory, got %v", err)
+	}
+
+	// Overcommit allowed
+	config, err := driver.Config()
+	if err != nil {
+		t.Fatalf("Error loading configuration: %v", err)
+	}
+	config.AllowOvercommit = true
+	err = driver.SetConfig(config)
+	if err != nil {
+		t.Fatalf("Error setting configuration: %v", err)
+	}
+
+	err = machine.Start()
+	if err != nil {
+		t.Errorf("Error starting machine with overcommit allowed: %v", err)
+	}
+
+	// Machines created in parallel are checked together, before any is
+	// created. Two 2 GiB machines do not fit in 3 GiB at the same time.
+	config.AllowOvercommit = false
+	err = driver.SetConfig(config)
+	if err != nil {
+		t.Fatalf("Error setting configuration: %v", err)
+	}
+	fe.freememory = 3 << 30
+	names := []string{"node2", "node3", "node4", "node5"}
+	_, err = driver.NewMachines("test", "1.27", names, 4)
+	if !errors.As(err, &resourceerr) || resourceerr.Resource != driverhyperv.ResourceMemory {
+		t.Fatalf("Expected insufficient memory creating machines in parallel, got %v", err)
+	}
+	if resourceerr.MachineName != "node3" || resourceerr.Required != 4<<30 {
+		t.Errorf("Expected node3 to need 4 GiB, got %v needing %v", resourceerr.MachineName, resourceerr.Required)
+	}
+	for _, name := range names {
+		if _, ok := fe.machines[driver.QualifiedMachineName(name, "test")]; ok {
+			t.Errorf("Expected machine %v not to be created", name)
+		}
+	}
+
+	// Disk space is needed for every machine
+	fe.freememory = 64 << 30
+	fe.freedisk = 12
+	_, err = driver.NewMachines("test", "1.27", names, 1)
+	if !errors.As(err, &resourceerr) || resourceerr.Resource != driverhyperv.ResourceDiskSpace || resourceerr.MachineName != "node4" {
+		t.Fatalf("Expected insufficient disk space for node4, got %v", err)
+	}
+
+	_, err = driver.NewMachines("test", "1.27", names[:2], 1)
+	if err != nil {
+		t.Errorf("Error creating machines that fit: %v", err)
+	}
+}
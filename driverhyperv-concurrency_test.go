@@ -0,0 +1,168 @@
+package driverhyperv_test
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	driverhyperv "github.com/kuttiproject/driver-hyperv"
+	"github.com/kuttiproject/drivercore"
+	"github.com/kuttiproject/workspace"
+)
+
+// setupimagecatalog creates an image list with one image, which is not
+// downloaded, and returns the path of a file that can be imported as
+// that image.
+func setupimagecatalog(t *testing.T, k8sversion string) string {
+	return setupimagecatalogwith(t, k8sversion, nil)
+}
+
+// setupimagecatalogwith is like setupimagecatalog, and adds the specified
+// fields to the image list entry.
+func setupimagecatalogwith(t *testing.T, k8sversion string, fields map[string]interface{}) string {
+	imagecontent := []byte("kutti test image")
+	imagefilepath := filepath.Join(t.TempDir(), "kutti-"+k8sversion+".vhdx")
+	err := os.WriteFile(imagefilepath, imagecontent, 0644)
+	if err != nil {
+		t.Fatalf("Error creating image file: %v", err)
+	}
+
+	entry := map[string]interface{}{
+		"ImageK8sVersion": k8sversion,
+		"ImageChecksum":   fmt.Sprintf("%x", sha256.Sum256(imagecontent)),
+		"ImageStatus":     drivercore.ImageStatusNotDownloaded,
+	}
+	for key, value := range fields {
+		entry[key] = value
+	}
+	catalog, _ := json.Marshal(map[string]interface{}{
+		k8sversion: entry,
+	})
+
+	configdir, err := workspace.ConfigDir()
+	if err != nil {
+		t.Fatalf("Error getting configuration directory: %v", err)
+	}
+	err = os.WriteFile(filepath.Join(configdir, "driver-hyperv-images.json"), catalog, 0644)
+	if err != nil {
+		t.Fatalf("Error creating image list: %v", err)
+	}
+
+	return imagefilepath
+}
+
+func TestConcurrentOperations(t *testing.T) {
+	err := workspace.Set(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error setting workspace: %v", err)
+	}
+
+	const k8sversion = "1.27"
+	imagefilepath := setupimagecatalog(t, k8sversion)
+
+	fe := &sshfakeexecutor{fakeexecutor: newfakeexecutor()}
+	driver := driverhyperv.NewDriverWithExecutor(fe)
+
+	err = driver.EnableTrace(filepath.Join(t.TempDir(), "trace.jsonl"))
+	if err != nil {
+		t.Fatalf("Error enabling trace: %v", err)
+	}
+	defer driver.Close()
+
+	// Import the image first, since machines are created from it
+	image, err := driver.GetImage(k8sversion)
+	if err != nil {
+		t.Fatalf("Error getting image: %v", err)
+	}
+	err = image.FromFile(imagefilepath)
+	if err != nil {
+		t.Fatalf("Error importing image: %v", err)
+	}
+
+	const nodecount = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, nodecount*2)
+
+	for i := 1; i <= nodecount; i++ {
+		nodename := fmt.Sprintf("node%v", i)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			machine, err := driver.NewMachine(nodename, "test", k8sversion)
+			if err != nil {
+				errs <- fmt.Errorf("creating %v: %v", nodename, err)
+				return
+			}
+
+			err = machine.Start()
+			if err != nil {
+				errs <- fmt.Errorf("starting %v: %v", nodename, err)
+				return
+			}
+			machine.WaitForStateChange(25)
+			machine.Status()
+			machine.IPAddress()
+
+			err = machine.Stop()
+			if err != nil {
+				errs <- fmt.Errorf("stopping %v: %v", nodename, err)
+			}
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			driver.Status()
+			driver.Revalidate()
+			driver.SetPersistentSession(true)
+			driver.StatusHistory()
+
+			images, err := driver.ListImages()
+			if err != nil {
+				errs <- fmt.Errorf("listing images: %v", err)
+				return
+			}
+			for _, image := range images {
+				image.Status()
+			}
+			driver.K8sVersions()
+
+			_, err = driver.Config()
+			if err != nil {
+				errs <- fmt.Errorf("loading configuration: %v", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	image, err = driver.GetImage(k8sversion)
+	if err != nil {
+		t.Fatalf("Error getting image: %v", err)
+	}
+	if image.Status() != drivercore.ImageStatusDownloaded {
+		t.Errorf("Expected image status %v, got %v", drivercore.ImageStatusDownloaded, image.Status())
+	}
+
+	for i := 1; i <= nodecount; i++ {
+		machine, err := driver.GetMachine(fmt.Sprintf("node%v", i), "test")
+		if err != nil {
+			t.Errorf("Error getting machine: %v", err)
+			continue
+		}
+		if machine.Status() != drivercore.MachineStatusStopped {
+			t.Errorf("Expected machine %v to be stopped, got %v", machine.Name(), machine.Status())
+		}
+	}
+}
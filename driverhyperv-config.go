@@ -0,0 +1,248 @@
+package driverhyperv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/kuttiproject/workspace"
+)
+
+const driverConfigFile = "driver-hyperv.json"
+
+// DriverConfig holds the tunable settings of the driver. It is stored in
+// the file driver-hyperv.json in the kutti configuration directory, so
+// that settings can be shared, for example by checking the file in.
+// Settings missing from the file take their default values.
+type DriverConfig struct {
+	// MachineMemoryMB is the memory of new machines, in megabytes.
+	// It should be an even number, and at least 512. Default 2048.
+	MachineMemoryMB int
+	// MachineCPUs is the processor count of new machines. Default 2.
+	MachineCPUs int
+	// MachineDiskSizeGB is the disk size of new machines, in gigabytes.
+	// If zero, the disk is the size of the image. Default 0.
+	MachineDiskSizeGB int
+	// SwitchName is the virtual switch that new machines are connected
+	// to. Default "Default Switch".
+	SwitchName string
+	// SSHUsername and SSHPassword are the credentials used to run
+	// commands inside machines. They should match the driver images.
+	SSHUsername string
+	SSHPassword string
+	// WaitTimeoutSeconds is the time to wait for a machine to start
+	// or stop, if no timeout is specified. Default 25.
+	WaitTimeoutSeconds int
+	// ReadyTimeoutSeconds is the time NewMachine waits for a new machine
+	// to be running and to have an IPv4 address. Default 90.
+	ReadyTimeoutSeconds int
+	// RenameRetries is the number of times NewMachine tries to set the
+	// host name of a new machine. Default 3.
+	RenameRetries int
+	// ImagesSourceURL is the location of the master list of images. If
+	// empty, the ImagesSourceURL variable is used.
+	ImagesSourceURL string
+	// AllowOvercommit turns off the check that the host has enough
+	// free memory, logical processors and disk space before a machine
+	// is created or started. Default false.
+	AllowOvercommit bool
+	// DifferencingDisks makes NewMachine create the disk of each machine
+	// as a differencing disk, whose parent is the cached image, instead
+	// of copying the image. This is much faster, and uses much less disk
+	// space. The cached image is made read-only, and cannot be removed
+	// while any machine uses it. It is not supported for remote hosts.
+	// Under WSL, it needs the kutti workspace to be on a Windows drive,
+	// because Hyper-V cannot use parent disks in the WSL file system.
+	// Default false.
+	DifferencingDisks bool
+	// KeepFailedMachines stops NewMachine from removing what it created
+	// for a machine when a later step fails, so that the VM and its disk
+	// can be examined. The VM has to be deleted manually afterwards.
+	// Default false.
+	KeepFailedMachines bool
+}
+
+func defaultdriverconfig() DriverConfig {
+	return DriverConfig{
+		MachineMemoryMB:     2048,
+		MachineCPUs:         2,
+		SwitchName:          "Default Switch",
+		SSHUsername:         "kuttiadmin",
+		SSHPassword:         "Pass@word1",
+		WaitTimeoutSeconds:  25,
+		ReadyTimeoutSeconds: 90,
+		RenameRetries:       3,
+	}
+}
+
+// MachineSpec returns the spec of machines created by NewMachine.
+func (dc *DriverConfig) MachineSpec() MachineSpec {
+	return MachineSpec{
+		ProcessorCount:  dc.MachineCPUs,
+		MemoryStartupMB: dc.MachineMemoryMB,
+		DiskSizeGB:      dc.MachineDiskSizeGB,
+	}
+}
+
+// Validate returns an error if any setting is invalid.
+func (dc *DriverConfig) Validate() error {
+	if dc.MachineMemoryMB < 512 || dc.MachineMemoryMB%2 != 0 {
+		return fmt.Errorf("invalid machine memory %v MB: should be an even number, at least 512", dc.MachineMemoryMB)
+	}
+
+	if dc.MachineCPUs < 1 {
+		return fmt.Errorf("invalid machine CPU count %v: should be at least 1", dc.MachineCPUs)
+	}
+
+	if dc.MachineDiskSizeGB < 0 {
+		return fmt.Errorf("invalid machine disk size %v GB: should not be negative", dc.MachineDiskSizeGB)
+	}
+
+	if dc.SwitchName == "" {
+		return errors.New("switch name not specified")
+	}
+
+	if dc.SSHUsername == "" {
+		return errors.New("SSH username not specified")
+	}
+
+	if dc.WaitTimeoutSeconds < 1 {
+		return fmt.Errorf("invalid wait timeout %v: should be at least 1 second", dc.WaitTimeoutSeconds)
+	}
+
+	if dc.ReadyTimeoutSeconds < 1 {
+		return fmt.Errorf("invalid ready timeout %v: should be at least 1 second", dc.ReadyTimeoutSeconds)
+	}
+
+	if dc.RenameRetries < 1 {
+		return fmt.Errorf("invalid rename retry count %v: should be at least 1", dc.RenameRetries)
+	}
+
+	if dc.ImagesSourceURL != "" {
+		sourceurl, err := url.Parse(dc.ImagesSourceURL)
+		if err != nil || (sourceurl.Scheme != "http" && sourceurl.Scheme != "https") || sourceurl.Host == "" {
+			return fmt.Errorf("invalid images source URL '%v'", dc.ImagesSourceURL)
+		}
+	}
+
+	return nil
+}
+
+var (
+	driverconfig           = &driverconfigdata{}
+	driverconfigmanager, _ = workspace.NewFileConfigManager(driverConfigFile, driverconfig)
+	// driverconfigdir is the configuration directory that driverconfig
+	// was loaded from or saved to, or empty if it has not been loaded.
+	driverconfigdir string
+	// driverconfigmutex protects driverconfig and driverconfigdir. It
+	// should be held while loading or saving driverconfig.
+	driverconfigmutex sync.Mutex
+)
+
+type driverconfigdata struct {
+	config DriverConfig
+}
+
+func (dcd *driverconfigdata) Serialize() ([]byte, error) {
+	return json.MarshalIndent(dcd.config, "", "  ")
+}
+
+func (dcd *driverconfigdata) Deserialize(data []byte) error {
+	loaddata := defaultdriverconfig()
+	err := json.Unmarshal(data, &loaddata)
+	if err != nil {
+		return err
+	}
+
+	err = loaddata.Validate()
+	if err != nil {
+		return err
+	}
+
+	dcd.config = loaddata
+	return nil
+}
+
+func (dcd *driverconfigdata) SetDefaults() {
+	dcd.config = defaultdriverconfig()
+}
+
+// loaddriverconfig returns the current settings. The configuration file
+// is read only the first time, and again if the configuration directory
+// changes, so that an edit to the file in the middle of an operation
+// cannot change settings, such as the SSH credentials, between steps or
+// retries.
+func loaddriverconfig() (DriverConfig, error) {
+	driverconfigmutex.Lock()
+	defer driverconfigmutex.Unlock()
+
+	confdir, err := hypervConfigDir()
+	if err != nil {
+		return DriverConfig{}, fmt.Errorf("could not load driver configuration: %v", err)
+	}
+
+	if confdir == driverconfigdir {
+		return driverconfig.config, nil
+	}
+
+	err = driverconfigmanager.Load()
+	if err != nil {
+		return DriverConfig{}, fmt.Errorf("could not load driver configuration: %v", err)
+	}
+	driverconfigdir = confdir
+
+	return driverconfig.config, nil
+}
+
+// Config returns the current driver settings. The configuration file is
+// read the first time settings are needed. Later changes to the file are
+// not seen; use SetConfig to change settings.
+func (vd *Driver) Config() (DriverConfig, error) {
+	return loaddriverconfig()
+}
+
+// SetConfig validates and saves the driver settings. The settings are
+// used by subsequent operations.
+func (vd *Driver) SetConfig(config DriverConfig) error {
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+
+	driverconfigmutex.Lock()
+	defer driverconfigmutex.Unlock()
+
+	confdir, err := hypervConfigDir()
+	if err != nil {
+		return fmt.Errorf("could not save driver configuration: %v", err)
+	}
+
+	driverconfig.config = config
+	err = driverconfigmanager.Save()
+	if err != nil {
+		// The file has to be read again
+		driverconfigdir = ""
+		return fmt.Errorf("could not save driver configuration: %v", err)
+	}
+	driverconfigdir = confdir
+
+	return nil
+}
+
+// ResetConfig restores the default driver settings, and saves them.
+func (vd *Driver) ResetConfig() error {
+	return vd.SetConfig(defaultdriverconfig())
+}
+
+// imagessourceurl returns the configured location of the master list
+// of images.
+func imagessourceurl() string {
+	config, err := loaddriverconfig()
+	if err != nil || config.ImagesSourceURL == "" {
+		return ImagesSourceURL
+	}
+
+	return config.ImagesSourceURL
+}
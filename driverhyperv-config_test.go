@@ -0,0 +1,96 @@
+package driverhyperv_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	driverhyperv "github.com/kuttiproject/driver-hyperv"
+	"github.com/kuttiproject/workspace"
+)
+
+func TestDriverConfig(t *testing.T) {
+	driver, fe := newtestdriver(t)
+
+	config, err := driver.Config()
+	if err != nil {
+		t.Fatalf("Error loading configuration: %v", err)
+	}
+	if config.MachineCPUs != 2 || config.MachineMemoryMB != 2048 || config.SwitchName != "Default Switch" {
+		t.Errorf("Unexpected default configuration: %+v", config)
+	}
+
+	invalidconfig := config
+	invalidconfig.MachineCPUs = 0
+	err = driver.SetConfig(invalidconfig)
+	if err == nil {
+		t.Errorf("Expected error setting invalid configuration")
+	}
+
+	config.MachineCPUs = 4
+	config.MachineMemoryMB = 4096
+	config.SwitchName = "kutti"
+	config.SSHUsername = "admin"
+	err = driver.SetConfig(config)
+	if err != nil {
+		t.Fatalf("Error setting configuration: %v", err)
+	}
+
+	_, err = driver.NewMachine("node1", "test", "1.27")
+	if err != nil {
+		t.Fatalf("Error creating machine: %v", err)
+	}
+
+	var newmachinerequest *driverhyperv.ScriptRequest
+	for _, request := range fe.requests {
+		if request.Command == "newmachine" {
+			newmachinerequest = request
+		}
+	}
+	if newmachinerequest == nil {
+		t.Fatalf("Expected a newmachine request")
+	}
+	if newmachinerequest.Parameter("MemoryBytes") != int64(4096)<<20 {
+		t.Errorf("Expected MemoryBytes %v, got %v", int64(4096)<<20, newmachinerequest.Parameter("MemoryBytes"))
+	}
+	if newmachinerequest.Parameter("ProcessorCount") != 4 {
+		t.Errorf("Expected ProcessorCount 4, got %v", newmachinerequest.Parameter("ProcessorCount"))
+	}
+	if newmachinerequest.Parameter("SwitchName") != "kutti" {
+		t.Errorf("Expected SwitchName kutti, got %v", newmachinerequest.Parameter("SwitchName"))
+	}
+
+	if len(fe.commands) != 1 || !strings.Contains(fe.commands[0], "/home/admin/") {
+		t.Errorf("Expected rename command for user admin, got %v", fe.commands)
+	}
+
+	// Changes to the file after it has been read are not seen
+	confdir, err := workspace.ConfigDir()
+	if err != nil {
+		t.Fatalf("Error getting configuration directory: %v", err)
+	}
+	err = os.WriteFile(filepath.Join(confdir, "driver-hyperv.json"), []byte(`{"SSHUsername": "other"}`), 0644)
+	if err != nil {
+		t.Fatalf("Error writing configuration file: %v", err)
+	}
+	config, err = driver.Config()
+	if err != nil {
+		t.Fatalf("Error loading configuration: %v", err)
+	}
+	if config.SSHUsername != "admin" {
+		t.Errorf("Expected SSH username admin after editing the file, got %v", config.SSHUsername)
+	}
+
+	err = driver.ResetConfig()
+	if err != nil {
+		t.Fatalf("Error resetting configuration: %v", err)
+	}
+	config, err = driver.Config()
+	if err != nil {
+		t.Fatalf("Error loading configuration: %v", err)
+	}
+	if config.SSHUsername != "kuttiadmin" {
+		t.Errorf("Expected default SSH username after reset, got %v", config.SSHUsername)
+	}
+}
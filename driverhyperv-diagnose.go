@@ -0,0 +1,438 @@
+package driverhyperv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kuttiproject/drivercore"
+	"github.com/kuttiproject/workspace"
+)
+
+// CheckStatus is the outcome of a diagnostic check.
+type CheckStatus string
+
+// The possible outcomes of a diagnostic check.
+const (
+	CheckPass = CheckStatus("Pass")
+	CheckWarn = CheckStatus("Warn")
+	CheckFail = CheckStatus("Fail")
+)
+
+// Thresholds used by diagnostic checks.
+const (
+	// Free space below which a volume check fails. A single node disk
+	// needs about this much.
+	diagnoseFailFreeBytes = 5 << 30
+	// Free space below which a volume check warns.
+	diagnoseWarnFreeBytes = 20 << 30
+	// Age after which the image list is considered stale.
+	diagnoseImageListMaxAge = 30 * 24 * time.Hour
+)
+
+// DiagnosticCheck is the result of a single diagnostic check.
+type DiagnosticCheck struct {
+	// Name identifies the check, for example "Virtual switch".
+	Name string
+	// Status is the outcome of the check.
+	Status CheckStatus
+	// Message describes what was found.
+	Message string
+	// Remediation suggests how to fix a warning or failure. It is
+	// empty if the check passed.
+	Remediation string
+}
+
+// DiagnosticReport is a structured report about the ability of the
+// host to run the driver.
+type DiagnosticReport struct {
+	Checks []DiagnosticCheck
+}
+
+// Status returns the worst outcome among all checks in the report.
+func (dr *DiagnosticReport) Status() CheckStatus {
+	result := CheckPass
+	for _, check := range dr.Checks {
+		switch check.Status {
+		case CheckFail:
+			return CheckFail
+		case CheckWarn:
+			result = CheckWarn
+		}
+	}
+
+	return result
+}
+
+func (dr *DiagnosticReport) add(name string, status CheckStatus, message string, remediation string) {
+	dr.Checks = append(dr.Checks, DiagnosticCheck{
+		Name:        name,
+		Status:      status,
+		Message:     message,
+		Remediation: remediation,
+	})
+}
+
+// hostdiagnosis is the payload of the "diagnose" command.
+type hostdiagnosis struct {
+	ScriptVersion     string
+	PowerShellEdition string
+	PowerShellVersion string
+	HypervisorPresent bool
+	PermissionLevel   string
+	HyperVModule      bool
+	SwitchExists      bool
+	Volumes           []struct {
+		Name         string
+		Path         string
+		FreeBytes    int64
+		TotalBytes   int64
+		ErrorMessage string
+	}
+}
+
+// decodepayload converts the payload of an interface script result
+// into a typed value.
+func decodepayload(payload map[string]interface{}, v interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// Diagnose checks the host for everything the driver needs, and returns
+// a report with the outcome of each check and, for any problems found,
+// a suggested remedy. Unlike Status, it does not stop at the first
+// problem.
+func (vd *Driver) Diagnose() *DiagnosticReport {
+	return vd.DiagnoseContext(context.Background())
+}
+
+// DiagnoseContext checks the host like Diagnose. If the context is done
+// before the host checks complete, they are reported as failed.
+func (vd *Driver) DiagnoseContext(ctx context.Context) *DiagnosticReport {
+	report := &DiagnosticReport{}
+
+	vd.diagnosehost(ctx, report)
+	diagnoseimagelist(report)
+	diagnosecachedimages(report)
+
+	return report
+}
+
+func (vd *Driver) diagnosehost(ctx context.Context, report *DiagnosticReport) {
+	if vd.currentexecutor() == nil {
+		err := vd.createexecutor()
+		if err != nil {
+			report.add(
+				"PowerShell",
+				CheckFail,
+				err.Error(),
+				"Install Windows PowerShell or PowerShell 7, and make sure it is on the PATH.",
+			)
+			return
+		}
+	}
+
+	config, err := loaddriverconfig()
+	if err != nil {
+		report.add(
+			"Configuration",
+			CheckFail,
+			err.Error(),
+			"Check that the driver configuration file is valid JSON.",
+		)
+		config = defaultdriverconfig()
+	}
+
+	params := scriptparams{
+		"SwitchName": config.SwitchName,
+	}
+	storagedirs := []struct {
+		param   string
+		dirfunc func() (string, error)
+	}{
+		{"MachinePath", vd.machineDir},
+		{"DiskPath", vd.diskDir},
+	}
+	for _, storagedir := range storagedirs {
+		dir, err := storagedir.dirfunc()
+		if err == nil {
+			dir, err = vd.hostpath(dir)
+		}
+		if err != nil {
+			report.add(
+				"Storage directories",
+				CheckFail,
+				err.Error(),
+				"Check that the storage directory exists and is accessible.",
+			)
+			continue
+		}
+		params[storagedir.param] = dir
+	}
+	// The image cache is on the machine running the driver, so it can
+	// only be checked by the interface script for a local host.
+	if vd.remote == nil {
+		cachedir, err := hypervCacheDir()
+		if err == nil {
+			cachedir, err = vd.hostpath(cachedir)
+		}
+		if err == nil {
+			params["CachePath"] = cachedir
+		}
+	}
+
+	result, err := vd.runwithresults(ctx, "diagnose", params)
+	if err == nil && !result.Success {
+		err = newoperationerror("diagnose host", "", result)
+	}
+	if err != nil {
+		report.add(
+			"Interface script",
+			CheckFail,
+			err.Error(),
+			"Check that PowerShell can run scripts on the host.",
+		)
+		return
+	}
+
+	var diagnosis hostdiagnosis
+	err = decodepayload(result.Payload, &diagnosis)
+	if err != nil {
+		report.add(
+			"Interface script",
+			CheckFail,
+			fmt.Sprintf("could not parse diagnosis: %v", err),
+			"Check that the interface script has not been modified.",
+		)
+		return
+	}
+
+	powershellname := "Windows PowerShell"
+	if diagnosis.PowerShellEdition == "Core" {
+		powershellname = "PowerShell"
+	}
+	report.add(
+		"PowerShell",
+		CheckPass,
+		fmt.Sprintf("%v %v", powershellname, diagnosis.PowerShellVersion),
+		"",
+	)
+
+	if diagnosis.ScriptVersion == ScriptVersion {
+		report.add("Interface script", CheckPass, "version "+ScriptVersion, "")
+	} else {
+		report.add(
+			"Interface script",
+			CheckFail,
+			fmt.Sprintf(
+				"interface script version '%v' does not match driver script version '%v'",
+				diagnosis.ScriptVersion,
+				ScriptVersion,
+			),
+			"Delete the cached interface script, so that the driver can write the correct version.",
+		)
+	}
+
+	if diagnosis.HypervisorPresent {
+		report.add("Hypervisor", CheckPass, "Hyper-V hypervisor is running", "")
+	} else {
+		report.add(
+			"Hypervisor",
+			CheckFail,
+			"Hyper-V hypervisor is not running",
+			"Enable the Hyper-V feature in Windows, and restart.",
+		)
+	}
+
+	if diagnosis.HyperVModule {
+		report.add("Hyper-V module", CheckPass, "Hyper-V PowerShell module is available", "")
+	} else {
+		report.add(
+			"Hyper-V module",
+			CheckFail,
+			"Hyper-V PowerShell module is not available",
+			"Enable the 'Hyper-V Module for Windows PowerShell' Windows feature.",
+		)
+	}
+
+	switch diagnosis.PermissionLevel {
+	case "administrator":
+		report.add("Permissions", CheckPass, "user is an administrator", "")
+	case "hypervadministrator":
+		report.add("Permissions", CheckPass, "user is a member of the Hyper-V Administrators group", "")
+	default:
+		report.add(
+			"Permissions",
+			CheckFail,
+			"user is not an administrator, or a member of the Hyper-V Administrators group",
+			"Add the user to the Hyper-V Administrators group, and log in again.",
+		)
+	}
+
+	switch {
+	case diagnosis.SwitchExists:
+		report.add("Virtual switch", CheckPass, fmt.Sprintf("the \"%v\" virtual switch exists", config.SwitchName), "")
+	case config.SwitchName == defaultdriverconfig().SwitchName:
+		report.add(
+			"Virtual switch",
+			CheckFail,
+			fmt.Sprintf("the \"%v\" virtual switch does not exist", config.SwitchName),
+			"The Default Switch is created by Windows 10 version 1709 and later when Hyper-V is enabled. Try disabling and re-enabling Hyper-V.",
+		)
+	default:
+		report.add(
+			"Virtual switch",
+			CheckFail,
+			fmt.Sprintf("the \"%v\" virtual switch does not exist", config.SwitchName),
+			"Create the switch using New-VMSwitch, or change SwitchName in the driver configuration.",
+		)
+	}
+
+	volumenames := map[string]string{
+		"MachineDir": "Free space (machines)",
+		"DiskDir":    "Free space (disks)",
+		"CacheDir":   "Free space (image cache)",
+	}
+	for _, volume := range diagnosis.Volumes {
+		name := volumenames[volume.Name]
+		if name == "" {
+			name = "Free space (" + volume.Name + ")"
+		}
+
+		switch {
+		case volume.ErrorMessage != "":
+			report.add(
+				name,
+				CheckWarn,
+				fmt.Sprintf("could not determine free space for '%v': %v", volume.Path, volume.ErrorMessage),
+				"Check that the directory is on a local volume that Hyper-V can use.",
+			)
+		case volume.FreeBytes < diagnoseFailFreeBytes:
+			report.add(
+				name,
+				CheckFail,
+				fmt.Sprintf("%v free on the volume containing '%v'", formatbytes(volume.FreeBytes), volume.Path),
+				"Free up space on the volume, or set a storage directory on another volume.",
+			)
+		case volume.FreeBytes < diagnoseWarnFreeBytes:
+			report.add(
+				name,
+				CheckWarn,
+				fmt.Sprintf("%v free on the volume containing '%v'", formatbytes(volume.FreeBytes), volume.Path),
+				"Free up space on the volume, or set a storage directory on another volume.",
+			)
+		default:
+			report.add(
+				name,
+				CheckPass,
+				fmt.Sprintf("%v free on the volume containing '%v'", formatbytes(volume.FreeBytes), volume.Path),
+				"",
+			)
+		}
+	}
+}
+
+func diagnoseimagelist(report *DiagnosticReport) {
+	confdir, err := hypervConfigDir()
+	if err != nil {
+		report.add("Image list", CheckFail, err.Error(), "Check that the kutti configuration directory is accessible.")
+		return
+	}
+
+	fileinfo, err := os.Stat(filepath.Join(confdir, imagesConfigFile))
+	if os.IsNotExist(err) {
+		report.add(
+			"Image list",
+			CheckWarn,
+			"the image list has never been fetched",
+			"Update the image list.",
+		)
+		return
+	}
+	if err != nil {
+		report.add("Image list", CheckFail, err.Error(), "Check that the kutti configuration directory is accessible.")
+		return
+	}
+
+	age := time.Since(fileinfo.ModTime())
+	if age > diagnoseImageListMaxAge {
+		report.add(
+			"Image list",
+			CheckWarn,
+			fmt.Sprintf("the image list was last updated %v days ago", int(age.Hours()/24)),
+			"Update the image list.",
+		)
+		return
+	}
+
+	report.add(
+		"Image list",
+		CheckPass,
+		fmt.Sprintf("the image list was last updated on %v", fileinfo.ModTime().Format("2006-01-02")),
+		"",
+	)
+}
+
+func diagnosecachedimages(report *DiagnosticReport) {
+	imagemutex.Lock()
+	err := imageconfigmanager.Load()
+	var images []Image
+	if err == nil {
+		for _, image := range imagedata.images {
+			if image.imageStatus == drivercore.ImageStatusDownloaded {
+				images = append(images, *image)
+			}
+		}
+	}
+	imagemutex.Unlock()
+
+	if err != nil {
+		report.add("Cached images", CheckFail, fmt.Sprintf("could not load image list: %v", err), "Update the image list.")
+		return
+	}
+
+	for _, image := range images {
+
+		name := "Image " + image.imageK8sVersion
+		remediation := "Purge the local copy of the image, and fetch it again."
+
+		imagepath, err := imagepathfromk8sversion(image.imageK8sVersion)
+		if err != nil {
+			report.add(name, CheckFail, err.Error(), remediation)
+			continue
+		}
+
+		checksum, err := workspace.ChecksumFile(imagepath)
+		if err != nil {
+			report.add(name, CheckFail, fmt.Sprintf("could not read cached image: %v", err), remediation)
+			continue
+		}
+
+		if checksum != image.imageChecksum {
+			report.add(name, CheckFail, "cached image does not match its checksum", remediation)
+			continue
+		}
+
+		report.add(name, CheckPass, "cached image is intact", "")
+	}
+
+	if len(images) == 0 {
+		report.add("Cached images", CheckPass, "no images are cached", "")
+	}
+}
+
+func formatbytes(bytes int64) string {
+	const gib = 1 << 30
+	if bytes >= gib {
+		return fmt.Sprintf("%.1f GiB", float64(bytes)/gib)
+	}
+
+	return fmt.Sprintf("%v MiB", bytes>>20)
+}
@@ -0,0 +1,113 @@
+package driverhyperv_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	driverhyperv "github.com/kuttiproject/driver-hyperv"
+	"github.com/kuttiproject/workspace"
+)
+
+// diagnoseexecutor reports a host with only the default switch, and
+// with little free disk space.
+type diagnoseexecutor struct{}
+
+func (de diagnoseexecutor) Execute(ctx context.Context, request *driverhyperv.ScriptRequest) (*driverhyperv.DriverResult, error) {
+	if request.Command != "diagnose" {
+		return nil, fmt.Errorf("diagnose executor: unexpected command %v", request.Command)
+	}
+
+	switchname, _ := request.Parameter("SwitchName").(string)
+
+	volumes := []interface{}{}
+	for name, param := range map[string]string{"MachineDir": "MachinePath", "DiskDir": "DiskPath"} {
+		path, _ := request.Parameter(param).(string)
+		volumes = append(volumes, map[string]interface{}{
+			"Name":       name,
+			"Path":       path,
+			"FreeBytes":  float64(10 << 30),
+			"TotalBytes": float64(100 << 30),
+		})
+	}
+
+	return &driverhyperv.DriverResult{
+		Success: true,
+		Payload: map[string]interface{}{
+			"ScriptVersion":     driverhyperv.ScriptVersion,
+			"PowerShellEdition": "Desktop",
+			"PowerShellVersion": "5.1.19041.1",
+			"HypervisorPresent": true,
+			"PermissionLevel":   "hypervadministrator",
+			"HyperVModule":      true,
+			"SwitchExists":      switchname == "Default Switch",
+			"Volumes":           volumes,
+		},
+	}, nil
+}
+
+func TestDiagnose(t *testing.T) {
+	err := workspace.Set(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error setting workspace: %v", err)
+	}
+
+	driver := driverhyperv.NewDriverWithExecutor(diagnoseexecutor{})
+
+	// The configured switch is checked
+	report := driver.Diagnose()
+	for _, check := range report.Checks {
+		if check.Name == "Virtual switch" && check.Status != driverhyperv.CheckPass {
+			t.Errorf("Expected the default switch to be found, got %v: %v", check.Status, check.Message)
+		}
+	}
+
+	config, err := driver.Config()
+	if err != nil {
+		t.Fatalf("Error loading configuration: %v", err)
+	}
+	config.SwitchName = "kutti"
+	err = driver.SetConfig(config)
+	if err != nil {
+		t.Fatalf("Error setting configuration: %v", err)
+	}
+
+	report = driver.Diagnose()
+
+	expected := map[string]driverhyperv.CheckStatus{
+		"PowerShell":            driverhyperv.CheckPass,
+		"Interface script":      driverhyperv.CheckPass,
+		"Hypervisor":            driverhyperv.CheckPass,
+		"Hyper-V module":        driverhyperv.CheckPass,
+		"Permissions":           driverhyperv.CheckPass,
+		"Virtual switch":        driverhyperv.CheckFail,
+		"Free space (machines)": driverhyperv.CheckWarn,
+		"Free space (disks)":    driverhyperv.CheckWarn,
+	}
+
+	found := map[string]bool{}
+	for _, check := range report.Checks {
+		status, ok := expected[check.Name]
+		if !ok {
+			continue
+		}
+		found[check.Name] = true
+
+		if check.Status != status {
+			t.Errorf("Expected check '%v' to be %v, got %v: %v", check.Name, status, check.Status, check.Message)
+		}
+		if check.Status != driverhyperv.CheckPass && check.Remediation == "" {
+			t.Errorf("Expected a remediation hint for check '%v'", check.Name)
+		}
+	}
+
+	for name := range expected {
+		if !found[name] {
+			t.Errorf("Expected check '%v' in report", name)
+		}
+	}
+
+	if report.Status() != driverhyperv.CheckFail {
+		t.Errorf("Expected report status %v, got %v", driverhyperv.CheckFail, report.Status())
+	}
+}
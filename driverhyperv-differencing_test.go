@@ -0,0 +1,103 @@
+package driverhyperv_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	driverhyperv "github.com/kuttiproject/driver-hyperv"
+	"github.com/kuttiproject/drivercore"
+	"github.com/kuttiproject/workspace"
+)
+
+func TestDifferencingDisks(t *testing.T) {
+	err := workspace.Set(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error setting workspace: %v", err)
+	}
+
+	imagefilepath := setupimagecatalog(t, "1.27")
+
+	fe := &sshfakeexecutor{fakeexecutor: newfakeexecutor()}
+	driver := driverhyperv.NewDriverWithExecutor(fe)
+
+	config, err := driver.Config()
+	if err != nil {
+		t.Fatalf("Error loading configuration: %v", err)
+	}
+	config.DifferencingDisks = true
+	err = driver.SetConfig(config)
+	if err != nil {
+		t.Fatalf("Error setting configuration: %v", err)
+	}
+
+	image, err := driver.GetImage("1.27")
+	if err != nil {
+		t.Fatalf("Error getting image: %v", err)
+	}
+	err = image.FromFile(imagefilepath)
+	if err != nil {
+		t.Fatalf("Error adding image: %v", err)
+	}
+
+	for _, machinename := range []string{"node1", "node2"} {
+		_, err = driver.NewMachine(machinename, "test", "1.27")
+		if err != nil {
+			t.Fatalf("Error creating machine %v: %v", machinename, err)
+		}
+	}
+
+	hypervimage := image.(*driverhyperv.Image)
+	if len(hypervimage.ChildDisks()) != 2 {
+		t.Errorf("Expected 2 child disks, got %v", hypervimage.ChildDisks())
+	}
+
+	cachedimagepath := ""
+	for _, request := range fe.requests {
+		if request.Command == "newdifferencingdisk" {
+			cachedimagepath, _ = request.Parameter("ParentPath").(string)
+		}
+	}
+	if cachedimagepath == "" {
+		t.Fatalf("Expected a newdifferencingdisk request")
+	}
+	fileinfo, err := os.Stat(cachedimagepath)
+	if err != nil {
+		t.Fatalf("Error checking cached image: %v", err)
+	}
+	if fileinfo.Mode().Perm()&0222 != 0 {
+		t.Errorf("Expected cached image to be read-only, got mode %v", fileinfo.Mode())
+	}
+
+	err = image.PurgeLocal()
+	if !errors.Is(err, driverhyperv.ErrImageInUse) {
+		t.Errorf("Expected ErrImageInUse purging parent image, got %v", err)
+	}
+	if image.Status() != drivercore.ImageStatusDownloaded {
+		t.Errorf("Expected image to stay downloaded, got %v", image.Status())
+	}
+
+	err = image.FromFile(imagefilepath)
+	if !errors.Is(err, driverhyperv.ErrImageInUse) {
+		t.Errorf("Expected ErrImageInUse replacing parent image, got %v", err)
+	}
+
+	for _, machinename := range []string{"node1", "node2"} {
+		err = driver.DeleteMachine(machinename, "test")
+		if err != nil {
+			t.Fatalf("Error deleting machine %v: %v", machinename, err)
+		}
+	}
+
+	if len(hypervimage.ChildDisks()) != 0 {
+		t.Errorf("Expected no child disks, got %v", hypervimage.ChildDisks())
+	}
+
+	err = image.PurgeLocal()
+	if err != nil {
+		t.Errorf("Error purging image: %v", err)
+	}
+	if _, err := os.Stat(cachedimagepath); !os.IsNotExist(err) {
+		t.Errorf("Expected cached image to be removed")
+	}
+}
@@ -0,0 +1,144 @@
+package driverhyperv
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the driver. Errors returned by Hyper-V operations
+// wrap one of these where the cause of the failure is known, and can be
+// tested with errors.Is.
+var (
+	ErrMachineNotFound         = errors.New("machine not found")
+	ErrMachineExists           = errors.New("machine already exists")
+	ErrHyperVNotEnabled        = errors.New("Hyper-V not enabled")
+	ErrInsufficientPermissions = errors.New("insufficient permissions")
+	ErrInvalidState            = errors.New("machine is not in a valid state for the operation")
+	ErrInvalidArgument         = errors.New("invalid argument to interface script")
+	ErrInsufficientResources   = errors.New("insufficient host resources")
+	ErrImageInUse              = errors.New("image is the parent of machine disks")
+	ErrDataDiskNotFound        = errors.New("data disk not found")
+	ErrCheckpointNotFound      = errors.New("checkpoint not found")
+	ErrNotReady                = errors.New("machine not ready")
+)
+
+// The error codes returned by the interface script, and the errors they
+// correspond to.
+var scripterrors = map[string]error{
+	"MachineNotFound":         ErrMachineNotFound,
+	"MachineExists":           ErrMachineExists,
+	"HyperVNotEnabled":        ErrHyperVNotEnabled,
+	"InsufficientPermissions": ErrInsufficientPermissions,
+	"InvalidState":            ErrInvalidState,
+	"InvalidArgument":         ErrInvalidArgument,
+	"CheckpointNotFound":      ErrCheckpointNotFound,
+}
+
+// OperationError is returned when the interface script reports that a
+// Hyper-V operation failed.
+type OperationError struct {
+	// Operation describes what was being attempted, for example
+	// "start the host".
+	Operation string
+	// MachineName is the name of the machine being operated on. It may
+	// be empty.
+	MachineName string
+	// Code is the error code returned by the interface script.
+	Code string
+	// Message is the error message returned by the interface script.
+	Message string
+}
+
+func (oe *OperationError) Error() string {
+	if oe.MachineName == "" {
+		return fmt.Sprintf("could not %s: %s", oe.Operation, oe.Message)
+	}
+
+	return fmt.Sprintf("could not %s '%s': %s", oe.Operation, oe.MachineName, oe.Message)
+}
+
+// Unwrap returns the error corresponding to the error code, or nil if
+// the code is unknown.
+func (oe *OperationError) Unwrap() error {
+	return scripterrors[oe.Code]
+}
+
+func newoperationerror(operation string, machinename string, result *DriverResult) *OperationError {
+	return &OperationError{
+		Operation:   operation,
+		MachineName: machinename,
+		Code:        result.ErrorCode,
+		Message:     result.ErrorMessage,
+	}
+}
+
+// The resources checked before a machine is created or started.
+const (
+	ResourceMemory     = "memory"
+	ResourceProcessors = "logical processors"
+	ResourceDiskSpace  = "disk space"
+)
+
+// InsufficientResourcesError is returned when the host does not have
+// enough of a resource to create or start a machine. It wraps
+// ErrInsufficientResources.
+type InsufficientResourcesError struct {
+	// Resource is one of ResourceMemory, ResourceProcessors or
+	// ResourceDiskSpace.
+	Resource string
+	// MachineName is the name of the machine being created or started.
+	MachineName string
+	// Required and Available are in bytes for memory and disk space,
+	// and a count for logical processors.
+	Required  int64
+	Available int64
+}
+
+func (ire *InsufficientResourcesError) Error() string {
+	required := fmt.Sprint(ire.Required)
+	available := fmt.Sprint(ire.Available)
+	if ire.Resource != ResourceProcessors {
+		required = formatbytes(ire.Required)
+		available = formatbytes(ire.Available)
+	}
+
+	return fmt.Sprintf(
+		"not enough %v on host for machine '%v': %v required, %v available",
+		ire.Resource,
+		ire.MachineName,
+		required,
+		available,
+	)
+}
+
+// Unwrap returns ErrInsufficientResources.
+func (ire *InsufficientResourcesError) Unwrap() error {
+	return ErrInsufficientResources
+}
+
+// ReadinessError is returned when a machine does not pass its readiness
+// probes in time. It wraps ErrNotReady, and the result of the last probe
+// that failed.
+type ReadinessError struct {
+	// MachineName is the name of the machine being waited for.
+	MachineName string
+	// Probe is the name of the last probe that failed.
+	Probe string
+	// Err is the result of the last probe that failed.
+	Err error
+}
+
+func (re *ReadinessError) Error() string {
+	return fmt.Sprintf(
+		"machine '%v' not ready: probe %v failed: %v",
+		re.MachineName,
+		re.Probe,
+		re.Err,
+	)
+}
+
+// Unwrap returns ErrNotReady, and the result of the last probe that
+// failed.
+func (re *ReadinessError) Unwrap() []error {
+	return []error{ErrNotReady, re.Err}
+}
@@ -0,0 +1,134 @@
+package driverhyperv
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+)
+
+// Executor runs commands of the interface script, and returns their results.
+// The driver performs every Hyper-V operation through an Executor.
+// By default, the driver uses an Executor that runs the interface script
+// with PowerShell. A different Executor can be supplied through
+// NewDriverWithExecutor, for example to test code that uses the driver on
+// hosts without Hyper-V.
+type Executor interface {
+	// Execute runs the specified interface script request. If the context
+	// is cancelled or its deadline expires before the command completes,
+	// Execute should abandon the command and return the context's error.
+	Execute(ctx context.Context, request *ScriptRequest) (*DriverResult, error)
+}
+
+// SSHExecutor runs commands inside machines over SSH. If the Executor
+// supplied to NewDriverWithExecutor also implements SSHExecutor, the
+// driver uses it to run commands inside machines, instead of connecting
+// to them.
+type SSHExecutor interface {
+	// ExecuteSSH runs the specified command inside the machine at the
+	// specified address, and returns its output.
+	ExecuteSSH(ctx context.Context, address string, command string) (string, error)
+}
+
+// ScriptRequest is a request to run a command of the interface script.
+// It is passed to the interface script as a single JSON document, so
+// parameter values are never interpreted by PowerShell. The interface
+// script validates the parameters of each command.
+type ScriptRequest struct {
+	Command    string
+	Parameters map[string]interface{}
+}
+
+// Parameter returns the value of the named parameter, or nil.
+func (sr *ScriptRequest) Parameter(name string) interface{} {
+	return sr.Parameters[name]
+}
+
+// encode returns the request as a base64-encoded JSON document, which
+// can safely be passed as a single command-line argument.
+func (sr *ScriptRequest) encode() (string, error) {
+	requestdata, err := json.Marshal(sr)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(requestdata), nil
+}
+
+// NewDriverWithExecutor returns a Hyper-V driver which uses the specified
+// Executor instead of PowerShell. The driver is not registered with
+// drivercore. Callers can register it under a name of their choice.
+func NewDriverWithExecutor(executor Executor) *Driver {
+	return &Driver{
+		executor:       executor,
+		customexecutor: true,
+	}
+}
+
+// rawexecutor is implemented by the driver's own executors. It runs an
+// interface script request, and returns the raw output of the script.
+// This lets the driver record the raw output when tracing.
+type rawexecutor interface {
+	Executor
+	executeraw(ctx context.Context, request *ScriptRequest) (stdout string, stderr string, err error)
+}
+
+// parseresult parses the output of the interface script.
+func parseresult(stdout string) (*DriverResult, error) {
+	dr := &DriverResult{}
+	err := json.Unmarshal([]byte(stdout), dr)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse interface script output: %v", err)
+	}
+
+	return dr, nil
+}
+
+// powershellexecutor runs the interface script by starting a new PowerShell
+// process for each command.
+type powershellexecutor struct {
+	powershellpath string
+	scriptpath     string
+}
+
+func (pe *powershellexecutor) Execute(ctx context.Context, request *ScriptRequest) (*DriverResult, error) {
+	stdout, _, err := pe.executeraw(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseresult(stdout)
+}
+
+func (pe *powershellexecutor) executeraw(ctx context.Context, request *ScriptRequest) (string, string, error) {
+	encodedrequest, err := request.encode()
+	if err != nil {
+		return "", "", err
+	}
+
+	powershellargs := []string{
+		"-NoProfile",
+		"-NonInteractive",
+		"-File",
+		pe.scriptpath,
+		encodedrequest,
+	}
+
+	// The PowerShell process is killed if the context is done
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, pe.powershellpath, powershellargs...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return stdout.String(), stderr.String(), ctx.Err()
+	}
+	if err != nil {
+		return stdout.String(), stderr.String(), fmt.Errorf("could not run interface script: %v: %s", err, stderr.String())
+	}
+
+	return stdout.String(), stderr.String(), nil
+}
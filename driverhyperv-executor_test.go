@@ -0,0 +1,552 @@
+package driverhyperv_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	driverhyperv "github.com/kuttiproject/driver-hyperv"
+	"github.com/kuttiproject/drivercore"
+	"github.com/kuttiproject/workspace"
+)
+
+// fakeexecutor is a scripted stand-in for the interface script.
+// It keeps a map of machine states, and implements enough commands
+// to manage machines. It is safe for concurrent use.
+type fakeexecutor struct {
+	mutex    sync.Mutex
+	machines map[string]string
+	specs    map[string]map[string]interface{}
+	disks    map[string]int64
+	// attached holds the paths of disks attached to each machine, with
+	// the boot disk first
+	attached map[string][]string
+	// checkpoints holds the checkpoints of each machine, with the state
+	// of the machine when each was created
+	checkpoints map[string][]fakecheckpoint
+	requests    []*driverhyperv.ScriptRequest
+	// The host capacity reported by the "hostcapacity" command. Every
+	// machine has 2 GiB of memory and 2 processors.
+	freememory        int64
+	logicalprocessors int64
+	freedisk          int64
+}
+
+type fakecheckpoint struct {
+	name  string
+	state string
+}
+
+func newfakeexecutor() *fakeexecutor {
+	return &fakeexecutor{
+		machines:          map[string]string{},
+		specs:             map[string]map[string]interface{}{},
+		disks:             map[string]int64{},
+		attached:          map[string][]string{},
+		checkpoints:       map[string][]fakecheckpoint{},
+		freememory:        64 << 30,
+		logicalprocessors: 16,
+		freedisk:          1 << 40,
+	}
+}
+
+// newtestworkspace sets up an empty workspace, with a dummy image for
+// Kubernetes version 1.27 in the image cache.
+func newtestworkspace(t *testing.T) {
+	t.Helper()
+
+	err := workspace.Set(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error setting workspace: %v", err)
+	}
+
+	cachedir, err := workspace.CacheSubDir("driver-hyperv")
+	if err != nil {
+		t.Fatalf("Error getting cache directory: %v", err)
+	}
+	err = os.WriteFile(filepath.Join(cachedir, "kutti-1.27.vhdx"), []byte("image"), 0644)
+	if err != nil {
+		t.Fatalf("Error creating image: %v", err)
+	}
+}
+
+// newtestdriver sets up a test workspace, and returns a driver that uses
+// a new fake executor, along with the executor.
+func newtestdriver(t *testing.T) (*driverhyperv.Driver, *sshfakeexecutor) {
+	t.Helper()
+
+	newtestworkspace(t)
+
+	fe := &sshfakeexecutor{fakeexecutor: newfakeexecutor()}
+	return driverhyperv.NewDriverWithExecutor(fe), fe
+}
+
+func (fe *fakeexecutor) machineresult(name string) *driverhyperv.DriverResult {
+	state, ok := fe.machines[name]
+	if !ok {
+		return &driverhyperv.DriverResult{
+			ErrorMessage: fmt.Sprintf("Hyper-V was unable to find a virtual machine with name \"%v\".", name),
+			ErrorCode:    "MachineNotFound",
+		}
+	}
+
+	ipaddress := ""
+	if state == "Running" {
+		ipaddress = "172.17.0.2"
+	}
+
+	machine := map[string]interface{}{
+		"Name":      name,
+		"IPAddress": ipaddress,
+		"State":     state,
+	}
+	if spec, ok := fe.specs[name]; ok {
+		machine["Spec"] = spec
+	}
+
+	return &driverhyperv.DriverResult{
+		Success: true,
+		Payload: map[string]interface{}{
+			"Machine": machine,
+		},
+	}
+}
+
+func (fe *fakeexecutor) Execute(ctx context.Context, request *driverhyperv.ScriptRequest) (*driverhyperv.DriverResult, error) {
+	fe.mutex.Lock()
+	defer fe.mutex.Unlock()
+
+	machinename, _ := request.Parameter("MachineName").(string)
+	fe.requests = append(fe.requests, request)
+
+	switch request.Command {
+	case "checkdriver":
+		return &driverhyperv.DriverResult{
+			Success: true,
+			Payload: map[string]interface{}{
+				"ScriptVersion": driverhyperv.ScriptVersion,
+			},
+		}, nil
+	case "newmachine":
+		if _, ok := fe.machines[machinename]; ok {
+			return &driverhyperv.DriverResult{
+				ErrorMessage: fmt.Sprintf("machine '%v' already exists", machinename),
+				ErrorCode:    "MachineExists",
+			}, nil
+		}
+		fe.machines[machinename] = "Off"
+		fe.disks[machinename] = 10 << 30
+		if vhdpath, ok := request.Parameter("VHDPath").(string); ok {
+			fe.attached[machinename] = []string{vhdpath}
+		}
+		fe.specs[machinename] = map[string]interface{}{
+			"ProcessorCount":       request.Parameter("ProcessorCount"),
+			"MemoryStartupBytes":   request.Parameter("MemoryBytes"),
+			"DynamicMemoryEnabled": request.Parameter("DynamicMemory") == true,
+			"MemoryMinimumBytes":   request.Parameter("MemoryMinimumBytes"),
+			"MemoryMaximumBytes":   request.Parameter("MemoryMaximumBytes"),
+			"MemoryWeight":         request.Parameter("MemoryWeight"),
+		}
+		return &driverhyperv.DriverResult{Success: true}, nil
+	case "deletemachine":
+		if _, ok := fe.machines[machinename]; !ok {
+			return fe.machineresult(machinename), nil
+		}
+		delete(fe.machines, machinename)
+		delete(fe.specs, machinename)
+		delete(fe.attached, machinename)
+		delete(fe.checkpoints, machinename)
+		return &driverhyperv.DriverResult{Success: true}, nil
+	case "getmachine", "waitmachine":
+		return fe.machineresult(machinename), nil
+	case "newdifferencingdisk":
+		diskpath, _ := request.Parameter("DiskPath").(string)
+		err := os.WriteFile(diskpath, []byte("differencing disk"), 0644)
+		if err != nil {
+			return &driverhyperv.DriverResult{ErrorMessage: err.Error()}, nil
+		}
+		return &driverhyperv.DriverResult{Success: true}, nil
+	case "newdatadisk":
+		diskpath, _ := request.Parameter("DiskPath").(string)
+		err := os.WriteFile(diskpath, []byte("data disk"), 0644)
+		if err != nil {
+			return &driverhyperv.DriverResult{ErrorMessage: err.Error()}, nil
+		}
+		return &driverhyperv.DriverResult{Success: true}, nil
+	case "listdisks":
+		if _, ok := fe.machines[machinename]; !ok {
+			return fe.machineresult(machinename), nil
+		}
+		disks := []interface{}{}
+		for i, diskpath := range fe.attached[machinename] {
+			disks = append(disks, map[string]interface{}{
+				"Path":               diskpath,
+				"ControllerType":     "SCSI",
+				"ControllerNumber":   0,
+				"ControllerLocation": i,
+			})
+		}
+		return &driverhyperv.DriverResult{
+			Success: true,
+			Payload: map[string]interface{}{"Disks": disks},
+		}, nil
+	case "attachdisk":
+		if _, ok := fe.machines[machinename]; !ok {
+			return fe.machineresult(machinename), nil
+		}
+		diskpath, _ := request.Parameter("DiskPath").(string)
+		fe.attached[machinename] = append(fe.attached[machinename], diskpath)
+		return &driverhyperv.DriverResult{Success: true}, nil
+	case "detachdisk":
+		if _, ok := fe.machines[machinename]; !ok {
+			return fe.machineresult(machinename), nil
+		}
+		diskpath, _ := request.Parameter("DiskPath").(string)
+		remaining := []string{}
+		for _, attachedpath := range fe.attached[machinename] {
+			if attachedpath != diskpath {
+				remaining = append(remaining, attachedpath)
+			}
+		}
+		if len(remaining) == len(fe.attached[machinename]) {
+			return &driverhyperv.DriverResult{
+				ErrorMessage: "disk is not attached",
+				ErrorCode:    "InvalidArgument",
+			}, nil
+		}
+		fe.attached[machinename] = remaining
+		return &driverhyperv.DriverResult{Success: true}, nil
+	case "newcheckpoint", "listcheckpoints", "restorecheckpoint", "deletecheckpoint":
+		return fe.checkpointresult(request), nil
+	case "resizedisk":
+		state, ok := fe.machines[machinename]
+		if !ok {
+			return fe.machineresult(machinename), nil
+		}
+		sizebytes, _ := request.Parameter("SizeBytes").(int64)
+		if state != "Off" {
+			return &driverhyperv.DriverResult{
+				ErrorMessage: "machine should be off to resize its disk",
+				ErrorCode:    "InvalidState",
+			}, nil
+		}
+		if sizebytes < fe.disks[machinename] {
+			return &driverhyperv.DriverResult{
+				ErrorMessage: "disk cannot be shrunk",
+				ErrorCode:    "InvalidArgument",
+			}, nil
+		}
+		oldsizebytes := fe.disks[machinename]
+		fe.disks[machinename] = sizebytes
+		return &driverhyperv.DriverResult{
+			Success: true,
+			Payload: map[string]interface{}{
+				"OldSizeBytes": float64(oldsizebytes),
+				"SizeBytes":    float64(sizebytes),
+			},
+		}, nil
+	case "hostcapacity":
+		capacity := map[string]interface{}{
+			"FreeMemoryBytes":   fe.freememory,
+			"LogicalProcessors": fe.logicalprocessors,
+			"Volume": map[string]interface{}{
+				"Name":      "DiskDir",
+				"FreeBytes": fe.freedisk,
+			},
+		}
+		if machinename != "" {
+			state, ok := fe.machines[machinename]
+			if !ok {
+				return fe.machineresult(machinename), nil
+			}
+			capacity["MachineState"] = state
+			capacity["MachineMemoryBytes"] = 2 << 30
+			capacity["MachineProcessorCount"] = 2
+		}
+		return &driverhyperv.DriverResult{Success: true, Payload: capacity}, nil
+	case "listmachines":
+		vmlist := []interface{}{}
+		for name := range fe.machines {
+			vmlist = append(vmlist, fe.machineresult(name).Payload["Machine"])
+		}
+		return &driverhyperv.DriverResult{
+			Success: true,
+			Payload: map[string]interface{}{"VMList": vmlist},
+		}, nil
+	case "startmachine":
+		if _, ok := fe.machines[machinename]; !ok {
+			return fe.machineresult(machinename), nil
+		}
+		fe.machines[machinename] = "Running"
+		return &driverhyperv.DriverResult{Success: true}, nil
+	case "stopmachine", "forcestopmachine":
+		if _, ok := fe.machines[machinename]; !ok {
+			return fe.machineresult(machinename), nil
+		}
+		fe.machines[machinename] = "Off"
+		return &driverhyperv.DriverResult{Success: true}, nil
+	case "pausemachine", "resumemachine", "savemachine":
+		state, ok := fe.machines[machinename]
+		if !ok {
+			return fe.machineresult(machinename), nil
+		}
+		transitions := map[string]map[string]string{
+			"pausemachine":  {"Running": "Paused"},
+			"resumemachine": {"Paused": "Running"},
+			"savemachine":   {"Running": "Saved", "Paused": "Saved"},
+		}
+		newstate, ok := transitions[request.Command][state]
+		if !ok {
+			return &driverhyperv.DriverResult{
+				ErrorMessage: fmt.Sprintf("The operation cannot be performed while the object is in its current state (%v).", state),
+				ErrorCode:    "InvalidState",
+			}, nil
+		}
+		fe.machines[machinename] = newstate
+		return &driverhyperv.DriverResult{Success: true}, nil
+	}
+
+	return nil, fmt.Errorf("fake executor: unexpected command %v", request.Command)
+}
+
+func (fe *fakeexecutor) checkpointresult(request *driverhyperv.ScriptRequest) *driverhyperv.DriverResult {
+	machinename, _ := request.Parameter("MachineName").(string)
+	checkpointname, _ := request.Parameter("CheckpointName").(string)
+
+	state, ok := fe.machines[machinename]
+	if !ok {
+		return fe.machineresult(machinename)
+	}
+
+	index := -1
+	for i, checkpoint := range fe.checkpoints[machinename] {
+		if checkpoint.name == checkpointname {
+			index = i
+		}
+	}
+
+	switch request.Command {
+	case "newcheckpoint":
+		if index >= 0 {
+			return &driverhyperv.DriverResult{
+				ErrorMessage: "checkpoint already exists",
+				ErrorCode:    "InvalidArgument",
+			}
+		}
+		fe.checkpoints[machinename] = append(fe.checkpoints[machinename], fakecheckpoint{name: checkpointname, state: state})
+		return &driverhyperv.DriverResult{Success: true}
+	case "listcheckpoints":
+		checkpoints := []interface{}{}
+		parentname := ""
+		for _, checkpoint := range fe.checkpoints[machinename] {
+			checkpoints = append(checkpoints, map[string]interface{}{
+				"Name":         checkpoint.name,
+				"CreationTime": "2024-01-02T03:04:05.0000000Z",
+				"ParentName":   parentname,
+			})
+			parentname = checkpoint.name
+		}
+		return &driverhyperv.DriverResult{
+			Success: true,
+			Payload: map[string]interface{}{"Checkpoints": checkpoints},
+		}
+	}
+
+	if index < 0 {
+		return &driverhyperv.DriverResult{
+			ErrorMessage: "checkpoint not found",
+			ErrorCode:    "CheckpointNotFound",
+		}
+	}
+
+	if request.Command == "restorecheckpoint" {
+		fe.machines[machinename] = fe.checkpoints[machinename][index].state
+	} else {
+		checkpoints := fe.checkpoints[machinename]
+		fe.checkpoints[machinename] = append(checkpoints[:index:index], checkpoints[index+1:]...)
+	}
+
+	return &driverhyperv.DriverResult{Success: true}
+}
+
+func TestDriverWithExecutor(t *testing.T) {
+	fe := newfakeexecutor()
+	driver := driverhyperv.NewDriverWithExecutor(fe)
+
+	if driver.Status() != "Ready" {
+		t.Fatalf("Expected driver status Ready, got %v: %v", driver.Status(), driver.Error())
+	}
+
+	qname := driver.QualifiedMachineName("node1", "test")
+	fe.machines[qname] = "Off"
+
+	machine, err := driver.GetMachine("node1", "test")
+	if err != nil {
+		t.Fatalf("Error getting machine: %v", err)
+	}
+	if machine.Status() != drivercore.MachineStatusStopped {
+		t.Errorf("Expected status %v, got %v", drivercore.MachineStatusStopped, machine.Status())
+	}
+
+	err = machine.Start()
+	if err != nil {
+		t.Fatalf("Error starting machine: %v", err)
+	}
+	machine.WaitForStateChange(25)
+	if machine.Status() != drivercore.MachineStatusRunning {
+		t.Errorf("Expected status %v, got %v", drivercore.MachineStatusRunning, machine.Status())
+	}
+	if machine.IPAddress() != "172.17.0.2" {
+		t.Errorf("Expected IP address 172.17.0.2, got '%v'", machine.IPAddress())
+	}
+
+	_, err = driver.GetMachine("node2", "test")
+	if !errors.Is(err, driverhyperv.ErrMachineNotFound) {
+		t.Errorf("Expected ErrMachineNotFound getting nonexistent machine, got %v", err)
+	}
+
+	delete(fe.machines, qname)
+	err = machine.Start()
+	if !errors.Is(err, driverhyperv.ErrMachineNotFound) {
+		t.Errorf("Expected ErrMachineNotFound starting deleted machine, got %v", err)
+	}
+}
+
+type disabledexecutor struct{}
+
+func (de disabledexecutor) Execute(ctx context.Context, request *driverhyperv.ScriptRequest) (*driverhyperv.DriverResult, error) {
+	return &driverhyperv.DriverResult{
+		ErrorMessage: "Hyper-V not enabled",
+		ErrorCode:    "HyperVNotEnabled",
+		Payload: map[string]interface{}{
+			"ScriptVersion": driverhyperv.ScriptVersion,
+		},
+	}, nil
+}
+
+func TestDriverNotEnabled(t *testing.T) {
+	driver := driverhyperv.NewDriverWithExecutor(disabledexecutor{})
+
+	if driver.Status() != "Error" {
+		t.Errorf("Expected driver status Error, got %v", driver.Status())
+	}
+
+	_, err := driver.GetMachine("node1", "test")
+	if !errors.Is(err, driverhyperv.ErrHyperVNotEnabled) {
+		t.Errorf("Expected ErrHyperVNotEnabled, got %v", err)
+	}
+}
+
+// hungexecutor simulates an interface script that never completes
+// anything except driver validation.
+type hungexecutor struct{}
+
+func (he hungexecutor) Execute(ctx context.Context, request *driverhyperv.ScriptRequest) (*driverhyperv.DriverResult, error) {
+	if request.Command == "checkdriver" {
+		return &driverhyperv.DriverResult{
+			Success: true,
+			Payload: map[string]interface{}{
+				"ScriptVersion": driverhyperv.ScriptVersion,
+			},
+		}, nil
+	}
+
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestDriverContextDeadline(t *testing.T) {
+	driver := driverhyperv.NewDriverWithExecutor(hungexecutor{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := driver.GetMachineContext(ctx, "node1", "test")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+// togglingexecutor reports Hyper-V as enabled or disabled, and counts
+// driver status checks.
+type togglingexecutor struct {
+	disabled bool
+	checks   int
+}
+
+func (te *togglingexecutor) Execute(ctx context.Context, request *driverhyperv.ScriptRequest) (*driverhyperv.DriverResult, error) {
+	if request.Command != "checkdriver" {
+		return nil, fmt.Errorf("toggling executor: unexpected command %v", request.Command)
+	}
+
+	te.checks++
+	result := &driverhyperv.DriverResult{
+		Success: !te.disabled,
+		Payload: map[string]interface{}{
+			"ScriptVersion": driverhyperv.ScriptVersion,
+		},
+	}
+	if te.disabled {
+		result.ErrorMessage = "Hyper-V not enabled"
+		result.ErrorCode = "HyperVNotEnabled"
+	}
+
+	return result, nil
+}
+
+func TestDriverRevalidation(t *testing.T) {
+	te := &togglingexecutor{}
+	driver := driverhyperv.NewDriverWithExecutor(te)
+
+	if driver.Status() != "Ready" || driver.Status() != "Ready" {
+		t.Fatalf("Expected driver status Ready, got %v: %v", driver.Status(), driver.Error())
+	}
+	if te.checks != 1 {
+		t.Errorf("Expected status to be checked once, got %v", te.checks)
+	}
+
+	te.disabled = true
+	if driver.Status() != "Ready" {
+		t.Errorf("Expected cached driver status Ready, got %v", driver.Status())
+	}
+
+	err := driver.Revalidate()
+	if !errors.Is(err, driverhyperv.ErrHyperVNotEnabled) {
+		t.Errorf("Expected ErrHyperVNotEnabled, got %v", err)
+	}
+	if driver.Status() != "Error" {
+		t.Errorf("Expected driver status Error, got %v", driver.Status())
+	}
+	if te.checks != 2 {
+		t.Errorf("Expected status to be checked twice, got %v", te.checks)
+	}
+
+	te.disabled = false
+	driver.Reset()
+	if driver.Status() != "Ready" {
+		t.Errorf("Expected driver status Ready after reset, got %v: %v", driver.Status(), driver.Error())
+	}
+
+	driver.SetValidationTTL(time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	driver.Status()
+	if te.checks != 4 {
+		t.Errorf("Expected status to be checked 4 times, got %v", te.checks)
+	}
+
+	history := driver.StatusHistory()
+	expected := []string{"Ready", "Error", "Ready"}
+	if len(history) != len(expected) {
+		t.Fatalf("Expected %v status changes, got %v", len(expected), len(history))
+	}
+	for i, change := range history {
+		if change.Status != expected[i] {
+			t.Errorf("Expected status change %v to be %v, got %v", i, expected[i], change.Status)
+		}
+	}
+}
@@ -1,9 +1,16 @@
 package driverhyperv
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/kuttiproject/drivercore"
 	"github.com/kuttiproject/kuttilog"
@@ -16,12 +23,16 @@ const ImagesVersion = "0.1"
 
 const imagesConfigFile = "driver-hyperv-images.json"
 
-// ImagesSourceURL is the location where the master list of images can be found
+// ImagesSourceURL is the location where the master list of images can be found.
+// It can be overridden by the ImagesSourceURL setting in the driver configuration.
 var ImagesSourceURL = "https://github.com/kuttiproject/driver-hyperv-images/releases/download/v" + ImagesVersion + "/" + imagesConfigFile
 
 var (
 	imagedata             = &imageconfigdata{}
 	imageconfigmanager, _ = workspace.NewFileConfigManager(imagesConfigFile, imagedata)
+	// imagemutex protects imagedata, and the status of every Image.
+	// It should be held while loading or saving imagedata.
+	imagemutex sync.Mutex
 )
 
 type imageconfigdata struct {
@@ -71,7 +82,32 @@ func imagepathfromk8sversion(k8sversion string) (string, error) {
 	return result, nil
 }
 
+// catalogimage returns a copy of the image for a Kubernetes version from
+// the image list, or nil if the list has no such image.
+func catalogimage(k8sversion string) *Image {
+	imagemutex.Lock()
+	defer imagemutex.Unlock()
+
+	err := imageconfigmanager.Load()
+	if err != nil {
+		return nil
+	}
+
+	img, ok := imagedata.images[k8sversion]
+	if !ok {
+		return nil
+	}
+
+	result := *img
+	return &result
+}
+
 func addfromfile(k8sversion string, filepath string, checksum string) error {
+	err := makeimagewritable(k8sversion)
+	if err != nil {
+		return err
+	}
+
 	kuttilog.Println(kuttilog.Info, "Checking image validity...")
 	filechecksum, err := workspace.ChecksumFile(filepath)
 	if err != nil {
@@ -100,6 +136,11 @@ func addfromfile(k8sversion string, filepath string, checksum string) error {
 }
 
 func removefile(k8sversion string) error {
+	err := makeimagewritable(k8sversion)
+	if err != nil {
+		return err
+	}
+
 	filename, err := imagepathfromk8sversion(k8sversion)
 	if err != nil {
 		return err
@@ -108,6 +149,121 @@ func removefile(k8sversion string) error {
 	return workspace.RemoveFile(filename)
 }
 
+// livechilddisks returns the child disks that still exist. A disk may
+// have been removed without the driver, for example by removing the
+// machine in Hyper-V Manager.
+func livechilddisks(childdisks []string) []string {
+	result := []string{}
+	for _, childdisk := range childdisks {
+		if _, err := os.Stat(childdisk); err == nil {
+			result = append(result, childdisk)
+		}
+	}
+
+	return result
+}
+
+// makeimagewritable checks that the cached image for a Kubernetes
+// version is not the parent of any differencing disks, and makes it
+// writable, so that it can be removed or replaced. If it is a parent,
+// an error wrapping ErrImageInUse is returned.
+func makeimagewritable(k8sversion string) error {
+	imagemutex.Lock()
+	defer imagemutex.Unlock()
+
+	err := imageconfigmanager.Load()
+	if err != nil {
+		return err
+	}
+
+	if img, ok := imagedata.images[k8sversion]; ok && len(img.imageChildDisks) > 0 {
+		img.imageChildDisks = livechilddisks(img.imageChildDisks)
+		if len(img.imageChildDisks) > 0 {
+			return fmt.Errorf(
+				"could not change image for K8s version %v: %w: %v",
+				k8sversion,
+				ErrImageInUse,
+				strings.Join(img.imageChildDisks, ", "),
+			)
+		}
+		imageconfigmanager.Save()
+	}
+
+	imagepath, err := imagepathfromk8sversion(k8sversion)
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(imagepath, 0644)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// addimagechild records that a disk is a differencing disk whose parent
+// is the cached image for a Kubernetes version, and makes the cached
+// image read-only. The image must be downloaded.
+func addimagechild(k8sversion string, childdisk string) error {
+	imagemutex.Lock()
+	defer imagemutex.Unlock()
+
+	err := imageconfigmanager.Load()
+	if err != nil {
+		return err
+	}
+
+	img, ok := imagedata.images[k8sversion]
+	if !ok || img.imageStatus != drivercore.ImageStatusDownloaded {
+		return fmt.Errorf("image for K8s version %v is not downloaded", k8sversion)
+	}
+
+	imagepath, err := imagepathfromk8sversion(k8sversion)
+	if err != nil {
+		return err
+	}
+
+	// Changes to the parent would corrupt the child disks
+	err = os.Chmod(imagepath, 0444)
+	if err != nil {
+		return err
+	}
+
+	img.imageChildDisks = append(img.imageChildDisks, childdisk)
+	return imageconfigmanager.Save()
+}
+
+// removeimagechild removes a disk from the child disks of any image.
+func removeimagechild(childdisk string) error {
+	imagemutex.Lock()
+	defer imagemutex.Unlock()
+
+	err := imageconfigmanager.Load()
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, img := range imagedata.images {
+		childdisks := []string{}
+		for _, existingdisk := range img.imageChildDisks {
+			if existingdisk == childdisk {
+				changed = true
+				continue
+			}
+			childdisks = append(childdisks, existingdisk)
+		}
+		img.imageChildDisks = childdisks
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return imageconfigmanager.Save()
+}
+
 func fetchimagelist() error {
 	// Download image list into temp directory
 	confdir, _ := hypervConfigDir()
@@ -116,9 +272,10 @@ func fetchimagelist() error {
 
 	kuttilog.Printf(kuttilog.Debug, "confdir: %v\ntempfilepath: %v\n", confdir, tempfilepath)
 
+	sourceurl := imagessourceurl()
 	kuttilog.Println(kuttilog.Info, "Fetching image list...")
-	kuttilog.Printf(kuttilog.Debug, "Fetching from %v into %v.", ImagesSourceURL, tempfilepath)
-	err := workspace.DownloadFile(ImagesSourceURL, tempfilepath)
+	kuttilog.Printf(kuttilog.Debug, "Fetching from %v into %v.", sourceurl, tempfilepath)
+	err := workspace.DownloadFile(sourceurl, tempfilepath)
 	kuttilog.Printf(kuttilog.Debug, "Error: %v", err)
 	if err != nil {
 		return err
@@ -137,6 +294,9 @@ func fetchimagelist() error {
 		return err
 	}
 
+	imagemutex.Lock()
+	defer imagemutex.Unlock()
+
 	// Compare against current and update
 	for key, newimage := range tempimagedata.images {
 		oldimage := imagedata.images[key]
@@ -147,6 +307,12 @@ func fetchimagelist() error {
 
 			newimage.imageStatus = drivercore.ImageStatusDownloaded
 		}
+
+		// The cached file is not changed by a new list, so any
+		// child disks still depend on it
+		if oldimage != nil {
+			newimage.imageChildDisks = oldimage.imageChildDisks
+		}
 	}
 
 	// Make it current
@@ -157,3 +323,77 @@ func fetchimagelist() error {
 
 	return nil
 }
+
+// setimagestatus sets the status of an image, and saves the image list.
+// The image may have been loaded before the list was last reloaded, so
+// the status of the image in the current list is set as well.
+func setimagestatus(i *Image, status drivercore.ImageStatus) error {
+	imagemutex.Lock()
+	defer imagemutex.Unlock()
+
+	i.imageStatus = status
+	if current, ok := imagedata.images[i.imageK8sVersion]; ok {
+		current.imageStatus = status
+	}
+
+	return imageconfigmanager.Save()
+}
+
+// progresswriter counts bytes written to it, and reports the count
+// through a callback.
+type progresswriter struct {
+	current  int64
+	total    int64
+	progress func(int64, int64)
+}
+
+func (pw *progresswriter) Write(p []byte) (int, error) {
+	pw.current += int64(len(p))
+	pw.progress(pw.current, pw.total)
+	return len(p), nil
+}
+
+// downloadfile downloads a file from url into destpath. The download
+// is aborted if the context is done. Progress is reported through the
+// progress callback, if it is not nil.
+func downloadfile(ctx context.Context, url string, destpath string, progress func(int64, int64)) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not download %v: %v", url, response.Status)
+	}
+
+	file, err := os.Create(destpath)
+	if err != nil {
+		return err
+	}
+
+	var source io.Reader = response.Body
+	if progress != nil {
+		source = io.TeeReader(
+			response.Body,
+			&progresswriter{total: response.ContentLength, progress: progress},
+		)
+	}
+
+	_, err = io.Copy(file, source)
+	closeerr := file.Close()
+	if err == nil {
+		err = closeerr
+	}
+	if err != nil {
+		os.Remove(destpath)
+		return err
+	}
+
+	return nil
+}
@@ -1,26 +1,36 @@
 package driverhyperv
 
 import (
+	"context"
+	"crypto/sha256"
 	_ "embed"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"time"
 
 	"github.com/kuttiproject/workspace"
 )
 
-type driverresult struct {
+// DriverResult is the result of running a command of the interface script.
+// The interface script returns it as a JSON document.
+type DriverResult struct {
 	Success      bool
 	ErrorMessage string
+	ErrorCode    string
 	Payload      map[string]interface{}
 }
 
-const scriptVersion = "0.2"
+// ScriptVersion is the version of the interface script protocol used by
+// this version of the driver. The interface script reports its version
+// in the payload of the "checkdriver" command, and the driver refuses
+// to work with a script that reports a different version. Custom
+// Executors should report this version.
+const ScriptVersion = "0.17"
 
-var scriptname = "hypervmanage-" + scriptVersion + ".ps1"
+var scriptname = "hypervmanage-" + ScriptVersion + ".ps1"
 
 func findPowerShell() (string, error) {
 	// First, try looking up Windows PowerShell on the path
@@ -35,28 +45,82 @@ func findPowerShell() (string, error) {
 		return toolpath, nil
 	}
 
+	// Finally, look for cross-platform PowerShell on other
+	// operating systems
+	toolpath, err = exec.LookPath("pwsh")
+	if err == nil {
+		return toolpath, nil
+	}
+
 	return "", errors.New("PowerShell not found")
 }
 
-func machineDir() (string, error) {
-	return workspace.CacheSubDir("driver-hyperv-machines")
+// storageSubDir returns a directory for driver files that the Hyper-V host
+// needs to access, as seen by the driver. For a remote host, this is under
+// the local storage path of the host. Otherwise, it is under the storage
+// directory if one has been set, or in the workspace cache.
+func (vd *Driver) storageSubDir(name string) (string, error) {
+	if vd.remote != nil {
+		return remotestoragesubdir(vd.remote, name)
+	}
+
+	if storagedir := vd.StorageDir(); storagedir != "" {
+		result := filepath.Join(storagedir, name)
+		err := os.MkdirAll(result, 0755)
+		if err != nil {
+			return "", err
+		}
+		return result, nil
+	}
+
+	return workspace.CacheSubDir(name)
+}
+
+func (vd *Driver) machineDir() (string, error) {
+	return vd.storageSubDir("driver-hyperv-machines")
 }
 
-func diskDir() (string, error) {
-	return workspace.CacheSubDir("driver-hyperv-disks")
+func (vd *Driver) diskDir() (string, error) {
+	return vd.storageSubDir("driver-hyperv-disks")
 }
 
-func findScript() (string, error) {
-	scriptdir, err := hypervCacheDir()
+func (vd *Driver) scriptDir() (string, error) {
+	if vd.remote != nil || vd.StorageDir() != "" {
+		return vd.storageSubDir("driver-hyperv")
+	}
+
+	return hypervCacheDir()
+}
+
+// hostpath converts a path as seen by the driver into the same path as
+// seen by the Hyper-V host. Paths passed to the interface script, and
+// the path of the script itself, should be converted using this.
+func (vd *Driver) hostpath(localpath string) (string, error) {
+	if vd.remote != nil {
+		return remotehostpath(vd.remote, localpath)
+	}
+
+	if runningInWSL() {
+		return WSLToWindowsPath(localpath, "")
+	}
+
+	return localpath, nil
+}
+
+// findScript returns the path of the cached copy of the interface script.
+// The cached copy is compared with the embedded script, and rewritten if
+// it is missing or different.
+func (vd *Driver) findScript() (string, error) {
+	scriptdir, err := vd.scriptDir()
 	if err != nil {
 		return "", fmt.Errorf("could not find script: %v", err.Error())
 	}
 
 	scriptpath := filepath.Join(scriptdir, scriptname)
-	if _, err := os.Stat(scriptpath); err != nil {
+	if !scriptIsCurrent(scriptpath) {
 		err = writeScript(scriptpath)
 		if err != nil {
-			return "", err
+			return "", fmt.Errorf("could not write script: %v", err)
 		}
 	}
 
@@ -66,44 +130,113 @@ func findScript() (string, error) {
 //go:embed assets/hypervmanage.ps1
 var script string
 
+func scriptHash() [sha256.Size]byte {
+	return sha256.Sum256([]byte(script))
+}
+
+func scriptIsCurrent(scriptpath string) bool {
+	data, err := os.ReadFile(scriptpath)
+	if err != nil {
+		return false
+	}
+
+	return sha256.Sum256(data) == scriptHash()
+}
+
+// writeScript writes the embedded script to a temporary file in the
+// same directory as scriptpath, and then renames it to scriptpath.
+// This ensures that a partially written script is never used.
 func writeScript(scriptpath string) error {
-	scriptFile, err := os.Create(scriptpath)
+	scriptFile, err := os.CreateTemp(filepath.Dir(scriptpath), scriptname+".*.tmp")
 	if err != nil {
 		return err
 	}
-
-	defer scriptFile.Close()
+	tempfilepath := scriptFile.Name()
 
 	_, err = scriptFile.WriteString(script)
 	if err != nil {
+		scriptFile.Close()
+		os.Remove(tempfilepath)
+		return err
+	}
+
+	err = scriptFile.Close()
+	if err != nil {
+		os.Remove(tempfilepath)
+		return err
+	}
+
+	err = os.Rename(tempfilepath, scriptpath)
+	if err != nil {
+		os.Remove(tempfilepath)
 		return err
 	}
 
 	return nil
 }
 
-func (vd *Driver) runwithresults(args ...string) (*driverresult, error) {
-	// if !vd.validate() {
-	// 	return nil, vd
-	// }
+// scriptparams holds the parameters of an interface script command.
+type scriptparams = map[string]interface{}
+
+func (vd *Driver) runwithresults(ctx context.Context, command string, params scriptparams) (*DriverResult, error) {
+	vd.mutex.Lock()
+	executor := vd.executor
+	tracer := vd.tracer
+	vd.mutex.Unlock()
 
-	powershellargs := []string{
-		"-NoProfile",
-		"-NonInteractive",
-		"-File",
-		vd.scriptpath,
+	if executor == nil {
+		return nil, errors.New("driver not initialized")
 	}
-	powershellargs = append(powershellargs, args...)
-	resultstring, err := workspace.RunWithResults(vd.powershellpath, powershellargs...)
-	if err != nil {
-		return nil, err
+
+	if params == nil {
+		params = scriptparams{}
+	}
+
+	request := &ScriptRequest{
+		Command:    command,
+		Parameters: params,
+	}
+
+	if tracer == nil {
+		return executor.Execute(ctx, request)
 	}
 
-	dr := &driverresult{}
-	err = json.Unmarshal([]byte(resultstring), dr)
+	return tracedexecute(ctx, executor, tracer, request)
+}
+
+// tracedexecute runs a request, and records it in the trace. The raw
+// output of the script is recorded if the executor makes it available.
+func tracedexecute(ctx context.Context, executor Executor, tracer *tracer, request *ScriptRequest) (*DriverResult, error) {
+	var (
+		stdout, stderr string
+		result         *DriverResult
+		err            error
+	)
+
+	starttime := time.Now()
+	if rawexecutor, ok := executor.(rawexecutor); ok {
+		stdout, stderr, err = rawexecutor.executeraw(ctx, request)
+		if err == nil {
+			result, err = parseresult(stdout)
+		}
+	} else {
+		result, err = executor.Execute(ctx, request)
+	}
+
+	tracer.record(&TraceRecord{
+		Time:                 starttime,
+		Kind:                 TraceKindScript,
+		DurationMilliseconds: time.Since(starttime).Milliseconds(),
+		Request:              request,
+		Stdout:               stdout,
+		Stderr:               stderr,
+		Result:               result,
+		Error:                errorstring(err),
+	})
+
 	if err != nil {
 		return nil, err
 	}
 
-	return dr, nil
+	return result, nil
 }
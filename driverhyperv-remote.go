@@ -0,0 +1,165 @@
+package driverhyperv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RemoteHost describes a Hyper-V host that is managed remotely, using
+// WinRM. The user specified by Username must be an administrator or a
+// member of the Hyper-V Administrators group on the remote host, and
+// WinRM must accept basic authentication.
+//
+// The driver keeps the interface script, VM disks and VM files in a
+// storage directory on the remote host. The same directory must be
+// accessible from the machine running the driver, typically through
+// an SMB share, so that the driver can copy VHDX images to it.
+type RemoteHost struct {
+	// Endpoint is the URL of the WinRM service on the remote host.
+	// For example, https://hvserver:5986/wsman.
+	Endpoint string
+	// Username and Password are the credentials used for WinRM.
+	Username string
+	Password string
+	// Insecure turns off TLS certificate verification for an
+	// HTTPS endpoint.
+	Insecure bool
+	// StoragePath is the storage directory, as seen by the remote
+	// host. For example, D:\kutti.
+	StoragePath string
+	// LocalStoragePath is the storage directory, as seen by the
+	// machine running the driver. For example, \\hvserver\kutti.
+	LocalStoragePath string
+}
+
+// NewRemoteDriver returns a Hyper-V driver which manages the specified
+// remote host. The driver is not registered with drivercore. Callers can
+// register it under a name of their choice.
+func NewRemoteDriver(host RemoteHost) (*Driver, error) {
+	if host.Endpoint == "" {
+		return nil, errors.New("remote host endpoint not specified")
+	}
+
+	if host.StoragePath == "" || host.LocalStoragePath == "" {
+		return nil, errors.New("remote host storage paths not specified")
+	}
+
+	return &Driver{
+		remote: &host,
+	}, nil
+}
+
+// Remote returns the remote host managed by the driver, or nil if the
+// driver manages Hyper-V on the local machine.
+func (vd *Driver) Remote() *RemoteHost {
+	if vd.remote == nil {
+		return nil
+	}
+
+	result := *vd.remote
+	return &result
+}
+
+// winrmexecutor runs the interface script on a remote host via WinRM.
+type winrmexecutor struct {
+	client     *winrmclient
+	scriptpath string
+}
+
+func (we *winrmexecutor) Execute(ctx context.Context, request *ScriptRequest) (*DriverResult, error) {
+	stdout, _, err := we.executeraw(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseresult(stdout)
+}
+
+func (we *winrmexecutor) executeraw(ctx context.Context, request *ScriptRequest) (string, string, error) {
+	encodedrequest, err := request.encode()
+	if err != nil {
+		return "", "", err
+	}
+
+	powershellargs := []string{
+		"-NoProfile",
+		"-NonInteractive",
+		"-ExecutionPolicy",
+		"Bypass",
+		"-File",
+		windowsquote(we.scriptpath),
+		encodedrequest,
+	}
+
+	stdout, stderr, exitcode, err := we.client.run(ctx, "powershell.exe", powershellargs...)
+	if err != nil {
+		return stdout, stderr, err
+	}
+
+	if exitcode != 0 && strings.TrimSpace(stdout) == "" {
+		return stdout, stderr, fmt.Errorf("could not run interface script on remote host: exit code %v: %s", exitcode, stderr)
+	}
+
+	return stdout, stderr, nil
+}
+
+// windowsquote quotes an argument according to the rules used by
+// Windows programs to parse their command lines.
+func windowsquote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"") {
+		return arg
+	}
+
+	var result strings.Builder
+	result.WriteByte('"')
+	backslashes := 0
+	for _, c := range arg {
+		switch c {
+		case '\\':
+			backslashes++
+			continue
+		case '"':
+			// Backslashes before a quote, and the quote itself, are escaped
+			result.WriteString(strings.Repeat(`\`, backslashes*2+1))
+		default:
+			result.WriteString(strings.Repeat(`\`, backslashes))
+		}
+		backslashes = 0
+		result.WriteRune(c)
+	}
+	// Backslashes before the closing quote are escaped
+	result.WriteString(strings.Repeat(`\`, backslashes*2))
+	result.WriteByte('"')
+
+	return result.String()
+}
+
+// remotehostpath converts a path under the local storage path of a remote
+// host into the corresponding path under its storage path.
+func remotehostpath(host *RemoteHost, localpath string) (string, error) {
+	relpath, err := filepath.Rel(host.LocalStoragePath, localpath)
+	if err != nil || relpath == ".." || strings.HasPrefix(relpath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path '%v' is not in the remote storage directory", localpath)
+	}
+
+	result := strings.TrimRight(host.StoragePath, `\`)
+	if relpath != "." {
+		result += `\` + strings.ReplaceAll(filepath.ToSlash(relpath), "/", `\`)
+	}
+
+	return result, nil
+}
+
+func remotestoragesubdir(host *RemoteHost, name string) (string, error) {
+	result := filepath.Join(host.LocalStoragePath, name)
+	err := os.MkdirAll(result, 0755)
+	if err != nil {
+		return "", fmt.Errorf("could not access remote storage directory: %v", err)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,302 @@
+package driverhyperv
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionwaitdelay is how long a session waits for the standard error of
+// its process to be closed, after the process has exited.
+const sessionwaitdelay = 2 * time.Second
+
+type sessionrequest struct {
+	Id      uint64
+	Request *ScriptRequest
+}
+
+type sessionresponse struct {
+	Id     uint64
+	Result json.RawMessage
+}
+
+// sessionexecutor runs the interface script in a single, long-lived
+// PowerShell process. Requests are written to the standard input of
+// the process as JSON documents, one per line. Responses are read from
+// its standard output in the same way, and matched with requests by Id.
+// If the process exits, it is started again for the next request.
+// What the process writes to its standard error is kept, and included
+// in the error returned when the process ends unexpectedly.
+type sessionexecutor struct {
+	mutex          sync.Mutex
+	powershellpath string
+	scriptpath     string
+	lastid         uint64
+	cmd            *exec.Cmd
+	stdin          io.WriteCloser
+	stdout         *bufio.Reader
+	stdoutpipe     *os.File
+	stderr         *sessionstderr
+	exited         chan struct{}
+}
+
+// sessionstderrlimit is the number of bytes of the standard error of a
+// session that are kept.
+const sessionstderrlimit = 8192
+
+// sessionstderr keeps the last part of the standard error of a session.
+type sessionstderr struct {
+	mutex sync.Mutex
+	data  []byte
+}
+
+func (ss *sessionstderr) Write(p []byte) (int, error) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	ss.data = append(ss.data, p...)
+	if len(ss.data) > sessionstderrlimit {
+		ss.data = ss.data[len(ss.data)-sessionstderrlimit:]
+	}
+
+	return len(p), nil
+}
+
+func (ss *sessionstderr) String() string {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	return string(ss.data)
+}
+
+func (se *sessionexecutor) start() error {
+	stdoutreader, stdoutwriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(
+		se.powershellpath,
+		"-NoProfile",
+		"-NonInteractive",
+		"-File",
+		se.scriptpath,
+		"session",
+	)
+	cmd.Stdout = stdoutwriter
+	stderr := &sessionstderr{}
+	cmd.Stderr = stderr
+	// Do not wait forever for the standard error to be closed, in case
+	// the process has left a child behind that holds it open
+	cmd.WaitDelay = sessionwaitdelay
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		stdoutreader.Close()
+		stdoutwriter.Close()
+		return err
+	}
+
+	err = cmd.Start()
+	// The child process has its own copy of the write end now
+	stdoutwriter.Close()
+	if err != nil {
+		stdoutreader.Close()
+		return fmt.Errorf("could not start PowerShell session: %v", err)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	se.cmd = cmd
+	se.stdin = stdin
+	se.stdoutpipe = stdoutreader
+	se.stdout = bufio.NewReader(stdoutreader)
+	se.stderr = stderr
+	se.exited = exited
+
+	return nil
+}
+
+func (se *sessionexecutor) running() bool {
+	if se.cmd == nil {
+		return false
+	}
+
+	select {
+	case <-se.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// stop ends the session, if it is running, and returns what the process
+// wrote to its standard error.
+func (se *sessionexecutor) stop() string {
+	if se.cmd == nil {
+		return ""
+	}
+
+	se.stdin.Close()
+	se.cmd.Process.Kill()
+	<-se.exited
+	se.stdoutpipe.Close()
+	stderr := se.stderr.String()
+
+	se.cmd = nil
+	se.stdin = nil
+	se.stdout = nil
+	se.stdoutpipe = nil
+	se.stderr = nil
+	se.exited = nil
+
+	return stderr
+}
+
+// send writes a request to the session, starting the session
+// first if it is not running.
+func (se *sessionexecutor) send(request []byte) error {
+	if !se.running() {
+		se.stop()
+		err := se.start()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := se.stdin.Write(request)
+	if err != nil {
+		se.stop()
+	}
+
+	return err
+}
+
+func (se *sessionexecutor) Execute(ctx context.Context, request *ScriptRequest) (*DriverResult, error) {
+	stdout, _, err := se.executeraw(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseresult(stdout)
+}
+
+// executeraw returns the result part of the session response as the
+// standard output, and any stray output read before the response as
+// the standard error.
+func (se *sessionexecutor) executeraw(ctx context.Context, request *ScriptRequest) (string, string, error) {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+
+	if ctx.Err() != nil {
+		return "", "", ctx.Err()
+	}
+
+	se.lastid++
+	sessionrequest := sessionrequest{
+		Id:      se.lastid,
+		Request: request,
+	}
+	requestdata, err := json.Marshal(sessionrequest)
+	if err != nil {
+		return "", "", err
+	}
+	requestdata = append(requestdata, '\n')
+
+	// A request that could not be written was never seen by the
+	// session, so it is safe to try once more with a new session.
+	err = se.send(requestdata)
+	if err != nil {
+		err = se.send(requestdata)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("could not send request to PowerShell session: %v", err)
+	}
+
+	responsechan := make(chan sessionoutcome, 1)
+	go se.receive(sessionrequest.Id, responsechan)
+
+	select {
+	case outcome := <-responsechan:
+		if outcome.err != nil {
+			stderr := strings.TrimSpace(se.stop())
+			if stderr != "" {
+				outcome.err = fmt.Errorf("%w: %s", outcome.err, stderr)
+			}
+		}
+		return outcome.output, outcome.strayoutput, outcome.err
+	case <-ctx.Done():
+		// The only way to abandon a running command is to end the
+		// session. A new one will be started for the next request.
+		se.stop()
+		outcome := <-responsechan
+		return "", outcome.strayoutput, ctx.Err()
+	}
+}
+
+type sessionoutcome struct {
+	output      string
+	strayoutput string
+	err         error
+}
+
+// receive reads responses from the session until it finds the one
+// with the specified id, and sends it on responsechan.
+func (se *sessionexecutor) receive(id uint64, responsechan chan<- sessionoutcome) {
+	stdout := se.stdout
+	var strayoutput strings.Builder
+	for {
+		line, err := stdout.ReadBytes('\n')
+		if err != nil {
+			responsechan <- sessionoutcome{
+				strayoutput: strayoutput.String(),
+				err:         fmt.Errorf("PowerShell session ended unexpectedly: %v", err),
+			}
+			return
+		}
+
+		// Anything that is not a response to this request is stray
+		// output, and is ignored.
+		response := &sessionresponse{}
+		err = json.Unmarshal(line, response)
+		if err != nil || response.Id != id {
+			strayoutput.Write(line)
+			continue
+		}
+
+		if len(response.Result) == 0 || string(response.Result) == "null" {
+			responsechan <- sessionoutcome{
+				strayoutput: strayoutput.String(),
+				err:         errors.New("PowerShell session returned an empty result"),
+			}
+			return
+		}
+
+		responsechan <- sessionoutcome{
+			output:      string(response.Result),
+			strayoutput: strayoutput.String(),
+		}
+		return
+	}
+}
+
+// Close ends the PowerShell session, if it is running.
+func (se *sessionexecutor) Close() error {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+
+	se.stop()
+	return nil
+}
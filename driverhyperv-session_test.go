@@ -0,0 +1,195 @@
+package driverhyperv_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	driverhyperv "github.com/kuttiproject/driver-hyperv"
+)
+
+// fakesessionenv is set in the environment of the test binary when it is
+// started as a stand-in for a PowerShell session.
+const fakesessionenv = "DRIVERHYPERV_FAKE_SESSION"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakesessionenv) != "" {
+		runfakesession()
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+// runfakesession serves session requests on the standard input and
+// output, the way the interface script does in session mode. What it
+// does with a request depends on the command:
+//
+//	hang          never responds
+//	die           writes to the standard error and exits
+//	outoforder    responds to other requests first, and writes stray output
+//	answerandexit closes the standard input, responds and exits
+//
+// Any other command gets a response whose payload holds the command
+// and the process ID of the session.
+func runfakesession() {
+	input := bufio.NewReader(os.Stdin)
+	for {
+		line, err := input.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+
+		var request struct {
+			Id      uint64
+			Request driverhyperv.ScriptRequest
+		}
+		err = json.Unmarshal(line, &request)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fake session: invalid request: %v\n", err)
+			os.Exit(2)
+		}
+
+		command := request.Request.Command
+		switch command {
+		case "hang":
+			time.Sleep(time.Hour)
+		case "die":
+			fmt.Fprintln(os.Stderr, "fake session: fatal error")
+			os.Exit(3)
+		case "outoforder":
+			fmt.Println("WARNING: stray output")
+			writefakeresponse(request.Id-1, "stale")
+			writefakeresponse(request.Id+1, "early")
+			writefakeresponse(request.Id, command)
+		case "answerandexit":
+			os.Stdin.Close()
+			writefakeresponse(request.Id, command)
+			return
+		default:
+			writefakeresponse(request.Id, command)
+		}
+	}
+}
+
+func writefakeresponse(id uint64, command string) {
+	response := map[string]interface{}{
+		"Id": id,
+		"Result": driverhyperv.DriverResult{
+			Success: true,
+			Payload: map[string]interface{}{
+				"Command": command,
+				"PID":     os.Getpid(),
+			},
+		},
+	}
+
+	data, _ := json.Marshal(response)
+	fmt.Println(string(data))
+}
+
+// newfakesession returns a session executor that runs the test binary as
+// a stand-in for PowerShell.
+func newfakesession(t *testing.T) driverhyperv.Executor {
+	t.Setenv(fakesessionenv, "1")
+
+	executor := driverhyperv.NewSessionExecutor(os.Args[0], "hypervmanage.ps1")
+	t.Cleanup(func() {
+		executor.(io.Closer).Close()
+	})
+
+	return executor
+}
+
+// runfakecommand runs a command in a fake session, and returns the process
+// ID of the session that responded.
+func runfakecommand(t *testing.T, executor driverhyperv.Executor, command string) float64 {
+	t.Helper()
+
+	result, err := executor.Execute(
+		context.Background(),
+		&driverhyperv.ScriptRequest{Command: command},
+	)
+	if err != nil {
+		t.Fatalf("Error running %v: %v", command, err)
+	}
+	if result.Payload["Command"] != command {
+		t.Fatalf("Expected response to %v, got response to %v", command, result.Payload["Command"])
+	}
+
+	pid, _ := result.Payload["PID"].(float64)
+	return pid
+}
+
+func TestSessionResponseMatching(t *testing.T) {
+	executor := newfakesession(t)
+
+	pid := runfakecommand(t, executor, "first")
+	if runfakecommand(t, executor, "outoforder") != pid {
+		t.Errorf("Expected the session to keep running")
+	}
+
+	// The responses that did not match were skipped, not left to be
+	// read as the response to the next request
+	if runfakecommand(t, executor, "last") != pid {
+		t.Errorf("Expected the session to keep running")
+	}
+}
+
+func TestSessionRestart(t *testing.T) {
+	executor := newfakesession(t)
+
+	// The session stops reading requests, so the next request cannot
+	// be written, and is sent again to a new session
+	pid := runfakecommand(t, executor, "answerandexit")
+	newpid := runfakecommand(t, executor, "second")
+	if newpid == pid {
+		t.Errorf("Expected a new session after the session exited")
+	}
+
+	// The session dies while running a request
+	_, err := executor.Execute(
+		context.Background(),
+		&driverhyperv.ScriptRequest{Command: "die"},
+	)
+	if err == nil {
+		t.Fatalf("Expected error when the session dies")
+	}
+	if !strings.Contains(err.Error(), "fake session: fatal error") {
+		t.Errorf("Expected the standard error of the session in the error, got %v", err)
+	}
+
+	if runfakecommand(t, executor, "third") == newpid {
+		t.Errorf("Expected a new session after the session died")
+	}
+}
+
+func TestSessionCancel(t *testing.T) {
+	executor := newfakesession(t)
+
+	pid := runfakecommand(t, executor, "first")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := executor.Execute(ctx, &driverhyperv.ScriptRequest{Command: "hang"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the request to be abandoned at the deadline, took %v", elapsed)
+	}
+
+	// The hung session was ended, and a new one serves the next request
+	if runfakecommand(t, executor, "second") == pid {
+		t.Errorf("Expected a new session after cancellation")
+	}
+}
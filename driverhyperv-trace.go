@@ -0,0 +1,249 @@
+package driverhyperv
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// The kinds of interaction recorded in a trace.
+const (
+	TraceKindScript = "script"
+	TraceKindSSH    = "ssh"
+)
+
+// TraceRecord records a single interaction of the driver with Hyper-V,
+// or with a machine over SSH. A trace file contains one JSON-encoded
+// TraceRecord per line.
+type TraceRecord struct {
+	// Time is when the interaction started.
+	Time time.Time
+	// Kind is TraceKindScript or TraceKindSSH.
+	Kind string
+	// DurationMilliseconds is how long the interaction took.
+	DurationMilliseconds int64
+	// Request is the interface script request, for script interactions.
+	Request *ScriptRequest `json:",omitempty"`
+	// Address and Command are the machine address and command, for
+	// SSH interactions.
+	Address string `json:",omitempty"`
+	Command string `json:",omitempty"`
+	// Stdout and Stderr are the raw output of the interaction, where
+	// available.
+	Stdout string `json:",omitempty"`
+	Stderr string `json:",omitempty"`
+	// Result is the parsed result, for script interactions.
+	Result *DriverResult `json:",omitempty"`
+	// Error is the error returned by the interaction, if any.
+	Error string `json:",omitempty"`
+}
+
+// tracer writes trace records to a file.
+type tracer struct {
+	mutex   sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func newtracer(tracefilepath string) (*tracer, error) {
+	file, err := os.OpenFile(tracefilepath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open trace file: %v", err)
+	}
+
+	return &tracer{
+		file:    file,
+		encoder: json.NewEncoder(file),
+	}, nil
+}
+
+func (t *tracer) record(record *TraceRecord) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Tracing should never cause an operation to fail, so
+	// errors are ignored.
+	t.encoder.Encode(record)
+}
+
+func (t *tracer) close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.file.Close()
+}
+
+func errorstring(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	return err.Error()
+}
+
+// EnableTrace starts recording every interface script request and every
+// SSH command run by the driver, with their raw output, results and
+// timings, to the specified file. Records are appended to the file if it
+// already exists. The recorded file can be replayed using a ReplayExecutor.
+func (vd *Driver) EnableTrace(tracefilepath string) error {
+	newtracer, err := newtracer(tracefilepath)
+	if err != nil {
+		return err
+	}
+
+	vd.mutex.Lock()
+	oldtracer := vd.tracer
+	vd.tracer = newtracer
+	vd.mutex.Unlock()
+
+	if oldtracer != nil {
+		oldtracer.close()
+	}
+
+	return nil
+}
+
+// DisableTrace stops recording interactions, and closes the trace file.
+func (vd *Driver) DisableTrace() error {
+	vd.mutex.Lock()
+	oldtracer := vd.tracer
+	vd.tracer = nil
+	vd.mutex.Unlock()
+
+	if oldtracer == nil {
+		return nil
+	}
+
+	return oldtracer.close()
+}
+
+// currenttracer returns the tracer in use, or nil.
+func (vd *Driver) currenttracer() *tracer {
+	vd.mutex.Lock()
+	defer vd.mutex.Unlock()
+
+	return vd.tracer
+}
+
+// ReplayExecutor is an Executor that replays interactions recorded in a
+// trace file, instead of running the interface script. It also implements
+// SSHExecutor, and replays recorded SSH commands. Requests must arrive in
+// the same order in which they were recorded. A ReplayExecutor can be used
+// to reproduce a problem from a recorded trace, on any operating system.
+type ReplayExecutor struct {
+	mutex         sync.Mutex
+	scriptrecords []TraceRecord
+	sshrecords    []TraceRecord
+}
+
+// NewReplayExecutor reads the specified trace file, and returns a
+// ReplayExecutor that replays it.
+func NewReplayExecutor(tracefilepath string) (*ReplayExecutor, error) {
+	file, err := os.Open(tracefilepath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open trace file: %v", err)
+	}
+	defer file.Close()
+
+	result := &ReplayExecutor{}
+	scanner := bufio.NewScanner(file)
+	// Raw output can make for long lines
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	linenumber := 0
+	for scanner.Scan() {
+		linenumber++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var record TraceRecord
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trace record at line %v: %v", linenumber, err)
+		}
+
+		switch record.Kind {
+		case TraceKindScript:
+			result.scriptrecords = append(result.scriptrecords, record)
+		case TraceKindSSH:
+			result.sshrecords = append(result.sshrecords, record)
+		default:
+			return nil, fmt.Errorf("invalid trace record kind '%v' at line %v", record.Kind, linenumber)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read trace file: %v", err)
+	}
+
+	return result, nil
+}
+
+// Execute returns the next recorded interface script result. It returns
+// an error if the request's command does not match the recorded one, or
+// if there are no more recorded results.
+func (re *ReplayExecutor) Execute(ctx context.Context, request *ScriptRequest) (*DriverResult, error) {
+	re.mutex.Lock()
+	defer re.mutex.Unlock()
+
+	if len(re.scriptrecords) == 0 {
+		return nil, fmt.Errorf("replay: no recorded result for command '%v'", request.Command)
+	}
+
+	record := re.scriptrecords[0]
+	if record.Request == nil || record.Request.Command != request.Command {
+		expected := ""
+		if record.Request != nil {
+			expected = record.Request.Command
+		}
+		return nil, fmt.Errorf("replay: expected command '%v', got '%v'", expected, request.Command)
+	}
+	re.scriptrecords = re.scriptrecords[1:]
+
+	if record.Error != "" {
+		return nil, errors.New(record.Error)
+	}
+
+	if record.Result == nil {
+		return nil, fmt.Errorf("replay: no recorded result for command '%v'", request.Command)
+	}
+
+	return record.Result, nil
+}
+
+// ExecuteSSH returns the next recorded SSH command output. It returns an
+// error if the command does not match the recorded one, or if there are
+// no more recorded commands.
+func (re *ReplayExecutor) ExecuteSSH(ctx context.Context, address string, command string) (string, error) {
+	re.mutex.Lock()
+	defer re.mutex.Unlock()
+
+	if len(re.sshrecords) == 0 {
+		return "", fmt.Errorf("replay: no recorded output for SSH command '%v'", command)
+	}
+
+	record := re.sshrecords[0]
+	if record.Command != command {
+		return "", fmt.Errorf("replay: expected SSH command '%v', got '%v'", record.Command, command)
+	}
+	re.sshrecords = re.sshrecords[1:]
+
+	if record.Error != "" {
+		return record.Stdout, errors.New(record.Error)
+	}
+
+	return record.Stdout, nil
+}
+
+// Remaining returns the number of recorded interface script requests and
+// SSH commands that have not been replayed yet.
+func (re *ReplayExecutor) Remaining() (int, int) {
+	re.mutex.Lock()
+	defer re.mutex.Unlock()
+
+	return len(re.scriptrecords), len(re.sshrecords)
+}
@@ -0,0 +1,128 @@
+package driverhyperv_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	driverhyperv "github.com/kuttiproject/driver-hyperv"
+	"github.com/kuttiproject/drivercore"
+	"github.com/kuttiproject/workspace"
+)
+
+// sshfakeexecutor adds SSH commands to fakeexecutor.
+type sshfakeexecutor struct {
+	*fakeexecutor
+	sshmutex sync.Mutex
+	commands []string
+}
+
+func (sfe *sshfakeexecutor) ExecuteSSH(ctx context.Context, address string, command string) (string, error) {
+	sfe.sshmutex.Lock()
+	defer sfe.sshmutex.Unlock()
+
+	sfe.commands = append(sfe.commands, command)
+	// The file system growth script reports the file system size
+	if strings.Contains(command, "df -B1") {
+		return "21474836480\n", nil
+	}
+	return "ok", nil
+}
+
+// traceoperations performs a fixed sequence of driver operations.
+func traceoperations(t *testing.T, driver *driverhyperv.Driver) {
+	if driver.Status() != "Ready" {
+		t.Fatalf("Expected driver status Ready, got %v: %v", driver.Status(), driver.Error())
+	}
+
+	machine, err := driver.GetMachine("node1", "test")
+	if err != nil {
+		t.Fatalf("Error getting machine: %v", err)
+	}
+
+	err = machine.Start()
+	if err != nil {
+		t.Fatalf("Error starting machine: %v", err)
+	}
+	machine.WaitForStateChange(25)
+	if machine.Status() != drivercore.MachineStatusRunning {
+		t.Errorf("Expected status %v, got %v", drivercore.MachineStatusRunning, machine.Status())
+	}
+
+	err = machine.ExecuteCommand(drivercore.RenameMachine, "node1")
+	if err != nil {
+		t.Errorf("Error renaming machine: %v", err)
+	}
+
+	_, err = driver.GetMachine("node2", "test")
+	if !errors.Is(err, driverhyperv.ErrMachineNotFound) {
+		t.Errorf("Expected ErrMachineNotFound getting nonexistent machine, got %v", err)
+	}
+}
+
+func TestTraceRecordAndReplay(t *testing.T) {
+	err := workspace.Set(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error setting workspace: %v", err)
+	}
+	tracefile := filepath.Join(t.TempDir(), "trace.jsonl")
+
+	fe := &sshfakeexecutor{fakeexecutor: newfakeexecutor()}
+	driver := driverhyperv.NewDriverWithExecutor(fe)
+	fe.machines[driver.QualifiedMachineName("node1", "test")] = "Off"
+
+	err = driver.EnableTrace(tracefile)
+	if err != nil {
+		t.Fatalf("Error enabling trace: %v", err)
+	}
+	traceoperations(t, driver)
+	err = driver.Close()
+	if err != nil {
+		t.Fatalf("Error closing driver: %v", err)
+	}
+
+	if len(fe.commands) != 1 {
+		t.Fatalf("Expected 1 SSH command, got %v", len(fe.commands))
+	}
+
+	replay, err := driverhyperv.NewReplayExecutor(tracefile)
+	if err != nil {
+		t.Fatalf("Error loading trace: %v", err)
+	}
+	scriptcount, sshcount := replay.Remaining()
+	if scriptcount == 0 || sshcount != 1 {
+		t.Fatalf("Expected script records and 1 SSH record, got %v and %v", scriptcount, sshcount)
+	}
+
+	traceoperations(t, driverhyperv.NewDriverWithExecutor(replay))
+
+	scriptcount, sshcount = replay.Remaining()
+	if scriptcount != 0 || sshcount != 0 {
+		t.Errorf("Expected all records to be replayed, %v script and %v SSH records left", scriptcount, sshcount)
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	tracefile := filepath.Join(t.TempDir(), "trace.jsonl")
+
+	driver := driverhyperv.NewDriverWithExecutor(newfakeexecutor())
+	err := driver.EnableTrace(tracefile)
+	if err != nil {
+		t.Fatalf("Error enabling trace: %v", err)
+	}
+	driver.Status()
+	driver.Close()
+
+	replay, err := driverhyperv.NewReplayExecutor(tracefile)
+	if err != nil {
+		t.Fatalf("Error loading trace: %v", err)
+	}
+
+	_, err = replay.Execute(context.Background(), &driverhyperv.ScriptRequest{Command: "getmachine"})
+	if err == nil {
+		t.Errorf("Expected error replaying a different command")
+	}
+}
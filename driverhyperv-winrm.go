@@ -0,0 +1,340 @@
+package driverhyperv
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// WS-Management actions and URIs used by the WinRM remote shell protocol.
+const (
+	wsmanActionCreate    = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Create"
+	wsmanActionDelete    = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Delete"
+	wsmanActionCommand   = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Command"
+	wsmanActionReceive   = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Receive"
+	wsmanActionSignal    = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Signal"
+	wsmanResourceCmd     = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/cmd"
+	wsmanCommandDone     = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/CommandState/Done"
+	wsmanSignalTerminate = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/signal/terminate"
+
+	// The fault code returned when a Receive times out without output.
+	// The Receive should simply be repeated.
+	wsmanReceiveTimeoutCode = "2150858793"
+)
+
+// winrmclient runs commands on a remote Windows host, using the WinRM
+// remote shell protocol over HTTP or HTTPS with basic authentication.
+type winrmclient struct {
+	endpoint   string
+	username   string
+	password   string
+	httpclient *http.Client
+}
+
+func newwinrmclient(endpoint string, username string, password string, insecure bool) *winrmclient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return &winrmclient{
+		endpoint: endpoint,
+		username: username,
+		password: password,
+		httpclient: &http.Client{
+			Transport: transport,
+		},
+	}
+}
+
+type wsmanselector struct {
+	Name  string `xml:"Name,attr"`
+	Value string `xml:",chardata"`
+}
+
+type wsmanstream struct {
+	Name string `xml:"Name,attr"`
+	Data string `xml:",chardata"`
+}
+
+type wsmanresponse struct {
+	Body struct {
+		Fault *struct {
+			Reason string `xml:"Reason>Text"`
+			Detail struct {
+				Code    string `xml:"Code,attr"`
+				Message string `xml:"Message"`
+			} `xml:"Detail>WSManFault"`
+		} `xml:"Fault"`
+		ShellID         string          `xml:"Shell>ShellId"`
+		CreatedSelector []wsmanselector `xml:"ResourceCreated>ReferenceParameters>SelectorSet>Selector"`
+		CommandID       string          `xml:"CommandResponse>CommandId"`
+		Streams         []wsmanstream   `xml:"ReceiveResponse>Stream"`
+		CommandState    struct {
+			State    string `xml:"State,attr"`
+			ExitCode int    `xml:"ExitCode"`
+		} `xml:"ReceiveResponse>CommandState"`
+	} `xml:"Body"`
+}
+
+// wsmanfault is returned when the remote host responds with a SOAP fault.
+type wsmanfault struct {
+	code    string
+	message string
+}
+
+func (wf *wsmanfault) Error() string {
+	return fmt.Sprintf("WinRM fault %v: %v", wf.code, wf.message)
+}
+
+func xmlescape(s string) string {
+	var buffer bytes.Buffer
+	xml.EscapeText(&buffer, []byte(s))
+	return buffer.String()
+}
+
+func newmessageid() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("uuid:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func (wc *winrmclient) envelope(action string, shellid string, options map[string]string, body string) string {
+	var header strings.Builder
+
+	fmt.Fprintf(&header, "<a:To>%s</a:To>", xmlescape(wc.endpoint))
+	header.WriteString(`<a:ReplyTo><a:Address s:mustUnderstand="true">http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:Address></a:ReplyTo>`)
+	fmt.Fprintf(&header, `<a:Action s:mustUnderstand="true">%s</a:Action>`, action)
+	fmt.Fprintf(&header, "<a:MessageID>%s</a:MessageID>", newmessageid())
+	fmt.Fprintf(&header, `<w:ResourceURI s:mustUnderstand="true">%s</w:ResourceURI>`, wsmanResourceCmd)
+	header.WriteString(`<w:MaxEnvelopeSize s:mustUnderstand="true">153600</w:MaxEnvelopeSize>`)
+	header.WriteString(`<w:OperationTimeout>PT60S</w:OperationTimeout>`)
+	header.WriteString(`<w:Locale xml:lang="en-US" s:mustUnderstand="false"/>`)
+	if shellid != "" {
+		fmt.Fprintf(&header, `<w:SelectorSet><w:Selector Name="ShellId">%s</w:Selector></w:SelectorSet>`, xmlescape(shellid))
+	}
+	if len(options) > 0 {
+		header.WriteString("<w:OptionSet>")
+		for name, value := range options {
+			fmt.Fprintf(&header, `<w:Option Name="%s">%s</w:Option>`, name, value)
+		}
+		header.WriteString("</w:OptionSet>")
+	}
+
+	return `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"` +
+		` xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing"` +
+		` xmlns:w="http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd"` +
+		` xmlns:rsp="http://schemas.microsoft.com/wbem/wsman/1/windows/shell">` +
+		"<s:Header>" + header.String() + "</s:Header>" +
+		"<s:Body>" + body + "</s:Body>" +
+		"</s:Envelope>"
+}
+
+func (wc *winrmclient) post(ctx context.Context, message string) (*wsmanresponse, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, wc.endpoint, strings.NewReader(message))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/soap+xml;charset=UTF-8")
+	request.SetBasicAuth(wc.username, wc.password)
+
+	response, err := wc.httpclient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusUnauthorized {
+		return nil, errors.New("WinRM authentication failed")
+	}
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &wsmanresponse{}
+	err = xml.Unmarshal(body, result)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WinRM response (HTTP status %v): %v", response.Status, err)
+	}
+
+	if result.Body.Fault != nil {
+		fault := &wsmanfault{
+			code:    result.Body.Fault.Detail.Code,
+			message: result.Body.Fault.Detail.Message,
+		}
+		if fault.message == "" {
+			fault.message = result.Body.Fault.Reason
+		}
+		return nil, fault
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("WinRM request failed: %v", response.Status)
+	}
+
+	return result, nil
+}
+
+func (wc *winrmclient) createshell(ctx context.Context) (string, error) {
+	message := wc.envelope(
+		wsmanActionCreate,
+		"",
+		map[string]string{
+			"WINRS_NOPROFILE": "TRUE",
+			"WINRS_CODEPAGE":  "65001",
+		},
+		"<rsp:Shell><rsp:InputStreams>stdin</rsp:InputStreams><rsp:OutputStreams>stdout stderr</rsp:OutputStreams></rsp:Shell>",
+	)
+
+	response, err := wc.post(ctx, message)
+	if err != nil {
+		return "", err
+	}
+
+	if response.Body.ShellID != "" {
+		return response.Body.ShellID, nil
+	}
+	for _, selector := range response.Body.CreatedSelector {
+		if selector.Name == "ShellId" {
+			return selector.Value, nil
+		}
+	}
+
+	return "", errors.New("WinRM did not return a shell id")
+}
+
+func (wc *winrmclient) deleteshell(ctx context.Context, shellid string) error {
+	_, err := wc.post(ctx, wc.envelope(wsmanActionDelete, shellid, nil, ""))
+	return err
+}
+
+func (wc *winrmclient) startcommand(ctx context.Context, shellid string, command string, args []string) (string, error) {
+	var body strings.Builder
+	body.WriteString("<rsp:CommandLine>")
+	fmt.Fprintf(&body, "<rsp:Command>%s</rsp:Command>", xmlescape(command))
+	for _, arg := range args {
+		fmt.Fprintf(&body, "<rsp:Arguments>%s</rsp:Arguments>", xmlescape(arg))
+	}
+	body.WriteString("</rsp:CommandLine>")
+
+	message := wc.envelope(
+		wsmanActionCommand,
+		shellid,
+		map[string]string{
+			"WINRS_CONSOLEMODE_STDIN": "TRUE",
+			"WINRS_SKIP_CMD_SHELL":    "TRUE",
+		},
+		body.String(),
+	)
+
+	response, err := wc.post(ctx, message)
+	if err != nil {
+		return "", err
+	}
+
+	if response.Body.CommandID == "" {
+		return "", errors.New("WinRM did not return a command id")
+	}
+
+	return response.Body.CommandID, nil
+}
+
+func (wc *winrmclient) signalterminate(ctx context.Context, shellid string, commandid string) error {
+	body := fmt.Sprintf(
+		`<rsp:Signal CommandId="%s"><rsp:Code>%s</rsp:Code></rsp:Signal>`,
+		xmlescape(commandid),
+		wsmanSignalTerminate,
+	)
+	_, err := wc.post(ctx, wc.envelope(wsmanActionSignal, shellid, nil, body))
+	return err
+}
+
+// receive collects the output of a command until it completes.
+func (wc *winrmclient) receive(ctx context.Context, shellid string, commandid string) (string, string, int, error) {
+	var stdout, stderr bytes.Buffer
+	body := fmt.Sprintf(
+		`<rsp:Receive><rsp:DesiredStream CommandId="%s">stdout stderr</rsp:DesiredStream></rsp:Receive>`,
+		xmlescape(commandid),
+	)
+
+	for {
+		response, err := wc.post(ctx, wc.envelope(wsmanActionReceive, shellid, nil, body))
+		if err != nil {
+			var fault *wsmanfault
+			if errors.As(err, &fault) && fault.code == wsmanReceiveTimeoutCode {
+				continue
+			}
+			return "", "", 0, err
+		}
+
+		for _, stream := range response.Body.Streams {
+			data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(stream.Data))
+			if err != nil {
+				return "", "", 0, fmt.Errorf("invalid WinRM output stream: %v", err)
+			}
+			switch stream.Name {
+			case "stdout":
+				stdout.Write(data)
+			case "stderr":
+				stderr.Write(data)
+			}
+		}
+
+		if response.Body.CommandState.State == wsmanCommandDone {
+			return stdout.String(), stderr.String(), response.Body.CommandState.ExitCode, nil
+		}
+	}
+}
+
+// newcleanupcontext returns a context for cleaning up a remote shell,
+// which is not done when the context of the command is.
+func newcleanupcontext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 30*time.Second)
+}
+
+// run runs a command on the remote host, and returns its standard output,
+// standard error and exit code. If the context is done before the command
+// completes, the command is terminated on the remote host.
+func (wc *winrmclient) run(ctx context.Context, command string, args ...string) (string, string, int, error) {
+	shellid, err := wc.createshell(ctx)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("could not create WinRM shell: %v", err)
+	}
+
+	// Clean up even if ctx is done. The cleanup gets its own timeout,
+	// which starts when the command is over.
+	defer func() {
+		cleanupctx, cancel := newcleanupcontext()
+		defer cancel()
+		wc.deleteshell(cleanupctx, shellid)
+	}()
+
+	commandid, err := wc.startcommand(ctx, shellid, command, args)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("could not start WinRM command: %v", err)
+	}
+
+	stdout, stderr, exitcode, err := wc.receive(ctx, shellid, commandid)
+	if err != nil {
+		if ctx.Err() != nil {
+			cleanupctx, cancel := newcleanupcontext()
+			defer cancel()
+			wc.signalterminate(cleanupctx, shellid, commandid)
+			return "", "", 0, ctx.Err()
+		}
+		return "", "", 0, err
+	}
+
+	return stdout, stderr, exitcode, nil
+}
@@ -0,0 +1,143 @@
+package driverhyperv_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	driverhyperv "github.com/kuttiproject/driver-hyperv"
+	"github.com/kuttiproject/drivercore"
+)
+
+var (
+	winrmActionPattern   = regexp.MustCompile(`<a:Action[^>]*>([^<]+)</a:Action>`)
+	winrmArgumentPattern = regexp.MustCompile(`<rsp:Arguments>([^<]*)</rsp:Arguments>`)
+)
+
+// winrmstandin is a stand-in for the WinRM service of a remote Hyper-V
+// host. It answers interface script commands from canned results.
+type winrmstandin struct {
+	mutex        sync.Mutex
+	commandlines []string
+	lastargs     []string
+}
+
+func (ws *winrmstandin) respond(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", "application/soap+xml;charset=UTF-8")
+	fmt.Fprintf(
+		w,
+		`<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:rsp="http://schemas.microsoft.com/wbem/wsman/1/windows/shell"><s:Header/><s:Body>%s</s:Body></s:Envelope>`,
+		body,
+	)
+}
+
+func (ws *winrmstandin) scriptoutput() string {
+	// The encoded interface script request follows the script path
+	request := &driverhyperv.ScriptRequest{}
+	for i, arg := range ws.lastargs {
+		if arg == "-File" && i+2 < len(ws.lastargs) {
+			requestdata, _ := base64.StdEncoding.DecodeString(ws.lastargs[i+2])
+			json.Unmarshal(requestdata, request)
+		}
+	}
+
+	switch request.Command {
+	case "checkdriver":
+		return fmt.Sprintf(`{"Success":true,"ErrorMessage":"","ErrorCode":"","PayLoad":{"ScriptVersion":"%v"}}`, driverhyperv.ScriptVersion)
+	case "getmachine":
+		return `{"Success":true,"ErrorMessage":"","ErrorCode":"","PayLoad":{"Machine":{"Name":"tester-test-node1","IPAddress":"","State":"Off"}}}`
+	}
+
+	return `{"Success":false,"ErrorMessage":"invalid interface argument","ErrorCode":"InvalidArgument","PayLoad":null}`
+}
+
+func (ws *winrmstandin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	if !ok || username != "tester" || password != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	action := winrmActionPattern.FindStringSubmatch(string(body))
+	if action == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	switch action[1] {
+	case "http://schemas.xmlsoap.org/ws/2004/09/transfer/Create":
+		ws.respond(w, `<rsp:Shell><rsp:ShellId>SHELL-1</rsp:ShellId></rsp:Shell>`)
+	case "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Command":
+		ws.lastargs = nil
+		for _, match := range winrmArgumentPattern.FindAllStringSubmatch(string(body), -1) {
+			ws.lastargs = append(ws.lastargs, match[1])
+		}
+		ws.commandlines = append(ws.commandlines, strings.Join(ws.lastargs, " "))
+		ws.respond(w, `<rsp:CommandResponse><rsp:CommandId>COMMAND-1</rsp:CommandId></rsp:CommandResponse>`)
+	case "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Receive":
+		ws.respond(
+			w,
+			fmt.Sprintf(
+				`<rsp:ReceiveResponse><rsp:Stream Name="stdout" CommandId="COMMAND-1">%s</rsp:Stream><rsp:CommandState CommandId="COMMAND-1" State="http://schemas.microsoft.com/wbem/wsman/1/windows/shell/CommandState/Done"><rsp:ExitCode>0</rsp:ExitCode></rsp:CommandState></rsp:ReceiveResponse>`,
+				base64.StdEncoding.EncodeToString([]byte(ws.scriptoutput())),
+			),
+		)
+	default:
+		ws.respond(w, "")
+	}
+}
+
+func TestRemoteDriver(t *testing.T) {
+	standin := &winrmstandin{}
+	server := httptest.NewServer(standin)
+	defer server.Close()
+
+	localstorage := t.TempDir()
+	driver, err := driverhyperv.NewRemoteDriver(driverhyperv.RemoteHost{
+		Endpoint:         server.URL + "/wsman",
+		Username:         "tester",
+		Password:         "secret",
+		StoragePath:      `D:\kutti`,
+		LocalStoragePath: localstorage,
+	})
+	if err != nil {
+		t.Fatalf("Error creating remote driver: %v", err)
+	}
+
+	if driver.Status() != "Ready" {
+		t.Fatalf("Expected driver status Ready, got %v: %v", driver.Status(), driver.Error())
+	}
+
+	scriptname := "hypervmanage-" + driverhyperv.ScriptVersion + ".ps1"
+	_, err = os.Stat(filepath.Join(localstorage, "driver-hyperv", scriptname))
+	if err != nil {
+		t.Errorf("Interface script not copied to remote storage: %v", err)
+	}
+
+	hostscriptpath := `D:\kutti\driver-hyperv\` + scriptname
+	if len(standin.commandlines) == 0 || !strings.Contains(standin.commandlines[0], hostscriptpath) {
+		t.Errorf("Expected command line to use script %v, got %v", hostscriptpath, standin.commandlines)
+	}
+
+	machine, err := driver.GetMachine("node1", "test")
+	if err != nil {
+		t.Fatalf("Error getting machine: %v", err)
+	}
+
+	if machine.Status() != drivercore.MachineStatusStopped {
+		t.Errorf("Expected status %v, got %v", drivercore.MachineStatusStopped, machine.Status())
+	}
+}
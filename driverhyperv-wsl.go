@@ -0,0 +1,153 @@
+package driverhyperv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+)
+
+// wslmountroot is the directory under which WSL mounts Windows drives.
+const wslmountroot = "/mnt/"
+
+// runningInWSL returns true if the driver is running inside the Windows
+// Subsystem for Linux.
+func runningInWSL() bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+
+	if os.Getenv("WSL_DISTRO_NAME") != "" {
+		return true
+	}
+
+	_, err := os.Stat("/proc/sys/fs/binfmt_misc/WSLInterop")
+	return err == nil
+}
+
+// WSLToWindowsPath converts an absolute path inside the Windows Subsystem
+// for Linux into the corresponding Windows path. Paths on mounted Windows
+// drives, like /mnt/c/Users, become drive paths like C:\Users. Other paths
+// become UNC paths into the WSL distribution, like \\wsl$\distro\home.
+// If distro is empty, the WSL_DISTRO_NAME environment variable is used.
+func WSLToWindowsPath(wslpath string, distro string) (string, error) {
+	if !path.IsAbs(wslpath) {
+		return "", fmt.Errorf("path '%v' is not absolute", wslpath)
+	}
+	wslpath = path.Clean(wslpath)
+
+	if strings.HasPrefix(wslpath, wslmountroot) {
+		rest := strings.TrimPrefix(wslpath, wslmountroot)
+		drive, rest, _ := strings.Cut(rest, "/")
+		if len(drive) == 1 && isletter(drive[0]) {
+			return strings.ToUpper(drive) + `:\` + strings.ReplaceAll(rest, "/", `\`), nil
+		}
+	}
+
+	if distro == "" {
+		distro = os.Getenv("WSL_DISTRO_NAME")
+	}
+	if distro == "" {
+		return "", errors.New("could not determine WSL distribution name")
+	}
+
+	return `\\wsl$\` + distro + strings.ReplaceAll(wslpath, "/", `\`), nil
+}
+
+// WindowsToWSLPath converts an absolute Windows path into the
+// corresponding path inside the Windows Subsystem for Linux. Drive paths
+// like C:\Users become /mnt/c/Users, and UNC paths into a WSL distribution
+// like \\wsl$\distro\home or \\wsl.localhost\distro\home become /home.
+func WindowsToWSLPath(windowspath string) (string, error) {
+	if len(windowspath) >= 2 && isletter(windowspath[0]) && windowspath[1] == ':' {
+		rest := strings.Trim(strings.ReplaceAll(windowspath[2:], `\`, "/"), "/")
+		result := wslmountroot + strings.ToLower(windowspath[:1])
+		if rest != "" {
+			result += "/" + rest
+		}
+		return path.Clean(result), nil
+	}
+
+	for _, prefix := range wslshareprefixes {
+		if len(windowspath) < len(prefix) || !strings.EqualFold(windowspath[:len(prefix)], prefix) {
+			continue
+		}
+
+		// Skip the distribution name
+		_, rest, _ := strings.Cut(windowspath[len(prefix):], `\`)
+		return path.Clean("/" + strings.ReplaceAll(rest, `\`, "/")), nil
+	}
+
+	return "", fmt.Errorf("path '%v' cannot be converted to a WSL path", windowspath)
+}
+
+// wslshareprefixes are the prefixes of Windows paths that lead into a WSL
+// distribution.
+var wslshareprefixes = []string{`\\wsl$\`, `\\wsl.localhost\`}
+
+// checkdifferencingparent returns an error if Hyper-V cannot use a file
+// as the parent of a differencing disk. Under WSL, the image cache is
+// usually in the Linux file system, which Hyper-V can only reach through
+// a \\wsl$ share, and Hyper-V cannot open parent disks there.
+func (vd *Driver) checkdifferencingparent(parentfile string) error {
+	hostparentfile, err := vd.hostpath(parentfile)
+	if err != nil {
+		return err
+	}
+
+	for _, prefix := range wslshareprefixes {
+		if hasprefixfold(hostparentfile, prefix) {
+			return fmt.Errorf(
+				"differencing disks cannot be used because the image cache '%v' is in the WSL file system: turn off DifferencingDisks, or keep the kutti workspace on a Windows drive",
+				hostparentfile,
+			)
+		}
+	}
+
+	return nil
+}
+
+func isletter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// SetStorageDir sets the directory under which the driver keeps VM disks
+// and VM files for a local Hyper-V host. By default, these are kept in
+// the workspace cache directory. When running inside WSL, the workspace
+// cache is usually on the Linux file system, which Hyper-V cannot use for
+// VM disks. In that case, a directory on a Windows drive should be set
+// here. It can be specified either as a WSL path like /mnt/c/kutti, or as
+// a Windows path like C:\kutti.
+// Setting an empty path restores the default.
+func (vd *Driver) SetStorageDir(storagedir string) error {
+	if storagedir != "" && runningInWSL() && !path.IsAbs(storagedir) {
+		wslpath, err := WindowsToWSLPath(storagedir)
+		if err != nil {
+			return err
+		}
+		storagedir = wslpath
+	}
+
+	if storagedir != "" {
+		err := os.MkdirAll(storagedir, 0755)
+		if err != nil {
+			return fmt.Errorf("could not create storage directory: %v", err)
+		}
+	}
+
+	vd.mutex.Lock()
+	defer vd.mutex.Unlock()
+
+	vd.storagedir = storagedir
+	return nil
+}
+
+// StorageDir returns the directory set by SetStorageDir.
+func (vd *Driver) StorageDir() string {
+	vd.mutex.Lock()
+	defer vd.mutex.Unlock()
+
+	return vd.storagedir
+}
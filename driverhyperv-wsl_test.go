@@ -0,0 +1,100 @@
+package driverhyperv_test
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+
+	driverhyperv "github.com/kuttiproject/driver-hyperv"
+)
+
+func TestWSLPathTranslation(t *testing.T) {
+	towindows := []struct {
+		wslpath     string
+		windowspath string
+	}{
+		{"/mnt/c/Users/kutti/disk.vhdx", `C:\Users\kutti\disk.vhdx`},
+		{"/mnt/d", `D:\`},
+		{"/mnt/c/kutti/../cache/", `C:\cache`},
+		{"/home/kutti/.cache/kutti", `\\wsl$\Ubuntu\home\kutti\.cache\kutti`},
+		{"/mnt/wsl/shared", `\\wsl$\Ubuntu\mnt\wsl\shared`},
+	}
+
+	for _, tc := range towindows {
+		result, err := driverhyperv.WSLToWindowsPath(tc.wslpath, "Ubuntu")
+		if err != nil {
+			t.Errorf("Error converting '%v': %v", tc.wslpath, err)
+			continue
+		}
+		if result != tc.windowspath {
+			t.Errorf("Converting '%v': expected '%v', got '%v'", tc.wslpath, tc.windowspath, result)
+		}
+	}
+
+	_, err := driverhyperv.WSLToWindowsPath("relative/path", "Ubuntu")
+	if err == nil {
+		t.Error("Expected error converting relative path")
+	}
+
+	towsl := []struct {
+		windowspath string
+		wslpath     string
+	}{
+		{`C:\Users\kutti\disk.vhdx`, "/mnt/c/Users/kutti/disk.vhdx"},
+		{`D:\`, "/mnt/d"},
+		{`e:\kutti\`, "/mnt/e/kutti"},
+		{`\\wsl$\Ubuntu\home\kutti`, "/home/kutti"},
+		{`\\wsl.localhost\Ubuntu\home\kutti`, "/home/kutti"},
+	}
+
+	for _, tc := range towsl {
+		result, err := driverhyperv.WindowsToWSLPath(tc.windowspath)
+		if err != nil {
+			t.Errorf("Error converting '%v': %v", tc.windowspath, err)
+			continue
+		}
+		if result != tc.wslpath {
+			t.Errorf("Converting '%v': expected '%v', got '%v'", tc.windowspath, tc.wslpath, result)
+		}
+	}
+
+	_, err = driverhyperv.WindowsToWSLPath(`\\server\share\kutti`)
+	if err == nil {
+		t.Error("Expected error converting non-WSL UNC path")
+	}
+}
+
+func TestDifferencingDisksInWSL(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("WSL is only detected on Linux")
+	}
+	t.Setenv("WSL_DISTRO_NAME", "Ubuntu")
+
+	driver, fe := newtestdriver(t)
+
+	config, err := driver.Config()
+	if err != nil {
+		t.Fatalf("Error loading configuration: %v", err)
+	}
+	config.DifferencingDisks = true
+	err = driver.SetConfig(config)
+	if err != nil {
+		t.Fatalf("Error setting configuration: %v", err)
+	}
+
+	// The image cache is in the WSL file system
+	_, err = driver.NewMachine("node1", "test", "1.27")
+	if err == nil || !strings.Contains(err.Error(), "WSL file system") {
+		t.Fatalf("Expected differencing disk error, got %v", err)
+	}
+	_, err = driver.NewMachines("test", "1.27", []string{"node2", "node3"}, 2)
+	if err == nil || !strings.Contains(err.Error(), "WSL file system") {
+		t.Fatalf("Expected differencing disk error, got %v", err)
+	}
+
+	for _, request := range fe.requests {
+		if request.Command == "newdifferencingdisk" || request.Command == "newmachine" {
+			t.Errorf("Expected no %v request", request.Command)
+		}
+	}
+}
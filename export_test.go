@@ -0,0 +1,11 @@
+package driverhyperv
+
+// NewSessionExecutor returns the executor used in persistent session
+// mode, running the specified program instead of PowerShell, so that
+// tests can run it against a stand-in session.
+func NewSessionExecutor(powershellpath string, scriptpath string) Executor {
+	return &sessionexecutor{
+		powershellpath: powershellpath,
+		scriptpath:     scriptpath,
+	}
+}
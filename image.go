@@ -2,6 +2,7 @@ package driverhyperv
 
 import (
 	"archive/zip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -23,6 +24,14 @@ type hypervimagedata struct {
 	ImageSourceURL  string
 	ImageStatus     drivercore.ImageStatus
 	ImageDeprecated bool
+	// The following are set in the image list for images that need a
+	// Generation 2 VM. They are absent for older images.
+	ImageGeneration         int    `json:",omitempty"`
+	ImageSecureBootTemplate string `json:",omitempty"`
+	ImageTPM                bool   `json:",omitempty"`
+	// ImageChildDisks is kept locally. It lists the differencing disks
+	// whose parent is the cached image.
+	ImageChildDisks []string `json:",omitempty"`
 }
 
 // Image implements the drivercore.Image interface for Hyper-V.
@@ -32,6 +41,12 @@ type Image struct {
 	imageSourceURL  string
 	imageStatus     drivercore.ImageStatus
 	imageDeprecated bool
+
+	imageGeneration         int
+	imageSecureBootTemplate string
+	imageTPM                bool
+
+	imageChildDisks []string
 }
 
 // K8sVersion returns the version of Kubernetes present in the image.
@@ -44,6 +59,9 @@ func (i *Image) K8sVersion() string {
 // be used to create Machines, or Notdownloaded, meaning it has to be downloaded
 // using Fetch.
 func (i *Image) Status() drivercore.ImageStatus {
+	imagemutex.Lock()
+	defer imagemutex.Unlock()
+
 	return i.imageStatus
 }
 
@@ -53,7 +71,73 @@ func (i *Image) Deprecated() bool {
 	return i.imageDeprecated
 }
 
-func (i *Image) fetch(progress func(int64, int64)) error {
+// Generation returns the Hyper-V VM generation that Machines created from
+// the image use: 1 for BIOS, or 2 for UEFI. Images that do not specify a
+// generation use Generation 1.
+func (i *Image) Generation() int {
+	if i.imageGeneration == 0 {
+		return 1
+	}
+
+	return i.imageGeneration
+}
+
+// SecureBootTemplate returns the Secure Boot template used by Generation 2
+// Machines created from the image, for example
+// "MicrosoftUEFICertificateAuthority". If it is empty, Secure Boot is
+// turned off.
+func (i *Image) SecureBootTemplate() string {
+	return i.imageSecureBootTemplate
+}
+
+// TPM returns true if Generation 2 Machines created from the image have a
+// virtual Trusted Platform Module.
+func (i *Image) TPM() bool {
+	return i.imageTPM
+}
+
+// ChildDisks returns the paths of machine disks that are differencing
+// disks whose parent is the cached copy of the image. While there are
+// any, the cached copy cannot be removed or replaced.
+func (i *Image) ChildDisks() []string {
+	imagemutex.Lock()
+	defer imagemutex.Unlock()
+
+	current, ok := imagedata.images[i.imageK8sVersion]
+	if !ok {
+		current = i
+	}
+
+	return livechilddisks(current.imageChildDisks)
+}
+
+// validatebootoptions returns an error if the image's boot options are
+// not supported.
+func (i *Image) validatebootoptions() error {
+	switch i.Generation() {
+	case 1:
+		if i.imageSecureBootTemplate != "" || i.imageTPM {
+			return fmt.Errorf("image for K8s version %v: Secure Boot and TPM need a Generation 2 VM", i.imageK8sVersion)
+		}
+	case 2:
+		if i.imageSecureBootTemplate != "" && !secureboottemplates[i.imageSecureBootTemplate] {
+			return fmt.Errorf("image for K8s version %v: unknown Secure Boot template '%v'", i.imageK8sVersion, i.imageSecureBootTemplate)
+		}
+	default:
+		return fmt.Errorf("image for K8s version %v: invalid VM generation %v", i.imageK8sVersion, i.imageGeneration)
+	}
+
+	return nil
+}
+
+// The Secure Boot templates supported by Hyper-V.
+var secureboottemplates = map[string]bool{
+	"MicrosoftWindows":                  true,
+	"MicrosoftUEFICertificateAuthority": true,
+	"OpenSourceShieldedVM":              true,
+}
+
+func (i *Image) fetch(ctx context.Context, progress func(int64, int64)) error {
 	cachedir, err := hypervCacheDir()
 	if err != nil {
 		return err
@@ -64,33 +148,37 @@ func (i *Image) fetch(progress func(int64, int64)) error {
 	tempfilepath := filepath.Join(cachedir, tempfilename)
 
 	// Download file
-	if progress != nil {
-		err = workspace.DownloadFileWithProgress(
-			i.imageSourceURL,
-			tempfilepath,
-			progress,
-		)
-	} else {
-		err = workspace.DownloadFile(i.imageSourceURL, tempfilepath)
-	}
+	err = downloadfile(ctx, i.imageSourceURL, tempfilepath, progress)
 	if err != nil {
 		return err
 	}
 	defer workspace.RemoveFile(tempfilepath)
 
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
 	return i.fromZipFile(tempfilepath, cachedir)
 }
 
 // Fetch downloads the image from its source URL.
 func (i *Image) Fetch() error {
-	return i.fetch(nil)
+	return i.fetch(context.Background(), nil)
 }
 
 // FetchWithProgress downloads the image from the driver repository into the
 // local cache, and reports progress via the supplied callback. The callback
 // reports current and total in bytes.
 func (i *Image) FetchWithProgress(progress func(current int64, total int64)) error {
-	return i.fetch(progress)
+	return i.fetch(context.Background(), progress)
+}
+
+// FetchWithProgressContext downloads the image like FetchWithProgress.
+// If the context is done before the download completes, the download
+// is aborted, and the context's error is returned. The progress callback
+// can be nil.
+func (i *Image) FetchWithProgressContext(ctx context.Context, progress func(current int64, total int64)) error {
+	return i.fetch(ctx, progress)
 }
 
 // FromFile verifies an image file on a local path and copies it to the cache.
@@ -160,18 +248,17 @@ func (i *Image) fromVHDXFile(localfilepath string) error {
 		return err
 	}
 
-	i.imageStatus = drivercore.ImageStatusDownloaded
-	return imageconfigmanager.Save()
+	return setimagestatus(i, drivercore.ImageStatusDownloaded)
 }
 
 // PurgeLocal removes the local cached copy of an image.
+// If the cached copy is the parent of any differencing disks, it is not
+// removed, and an error wrapping ErrImageInUse is returned.
 func (i *Image) PurgeLocal() error {
-	if i.imageStatus == drivercore.ImageStatusDownloaded {
+	if i.Status() == drivercore.ImageStatusDownloaded {
 		err := removefile(i.K8sVersion())
 		if err == nil {
-			i.imageStatus = drivercore.ImageStatusNotDownloaded
-
-			return imageconfigmanager.Save()
+			return setimagestatus(i, drivercore.ImageStatusNotDownloaded)
 		}
 		return err
 	}
@@ -180,6 +267,8 @@ func (i *Image) PurgeLocal() error {
 }
 
 // MarshalJSON returns the JSON encoding of the image.
+// It is used while saving the image list, with imagemutex held,
+// so it does not lock.
 func (i *Image) MarshalJSON() ([]byte, error) {
 	savedata := hypervimagedata{
 		ImageK8sVersion: i.imageK8sVersion,
@@ -187,6 +276,12 @@ func (i *Image) MarshalJSON() ([]byte, error) {
 		ImageSourceURL:  i.imageSourceURL,
 		ImageStatus:     i.imageStatus,
 		ImageDeprecated: i.imageDeprecated,
+
+		ImageGeneration:         i.imageGeneration,
+		ImageSecureBootTemplate: i.imageSecureBootTemplate,
+		ImageTPM:                i.imageTPM,
+
+		ImageChildDisks: i.imageChildDisks,
 	}
 
 	return json.Marshal(savedata)
@@ -207,6 +302,10 @@ func (i *Image) UnmarshalJSON(b []byte) error {
 	i.imageSourceURL = loaddata.ImageSourceURL
 	i.imageStatus = loaddata.ImageStatus
 	i.imageDeprecated = loaddata.ImageDeprecated
+	i.imageGeneration = loaddata.ImageGeneration
+	i.imageSecureBootTemplate = loaddata.ImageSecureBootTemplate
+	i.imageTPM = loaddata.ImageTPM
+	i.imageChildDisks = loaddata.ImageChildDisks
 
 	return nil
 }
@@ -0,0 +1,96 @@
+package driverhyperv_test
+
+import (
+	"testing"
+
+	driverhyperv "github.com/kuttiproject/driver-hyperv"
+	"github.com/kuttiproject/workspace"
+)
+
+func TestGeneration2Image(t *testing.T) {
+	err := workspace.Set(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error setting workspace: %v", err)
+	}
+
+	imagefilepath := setupimagecatalogwith(t, "1.27", map[string]interface{}{
+		"ImageGeneration":         2,
+		"ImageSecureBootTemplate": "MicrosoftUEFICertificateAuthority",
+		"ImageTPM":                true,
+	})
+
+	fe := &sshfakeexecutor{fakeexecutor: newfakeexecutor()}
+	driver := driverhyperv.NewDriverWithExecutor(fe)
+
+	image, err := driver.GetImage("1.27")
+	if err != nil {
+		t.Fatalf("Error getting image: %v", err)
+	}
+	hypervimage := image.(*driverhyperv.Image)
+	if hypervimage.Generation() != 2 || hypervimage.SecureBootTemplate() != "MicrosoftUEFICertificateAuthority" || !hypervimage.TPM() {
+		t.Errorf("Unexpected boot options: generation %v, template '%v', TPM %v", hypervimage.Generation(), hypervimage.SecureBootTemplate(), hypervimage.TPM())
+	}
+
+	err = image.FromFile(imagefilepath)
+	if err != nil {
+		t.Fatalf("Error adding image: %v", err)
+	}
+
+	_, err = driver.NewMachine("node1", "test", "1.27")
+	if err != nil {
+		t.Fatalf("Error creating machine: %v", err)
+	}
+
+	var newmachinerequest *driverhyperv.ScriptRequest
+	for _, request := range fe.requests {
+		if request.Command == "newmachine" {
+			newmachinerequest = request
+		}
+	}
+	if newmachinerequest == nil {
+		t.Fatalf("Expected a newmachine request")
+	}
+	if newmachinerequest.Parameter("Generation") != 2 {
+		t.Errorf("Expected Generation 2, got %v", newmachinerequest.Parameter("Generation"))
+	}
+	if newmachinerequest.Parameter("SecureBootTemplate") != "MicrosoftUEFICertificateAuthority" {
+		t.Errorf("Expected SecureBootTemplate MicrosoftUEFICertificateAuthority, got %v", newmachinerequest.Parameter("SecureBootTemplate"))
+	}
+	if newmachinerequest.Parameter("EnableTPM") != true {
+		t.Errorf("Expected EnableTPM true, got %v", newmachinerequest.Parameter("EnableTPM"))
+	}
+}
+
+func TestInvalidImageBootOptions(t *testing.T) {
+	err := workspace.Set(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error setting workspace: %v", err)
+	}
+
+	imagefilepath := setupimagecatalogwith(t, "1.27", map[string]interface{}{
+		"ImageTPM": true,
+	})
+
+	fe := &sshfakeexecutor{fakeexecutor: newfakeexecutor()}
+	driver := driverhyperv.NewDriverWithExecutor(fe)
+
+	image, err := driver.GetImage("1.27")
+	if err != nil {
+		t.Fatalf("Error getting image: %v", err)
+	}
+	if image.(*driverhyperv.Image).Generation() != 1 {
+		t.Errorf("Expected Generation 1 for image without generation")
+	}
+	err = image.FromFile(imagefilepath)
+	if err != nil {
+		t.Fatalf("Error adding image: %v", err)
+	}
+
+	_, err = driver.NewMachine("node1", "test", "1.27")
+	if err == nil {
+		t.Errorf("Expected error creating machine from Generation 1 image with TPM")
+	}
+	if len(fe.machines) != 0 {
+		t.Errorf("Expected no machine to be created")
+	}
+}
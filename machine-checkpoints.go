@@ -0,0 +1,255 @@
+package driverhyperv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// CheckpointType is the kind of checkpoint to create.
+type CheckpointType string
+
+// The CheckpointType* constants are the supported kinds of checkpoint.
+// A standard checkpoint saves the memory and device state of a running
+// machine. A production checkpoint uses backup technology inside the
+// machine to save a consistent disk state, and restores the machine
+// turned off. Creating a production checkpoint fails if the machine does
+// not support it.
+const (
+	CheckpointStandard   = CheckpointType("Standard")
+	CheckpointProduction = CheckpointType("Production")
+)
+
+// Checkpoint is a saved state of a Machine.
+type Checkpoint struct {
+	Name         string
+	CreationTime time.Time
+	// ParentName is the name of the checkpoint that this checkpoint was
+	// created after, or empty.
+	ParentName string
+}
+
+// checkpointfilepattern matches the names of the differencing disks that
+// Hyper-V creates for checkpoints. They are named <disk>_<GUID>.avhdx,
+// where <disk> is the name of the parent disk without its extension.
+var checkpointfilepattern = regexp.MustCompile(`^(.+)_[0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12}\.avhdx$`)
+
+// checkpointparent returns the name of the parent disk of a checkpoint
+// differencing disk, without its extension, or an empty string if the
+// file is not a checkpoint differencing disk.
+func checkpointparent(filename string) string {
+	matches := checkpointfilepattern.FindStringSubmatch(filename)
+	if matches == nil {
+		return ""
+	}
+
+	return matches[1]
+}
+
+// checkpointfiles returns the differencing disks left behind by
+// checkpoints of a machine disk.
+func (vd *Driver) checkpointfiles(qualifiedmachinename string) ([]string, error) {
+	diskdir, err := vd.diskDir()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(diskdir)
+	if err != nil {
+		return nil, err
+	}
+
+	diskfiles := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && checkpointparent(entry.Name()) == qualifiedmachinename {
+			diskfiles = append(diskfiles, filepath.Join(diskdir, entry.Name()))
+		}
+	}
+
+	return diskfiles, nil
+}
+
+// deletecheckpointfiles removes the differencing disks left behind by
+// checkpoints of a machine disk. Those of its data disks are removed
+// along with the data disks. The machine should have been removed from
+// Hyper-V first.
+func (vd *Driver) deletecheckpointfiles(qualifiedmachinename string) error {
+	diskfiles, err := vd.checkpointfiles(qualifiedmachinename)
+	if err != nil {
+		return err
+	}
+
+	for _, diskfile := range diskfiles {
+		err = os.Remove(diskfile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validatecheckpointname(name string) error {
+	if name == "" || len(name) > 100 {
+		return fmt.Errorf("invalid checkpoint name '%v': should be between 1 and 100 characters", name)
+	}
+
+	return nil
+}
+
+// CreateCheckpoint saves the current state of the Machine as a named
+// checkpoint.
+// It does this by running the Cmdlet:
+//
+//	Checkpoint-VM -VM <vm> -SnapshotName <name>
+//
+// through an interface script. Checkpoints are turned off for Machines
+// created by this driver, so the specified checkpoint type is enabled
+// only while the checkpoint is created.
+func (vh *Machine) CreateCheckpoint(name string, checkpointtype CheckpointType) error {
+	return vh.CreateCheckpointContext(context.Background(), name, checkpointtype)
+}
+
+// CreateCheckpointContext creates a checkpoint, like CreateCheckpoint.
+// If the context is done before the operation completes, the operation is
+// abandoned and the context's error is returned.
+func (vh *Machine) CreateCheckpointContext(ctx context.Context, name string, checkpointtype CheckpointType) error {
+	err := validatecheckpointname(name)
+	if err != nil {
+		return err
+	}
+
+	if checkpointtype != CheckpointStandard && checkpointtype != CheckpointProduction {
+		return fmt.Errorf("invalid checkpoint type '%v'", checkpointtype)
+	}
+
+	return vh.runcheckpointcommand(
+		ctx,
+		"newcheckpoint",
+		"create checkpoint '"+name+"' of the host",
+		scriptparams{
+			"MachineName":    vh.qname(),
+			"CheckpointName": name,
+			"CheckpointType": string(checkpointtype),
+		},
+	)
+}
+
+// Checkpoints returns the checkpoints of the Machine, oldest first.
+// It does this by running the Cmdlet:
+//
+//	Get-VMSnapshot -VMName <machinename>
+//
+// through an interface script.
+func (vh *Machine) Checkpoints() ([]Checkpoint, error) {
+	return vh.CheckpointsContext(context.Background())
+}
+
+// CheckpointsContext returns the checkpoints of the Machine, like
+// Checkpoints. If the context is done before the operation completes, the
+// operation is abandoned and the context's error is returned.
+func (vh *Machine) CheckpointsContext(ctx context.Context) ([]Checkpoint, error) {
+	result, err := vh.driver.runwithresults(
+		ctx,
+		"listcheckpoints",
+		scriptparams{
+			"MachineName": vh.qname(),
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not list checkpoints of the host '%s': %w", vh.Name(), err)
+	}
+
+	if !result.Success {
+		return nil, newoperationerror("list checkpoints of the host", vh.Name(), result)
+	}
+
+	var checkpointdata struct {
+		Checkpoints []Checkpoint
+	}
+	err = decodepayload(result.Payload, &checkpointdata)
+	if err != nil {
+		return nil, fmt.Errorf("could not list checkpoints of the host '%s': %v", vh.Name(), err)
+	}
+
+	if checkpointdata.Checkpoints == nil {
+		return []Checkpoint{}, nil
+	}
+
+	return checkpointdata.Checkpoints, nil
+}
+
+// RestoreCheckpoint returns the Machine to the state saved in a named
+// checkpoint. Changes made since then are lost.
+// It does this by running the Cmdlet:
+//
+//	Restore-VMSnapshot -VMSnapshot <checkpoint> -Confirm:$false
+//
+// through an interface script. The status of the Machine is updated
+// afterwards.
+func (vh *Machine) RestoreCheckpoint(name string) error {
+	return vh.RestoreCheckpointContext(context.Background(), name)
+}
+
+// RestoreCheckpointContext restores a checkpoint, like RestoreCheckpoint.
+// If the context is done before the operation completes, the operation is
+// abandoned and the context's error is returned.
+func (vh *Machine) RestoreCheckpointContext(ctx context.Context, name string) error {
+	err := vh.runcheckpointcommand(
+		ctx,
+		"restorecheckpoint",
+		"restore checkpoint '"+name+"' of the host",
+		scriptparams{
+			"MachineName":    vh.qname(),
+			"CheckpointName": name,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	return vh.get(ctx)
+}
+
+// DeleteCheckpoint deletes a named checkpoint of the Machine. The current
+// state of the Machine is not affected.
+// It does this by running the Cmdlet:
+//
+//	Remove-VMSnapshot -VMSnapshot <checkpoint>
+//
+// through an interface script.
+func (vh *Machine) DeleteCheckpoint(name string) error {
+	return vh.DeleteCheckpointContext(context.Background(), name)
+}
+
+// DeleteCheckpointContext deletes a checkpoint, like DeleteCheckpoint.
+// If the context is done before the operation completes, the operation is
+// abandoned and the context's error is returned.
+func (vh *Machine) DeleteCheckpointContext(ctx context.Context, name string) error {
+	return vh.runcheckpointcommand(
+		ctx,
+		"deletecheckpoint",
+		"delete checkpoint '"+name+"' of the host",
+		scriptparams{
+			"MachineName":    vh.qname(),
+			"CheckpointName": name,
+		},
+	)
+}
+
+func (vh *Machine) runcheckpointcommand(ctx context.Context, command string, operation string, params scriptparams) error {
+	result, err := vh.driver.runwithresults(ctx, command, params)
+	if err != nil {
+		return fmt.Errorf("could not %v '%v': %w", operation, vh.Name(), err)
+	}
+
+	if !result.Success {
+		return newoperationerror(operation, vh.Name(), result)
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package driverhyperv_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	driverhyperv "github.com/kuttiproject/driver-hyperv"
+	"github.com/kuttiproject/drivercore"
+	"github.com/kuttiproject/workspace"
+)
+
+func TestCheckpoints(t *testing.T) {
+	driver, _ := newtestdriver(t)
+
+	newmachine, err := driver.NewMachine("node1", "test", "1.27")
+	if err != nil {
+		t.Fatalf("Error creating machine: %v", err)
+	}
+	machine := newmachine.(*driverhyperv.Machine)
+
+	err = machine.CreateCheckpoint("before-upgrade", driverhyperv.CheckpointProduction)
+	if err != nil {
+		t.Fatalf("Error creating checkpoint: %v", err)
+	}
+
+	err = machine.CreateCheckpoint("before-upgrade", driverhyperv.CheckpointStandard)
+	if !errors.Is(err, driverhyperv.ErrInvalidArgument) {
+		t.Errorf("Expected ErrInvalidArgument creating duplicate checkpoint, got %v", err)
+	}
+
+	err = machine.CreateCheckpoint("other", driverhyperv.CheckpointType("Quick"))
+	if err == nil {
+		t.Errorf("Expected error creating checkpoint of invalid type")
+	}
+
+	err = machine.Start()
+	if err != nil {
+		t.Fatalf("Error starting machine: %v", err)
+	}
+	machine.WaitForStateChange(25)
+
+	err = machine.CreateCheckpoint("running", driverhyperv.CheckpointStandard)
+	if err != nil {
+		t.Fatalf("Error creating checkpoint: %v", err)
+	}
+
+	checkpoints, err := machine.Checkpoints()
+	if err != nil {
+		t.Fatalf("Error listing checkpoints: %v", err)
+	}
+	if len(checkpoints) != 2 || checkpoints[1].Name != "running" || checkpoints[1].ParentName != "before-upgrade" {
+		t.Errorf("Unexpected checkpoints: %+v", checkpoints)
+	}
+	if checkpoints[0].CreationTime.Year() != 2024 {
+		t.Errorf("Expected creation time to be parsed, got %v", checkpoints[0].CreationTime)
+	}
+
+	err = machine.RestoreCheckpoint("before-upgrade")
+	if err != nil {
+		t.Fatalf("Error restoring checkpoint: %v", err)
+	}
+	if machine.Status() != drivercore.MachineStatusStopped {
+		t.Errorf("Expected status %v after restoring, got %v", drivercore.MachineStatusStopped, machine.Status())
+	}
+
+	err = machine.DeleteCheckpoint("running")
+	if err != nil {
+		t.Errorf("Error deleting checkpoint: %v", err)
+	}
+	err = machine.RestoreCheckpoint("running")
+	if !errors.Is(err, driverhyperv.ErrCheckpointNotFound) {
+		t.Errorf("Expected ErrCheckpointNotFound restoring deleted checkpoint, got %v", err)
+	}
+
+	// Checkpoint disks are removed with the machine
+	diskdir, err := workspace.CacheSubDir("driver-hyperv-disks")
+	if err != nil {
+		t.Fatalf("Error getting disk directory: %v", err)
+	}
+	qname := driver.QualifiedMachineName("node1", "test")
+	otherqname := driver.QualifiedMachineName("node1_2", "test")
+	checkpointid := "_0A1B2C3D-0A1B-0A1B-0A1B-0A1B2C3D4E5F.avhdx"
+	checkpointdisks := []string{
+		filepath.Join(diskdir, qname+checkpointid),
+		filepath.Join(diskdir, qname+".data", "ceph"+checkpointid),
+		filepath.Join(diskdir, otherqname+checkpointid),
+	}
+	for _, checkpointdisk := range checkpointdisks {
+		err = os.MkdirAll(filepath.Dir(checkpointdisk), 0755)
+		if err == nil {
+			err = os.WriteFile(checkpointdisk, []byte("checkpoint"), 0644)
+		}
+		if err != nil {
+			t.Fatalf("Error creating checkpoint disk: %v", err)
+		}
+	}
+
+	err = driver.DeleteMachine("node1", "test")
+	if err != nil {
+		t.Fatalf("Error deleting machine: %v", err)
+	}
+	for i, checkpointdisk := range checkpointdisks {
+		_, err := os.Stat(checkpointdisk)
+		if i < 2 && !os.IsNotExist(err) {
+			t.Errorf("Expected checkpoint disk %v to be deleted", filepath.Base(checkpointdisk))
+		}
+		if i == 2 && err != nil {
+			t.Errorf("Expected checkpoint disk of other machine to be kept, got %v", err)
+		}
+	}
+}
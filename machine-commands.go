@@ -1,29 +1,134 @@
 package driverhyperv
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/kuttiproject/drivercore"
 	"github.com/kuttiproject/sshclient"
 )
 
-// TODO: Look at parameterizing these
-var (
-	hypervUsername = "kuttiadmin"
-	hypervPassword = "Pass@word1"
-)
-
 // runwithresults allows running commands inside a VM Host.
 // It does this by creating an SSH session with the host.
-func (vh *Machine) runwithresults(execpath string, paramarray ...string) (string, error) {
-	client := sshclient.NewWithPassword(hypervUsername, hypervPassword)
+// If the context is done before the command completes, runwithresults
+// returns the context's error without waiting for the command.
+// If tracing is on, the command and its output are recorded.
+func (vh *Machine) runwithresults(ctx context.Context, execpath string, paramarray ...string) (string, error) {
 	params := append([]string{execpath}, paramarray...)
-	output, err := client.RunWithResults(vh.SSHAddress(), strings.Join(params, " "))
+	command := strings.Join(params, " ")
+	address := vh.SSHAddress()
+
+	tracer := vh.driver.currenttracer()
+	if tracer == nil {
+		return vh.runssh(ctx, address, command)
+	}
+
+	starttime := time.Now()
+	output, err := vh.runssh(ctx, address, command)
+	tracer.record(&TraceRecord{
+		Time:                 starttime,
+		Kind:                 TraceKindSSH,
+		DurationMilliseconds: time.Since(starttime).Milliseconds(),
+		Address:              address,
+		Command:              command,
+		Stdout:               output,
+		Error:                errorstring(err),
+	})
+
+	return output, err
+}
+
+// sshcommandids makes the names of the files used to stop SSH commands
+// unique within this process.
+var sshcommandids atomic.Int64
+
+// sshstopgrace is how long runssh waits for a stopped command to end.
+const sshstopgrace = 5 * time.Second
+
+// stoppablecommand wraps a command run over SSH, so that it can be
+// stopped from a second SSH session. The wrapper saves the process ID of
+// the shell running the command, which leads the process group of the
+// command, in a file. The returned stop command marks the command as
+// stopped, in case it has not started yet, and signals the process group.
+func stoppablecommand(command string) (wrapped string, stop string) {
+	filebase := fmt.Sprintf("/tmp/kutti-ssh-%d-%d", os.Getpid(), sshcommandids.Add(1))
+	pidfile := filebase + ".pid"
+	stopfile := filebase + ".stop"
+
+	wrapped = fmt.Sprintf(
+		"trap 'rm -f %[1]s %[2]s' EXIT; echo $$ >%[1]s; [ -e %[2]s ] && exit 143; %[3]s",
+		pidfile,
+		stopfile,
+		command,
+	)
+	stop = fmt.Sprintf(
+		"touch %[2]s; [ -s %[1]s ] && kill -TERM -- -$(cat %[1]s)",
+		pidfile,
+		stopfile,
+	)
+
+	return wrapped, stop
+}
+
+// runssh runs a command in a machine over SSH, and returns its combined
+// output, along with an error if it failed. If the context is done before
+// the command completes, the command is stopped from a second SSH session,
+// and the context's error is returned. If the command does not end soon
+// after that, for example because the machine cannot be reached, it is
+// abandoned.
+func (vh *Machine) runssh(ctx context.Context, address string, command string) (string, error) {
+	if sshexecutor, ok := vh.driver.currentexecutor().(SSHExecutor); ok {
+		return sshexecutor.ExecuteSSH(ctx, address, command)
+	}
+
+	config, err := loaddriverconfig()
 	if err != nil {
 		return "", err
 	}
-	return output, nil
+	client := sshclient.NewWithPassword(config.SSHUsername, config.SSHPassword)
+
+	// sshclient does not take a context
+	wrapped, stop := stoppablecommand(command)
+
+	type sshresult struct {
+		output string
+		err    error
+	}
+	resultchan := make(chan sshresult, 1)
+	go func() {
+		output, err := client.RunWithResults(address, wrapped)
+		resultchan <- sshresult{output: output, err: err}
+	}()
+
+	select {
+	case result := <-resultchan:
+		return result.output, result.err
+	case <-ctx.Done():
+		go client.RunWithResults(address, stop)
+
+		timer := time.NewTimer(sshstopgrace)
+		defer timer.Stop()
+		select {
+		case result := <-resultchan:
+			return result.output, ctx.Err()
+		case <-timer.C:
+			return "", ctx.Err()
+		}
+	}
+}
+
+// commanderror adds the output of a failed SSH command to its error.
+func commanderror(err error, output string) error {
+	output = strings.TrimSpace(output)
+	if output == "" {
+		return err
+	}
+
+	return fmt.Errorf("%w: %s", err, output)
 }
 
 var hypervCommands = map[drivercore.PredefinedCommand]func(*Machine, ...string) error{
@@ -31,14 +136,25 @@ var hypervCommands = map[drivercore.PredefinedCommand]func(*Machine, ...string)
 }
 
 func renamemachine(vh *Machine, params ...string) error {
-	newname := params[0]
-	execname := fmt.Sprintf("/home/%s/kutti-installscripts/set-hostname.sh", hypervUsername)
+	return renamemachinecontext(context.Background(), vh, params[0])
+}
+
+func renamemachinecontext(ctx context.Context, vh *Machine, newname string) error {
+	config, err := loaddriverconfig()
+	if err != nil {
+		return err
+	}
+	execname := fmt.Sprintf("/home/%s/kutti-installscripts/set-hostname.sh", config.SSHUsername)
 
-	_, err := vh.runwithresults(
+	output, err := vh.runwithresults(
+		ctx,
 		"/usr/bin/sudo",
 		execname,
 		newname,
 	)
+	if err != nil {
+		return commanderror(err, output)
+	}
 
-	return err
+	return nil
 }
@@ -0,0 +1,348 @@
+package driverhyperv
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DataDisk is an additional disk of a Machine, for example for storage
+// that is not on the root file system.
+type DataDisk struct {
+	// Name identifies the disk among the data disks of the machine.
+	Name string
+	// Path is the location of the disk file, as seen by the driver.
+	Path string
+	// SizeBytes is the current size of the disk file. Data disks are
+	// dynamically expanding, so this is less than the size of the disk
+	// as seen inside the machine until the disk fills up.
+	SizeBytes int64
+	// Attached is true if the disk is attached to the machine.
+	Attached bool
+	// ControllerNumber and ControllerLocation identify the SCSI
+	// controller and slot of an attached disk.
+	ControllerNumber   int
+	ControllerLocation int
+}
+
+var datadisknamepattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+func validatedatadiskname(name string) error {
+	if !datadisknamepattern.MatchString(name) {
+		return fmt.Errorf("invalid data disk name '%v': should contain only lowercase letters, digits and hyphens", name)
+	}
+
+	return nil
+}
+
+// datadiskdirsuffix is added to the qualified name of a machine to name
+// the directory that holds its data disks. Data disks are kept in a
+// directory of their own, because machine, cluster and data disk names
+// can all contain hyphens, so no file name prefix would be unambiguous.
+const datadiskdirsuffix = ".data"
+
+// datadiskdir returns the directory that holds the data disks of a
+// machine, in the disk directory.
+func (vd *Driver) datadiskdir(qualifiedmachinename string) (string, error) {
+	diskdir, err := vd.diskDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(diskdir, qualifiedmachinename+datadiskdirsuffix), nil
+}
+
+func (vd *Driver) datadiskpath(qualifiedmachinename string, name string) (string, error) {
+	datadiskdir, err := vd.datadiskdir(qualifiedmachinename)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(datadiskdir, name+".vhdx"), nil
+}
+
+// datadiskfiles returns the data disk files of a machine.
+func (vd *Driver) datadiskfiles(qualifiedmachinename string) ([]string, error) {
+	datadiskdir, err := vd.datadiskdir(qualifiedmachinename)
+	if err != nil {
+		return nil, err
+	}
+
+	return filepath.Glob(filepath.Join(datadiskdir, "*.vhdx"))
+}
+
+// deletedatadisks removes the data disk files of a machine, along with
+// the differencing disks left behind by their checkpoints. The machine
+// should have been removed from Hyper-V first.
+func (vd *Driver) deletedatadisks(qualifiedmachinename string) error {
+	datadiskdir, err := vd.datadiskdir(qualifiedmachinename)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(datadiskdir)
+}
+
+// DataDisks returns the data disks of a Machine, attached or not, in order
+// of name.
+// It does this by running the Cmdlet:
+//
+//	Get-VMHardDiskDrive -VMName <machinename>
+//
+// through an interface script, and looking for data disk files.
+func (vh *Machine) DataDisks() ([]DataDisk, error) {
+	return vh.DataDisksContext(context.Background())
+}
+
+// DataDisksContext returns the data disks of a Machine, like DataDisks.
+// If the context is done before the operation completes, the operation
+// is abandoned and the context's error is returned.
+func (vh *Machine) DataDisksContext(ctx context.Context) ([]DataDisk, error) {
+	qname := vh.qname()
+
+	result, err := vh.driver.runwithresults(
+		ctx,
+		"listdisks",
+		scriptparams{
+			"MachineName": qname,
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not list disks of the host '%s': %w", vh.Name(), err)
+	}
+
+	if !result.Success {
+		return nil, newoperationerror("list disks of the host", vh.Name(), result)
+	}
+
+	var diskdata struct {
+		Disks []struct {
+			Path               string
+			ControllerType     string
+			ControllerNumber   int
+			ControllerLocation int
+		}
+	}
+	err = decodepayload(result.Payload, &diskdata)
+	if err != nil {
+		return nil, fmt.Errorf("could not list disks of the host '%s': %v", vh.Name(), err)
+	}
+
+	diskfiles, err := vh.driver.datadiskfiles(qname)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(diskfiles)
+
+	disks := make([]DataDisk, 0, len(diskfiles))
+	for _, diskfile := range diskfiles {
+		disk := DataDisk{
+			Name: strings.TrimSuffix(filepath.Base(diskfile), ".vhdx"),
+			Path: diskfile,
+		}
+
+		if fileinfo, err := os.Stat(diskfile); err == nil {
+			disk.SizeBytes = fileinfo.Size()
+		}
+
+		// Hyper-V paths are not case-sensitive
+		hostdiskfile, err := vh.driver.hostpath(diskfile)
+		if err != nil {
+			return nil, err
+		}
+		for _, attached := range diskdata.Disks {
+			if strings.EqualFold(attached.Path, hostdiskfile) {
+				disk.Attached = true
+				disk.ControllerNumber = attached.ControllerNumber
+				disk.ControllerLocation = attached.ControllerLocation
+			}
+		}
+
+		disks = append(disks, disk)
+	}
+
+	return disks, nil
+}
+
+// CreateDataDisk creates an empty, dynamically expanding data disk of the
+// specified size in gigabytes, and attaches it to the Machine.
+// It does this by running the Cmdlets:
+//
+//	New-VHD -Path <diskpath> -SizeBytes <size> -Dynamic
+//	Add-VMHardDiskDrive -VMName <machinename> -ControllerType SCSI -Path <diskpath>
+//
+// through an interface script. The disk is stored in a directory named
+// for the Machine, next to the disk of the Machine, and deleted when the
+// Machine is deleted. The Machine can be running.
+func (vh *Machine) CreateDataDisk(name string, sizegb int) error {
+	return vh.CreateDataDiskContext(context.Background(), name, sizegb)
+}
+
+// CreateDataDiskContext creates and attaches a data disk, like
+// CreateDataDisk. If the context is done before the operation completes,
+// the operation is abandoned and the context's error is returned.
+func (vh *Machine) CreateDataDiskContext(ctx context.Context, name string, sizegb int) error {
+	err := validatedatadiskname(name)
+	if err != nil {
+		return err
+	}
+
+	if sizegb < 1 {
+		return fmt.Errorf("invalid data disk size %v GB: should be at least 1", sizegb)
+	}
+
+	diskpath, err := vh.driver.datadiskpath(vh.qname(), name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(diskpath); err == nil {
+		return fmt.Errorf("data disk '%v' of the host '%v' already exists", name, vh.Name())
+	}
+
+	err = os.MkdirAll(filepath.Dir(diskpath), 0755)
+	if err != nil {
+		return fmt.Errorf("could not create data disk '%v' of the host '%v': %v", name, vh.Name(), err)
+	}
+
+	hostdiskpath, err := vh.driver.hostpath(diskpath)
+	if err != nil {
+		return err
+	}
+
+	result, err := vh.driver.runwithresults(
+		ctx,
+		"newdatadisk",
+		scriptparams{
+			"DiskPath":  hostdiskpath,
+			"SizeBytes": int64(sizegb) << 30,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("could not create data disk '%v' of the host '%v': %w", name, vh.Name(), err)
+	}
+
+	if !result.Success {
+		return newoperationerror("create data disk '"+name+"' of the host", vh.Name(), result)
+	}
+
+	err = vh.AttachDataDiskContext(ctx, name)
+	if err != nil {
+		os.Remove(diskpath)
+		return err
+	}
+
+	return nil
+}
+
+// AttachDataDisk attaches a detached data disk to the Machine.
+// It does this by running the Cmdlet:
+//
+//	Add-VMHardDiskDrive -VMName <machinename> -ControllerType SCSI -Path <diskpath>
+//
+// through an interface script. The Machine can be running.
+func (vh *Machine) AttachDataDisk(name string) error {
+	return vh.AttachDataDiskContext(context.Background(), name)
+}
+
+// AttachDataDiskContext attaches a data disk, like AttachDataDisk. If the
+// context is done before the operation completes, the operation is
+// abandoned and the context's error is returned.
+func (vh *Machine) AttachDataDiskContext(ctx context.Context, name string) error {
+	return vh.changedatadisk(ctx, "attachdisk", "attach data disk '"+name+"' to the host", name)
+}
+
+// DetachDataDisk detaches a data disk from the Machine. The disk is not
+// deleted, and can be attached again.
+// It does this by running the Cmdlet:
+//
+//	Remove-VMHardDiskDrive -VMHardDiskDrive <drive>
+//
+// through an interface script. The Machine can be running, but the disk
+// should not be in use inside it.
+func (vh *Machine) DetachDataDisk(name string) error {
+	return vh.DetachDataDiskContext(context.Background(), name)
+}
+
+// DetachDataDiskContext detaches a data disk, like DetachDataDisk. If the
+// context is done before the operation completes, the operation is
+// abandoned and the context's error is returned.
+func (vh *Machine) DetachDataDiskContext(ctx context.Context, name string) error {
+	return vh.changedatadisk(ctx, "detachdisk", "detach data disk '"+name+"' from the host", name)
+}
+
+func (vh *Machine) changedatadisk(ctx context.Context, command string, operation string, name string) error {
+	err := validatedatadiskname(name)
+	if err != nil {
+		return err
+	}
+
+	diskpath, err := vh.driver.datadiskpath(vh.qname(), name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(diskpath); err != nil {
+		return fmt.Errorf("could not %v '%v': %w", operation, vh.Name(), ErrDataDiskNotFound)
+	}
+
+	hostdiskpath, err := vh.driver.hostpath(diskpath)
+	if err != nil {
+		return err
+	}
+
+	result, err := vh.driver.runwithresults(
+		ctx,
+		command,
+		scriptparams{
+			"MachineName": vh.qname(),
+			"DiskPath":    hostdiskpath,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("could not %v '%v': %w", operation, vh.Name(), err)
+	}
+
+	if !result.Success {
+		return newoperationerror(operation, vh.Name(), result)
+	}
+
+	return nil
+}
+
+// DeleteDataDisk detaches a data disk from the Machine if it is attached,
+// and deletes it.
+func (vh *Machine) DeleteDataDisk(name string) error {
+	return vh.DeleteDataDiskContext(context.Background(), name)
+}
+
+// DeleteDataDiskContext deletes a data disk, like DeleteDataDisk. If the
+// context is done before the disk is detached, the operation is abandoned
+// and the context's error is returned.
+func (vh *Machine) DeleteDataDiskContext(ctx context.Context, name string) error {
+	disks, err := vh.DataDisksContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, disk := range disks {
+		if disk.Name != name {
+			continue
+		}
+
+		if disk.Attached {
+			err = vh.DetachDataDiskContext(ctx, name)
+			if err != nil {
+				return err
+			}
+		}
+
+		return os.Remove(disk.Path)
+	}
+
+	return fmt.Errorf("could not delete data disk '%v' of the host '%v': %w", name, vh.Name(), ErrDataDiskNotFound)
+}
@@ -0,0 +1,127 @@
+package driverhyperv_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	driverhyperv "github.com/kuttiproject/driver-hyperv"
+	"github.com/kuttiproject/workspace"
+)
+
+func TestDataDisks(t *testing.T) {
+	driver, _ := newtestdriver(t)
+
+	newmachine, err := driver.NewMachine("node1", "test", "1.27")
+	if err != nil {
+		t.Fatalf("Error creating machine: %v", err)
+	}
+	machine := newmachine.(*driverhyperv.Machine)
+
+	err = machine.CreateDataDisk("Bad Name", 10)
+	if err == nil {
+		t.Errorf("Expected error creating data disk with invalid name")
+	}
+
+	for _, name := range []string{"longhorn", "ceph"} {
+		err = machine.CreateDataDisk(name, 10)
+		if err != nil {
+			t.Fatalf("Error creating data disk %v: %v", name, err)
+		}
+	}
+
+	err = machine.CreateDataDisk("ceph", 10)
+	if err == nil {
+		t.Errorf("Expected error creating existing data disk")
+	}
+
+	err = machine.DetachDataDisk("ceph")
+	if err != nil {
+		t.Fatalf("Error detaching data disk: %v", err)
+	}
+
+	disks, err := machine.DataDisks()
+	if err != nil {
+		t.Fatalf("Error listing data disks: %v", err)
+	}
+	if len(disks) != 2 || disks[0].Name != "ceph" || disks[1].Name != "longhorn" {
+		t.Fatalf("Expected data disks ceph and longhorn, got %+v", disks)
+	}
+	if disks[0].Attached || !disks[1].Attached {
+		t.Errorf("Expected only longhorn to be attached, got %+v", disks)
+	}
+
+	err = machine.AttachDataDisk("ceph")
+	if err != nil {
+		t.Errorf("Error attaching data disk: %v", err)
+	}
+
+	err = machine.DeleteDataDisk("longhorn")
+	if err != nil {
+		t.Errorf("Error deleting data disk: %v", err)
+	}
+	if _, err := os.Stat(disks[1].Path); !os.IsNotExist(err) {
+		t.Errorf("Expected data disk file to be deleted")
+	}
+
+	err = machine.DeleteDataDisk("longhorn")
+	if !errors.Is(err, driverhyperv.ErrDataDiskNotFound) {
+		t.Errorf("Expected ErrDataDiskNotFound deleting missing data disk, got %v", err)
+	}
+
+	// Deleting the machine deletes its data disks, even if its own disk
+	// is already gone
+	diskdir, _ := workspace.CacheSubDir("driver-hyperv-disks")
+	err = os.Remove(filepath.Join(diskdir, driver.QualifiedMachineName("node1", "test")+".vhdx"))
+	if err != nil {
+		t.Fatalf("Error removing disk: %v", err)
+	}
+	err = driver.DeleteMachine("node1", "test")
+	if err != nil {
+		t.Fatalf("Error deleting machine: %v", err)
+	}
+	if _, err := os.Stat(disks[0].Path); !os.IsNotExist(err) {
+		t.Errorf("Expected data disk file to be deleted with machine")
+	}
+}
+
+func TestDataDisksWithHyphenatedNames(t *testing.T) {
+	driver, _ := newtestdriver(t)
+
+	// The data disk logs of node1 must not look like it belongs to
+	// node1-data-logs, or the other way round
+	machines := map[string]*driverhyperv.Machine{}
+	for _, name := range []string{"node1", "node1-data-logs"} {
+		newmachine, err := driver.NewMachine(name, "my-cluster", "1.27")
+		if err != nil {
+			t.Fatalf("Error creating machine %v: %v", name, err)
+		}
+		machines[name] = newmachine.(*driverhyperv.Machine)
+	}
+
+	err := machines["node1"].CreateDataDisk("logs", 10)
+	if err != nil {
+		t.Fatalf("Error creating data disk: %v", err)
+	}
+
+	disks, err := machines["node1-data-logs"].DataDisks()
+	if err != nil {
+		t.Fatalf("Error listing data disks: %v", err)
+	}
+	if len(disks) != 0 {
+		t.Errorf("Expected no data disks for node1-data-logs, got %+v", disks)
+	}
+
+	err = driver.DeleteMachine("node1-data-logs", "my-cluster")
+	if err != nil {
+		t.Fatalf("Error deleting machine: %v", err)
+	}
+	disks, err = machines["node1"].DataDisks()
+	if err != nil {
+		t.Fatalf("Error listing data disks: %v", err)
+	}
+	if len(disks) != 1 || disks[0].Name != "logs" || !disks[0].Attached {
+		t.Errorf("Expected attached data disk logs for node1, got %+v", disks)
+	}
+}
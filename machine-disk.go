@@ -0,0 +1,197 @@
+package driverhyperv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kuttiproject/drivercore"
+	"github.com/kuttiproject/kuttilog"
+)
+
+// growfsmarker is the name of a file in the directory of a machine which
+// indicates that its disk has been grown, but its root file system has
+// not.
+const growfsmarker = "kutti-growfs-pending"
+
+// growfsscript grows the partition and file system containing the root
+// directory of a machine to fill its disk, and prints the new size of
+// the file system in bytes. growpart exits with 1 if the partition
+// already fills the disk.
+const growfsscript = `set -e
+rootdev=$(findmnt -n -o SOURCE /)
+disk=/dev/$(lsblk -n -o PKNAME "$rootdev")
+partition=$(cat /sys/class/block/$(basename "$rootdev")/partition)
+growpart "$disk" "$partition" >/dev/null || [ $? -eq 1 ]
+case $(findmnt -n -o FSTYPE /) in
+xfs) xfs_growfs / >/dev/null ;;
+*) resize2fs "$rootdev" >/dev/null 2>&1 ;;
+esac
+df -B1 --output=size / | tail -n 1`
+
+// ResizeDisk grows the disk of a stopped Machine to the specified size in
+// gigabytes. It does this by running the Cmdlet:
+//
+//	Resize-VHD -Path <diskpath> -SizeBytes <size>
+//
+// through an interface script. Disks cannot be shrunk.
+// The partition and file system inside the Machine are grown to fill the
+// disk when the Machine is next started, after WaitForStateChange finds
+// it running. See GrowFilesystem.
+func (vh *Machine) ResizeDisk(sizegb int) error {
+	return vh.ResizeDiskContext(context.Background(), sizegb)
+}
+
+// ResizeDiskContext grows the disk of a stopped Machine, like ResizeDisk.
+// If the context is done before the operation completes, the operation is
+// abandoned and the context's error is returned.
+func (vh *Machine) ResizeDiskContext(ctx context.Context, sizegb int) error {
+	if sizegb < 1 {
+		return fmt.Errorf("invalid disk size %v GB: should be at least 1", sizegb)
+	}
+
+	return vh.resizedisk(ctx, int64(sizegb)<<30)
+}
+
+func (vh *Machine) resizedisk(ctx context.Context, sizebytes int64) error {
+	result, err := vh.driver.runwithresults(
+		ctx,
+		"resizedisk",
+		scriptparams{
+			"MachineName": vh.qname(),
+			"SizeBytes":   sizebytes,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("could not resize disk of the host '%s': %w", vh.Name(), err)
+	}
+
+	if !result.Success {
+		return newoperationerror("resize disk of the host", vh.Name(), result)
+	}
+
+	oldsizebytes, _ := result.Payload["OldSizeBytes"].(float64)
+	if int64(oldsizebytes) == sizebytes {
+		return nil
+	}
+
+	kuttilog.Printf(
+		kuttilog.Info,
+		"Disk of host '%v' resized from %v to %v.",
+		vh.Name(),
+		formatbytes(int64(oldsizebytes)),
+		formatbytes(sizebytes),
+	)
+
+	vh.mutex.Lock()
+	vh.spec.DiskSizeGB = int(sizebytes >> 30)
+	vh.mutex.Unlock()
+
+	return vh.setgrowfspending(true)
+}
+
+func (vh *Machine) growfsmarkerpath() (string, error) {
+	machinedir, err := vh.driver.machineDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(machinedir, vh.qname(), growfsmarker), nil
+}
+
+func (vh *Machine) setgrowfspending(pending bool) error {
+	markerpath, err := vh.growfsmarkerpath()
+	if err != nil {
+		return err
+	}
+
+	if !pending {
+		err = os.Remove(markerpath)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(markerpath), 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(markerpath, []byte{}, 0644)
+}
+
+// FilesystemGrowthPending returns true if the disk of the Machine has
+// been grown, but its file system has not.
+func (vh *Machine) FilesystemGrowthPending() bool {
+	markerpath, err := vh.growfsmarkerpath()
+	if err != nil {
+		return false
+	}
+
+	_, err = os.Stat(markerpath)
+	return err == nil
+}
+
+// GrowFilesystem grows the root partition and file system inside a
+// running Machine to fill its disk, and returns the new size of the file
+// system in bytes. It does this over SSH.
+func (vh *Machine) GrowFilesystem() (int64, error) {
+	return vh.GrowFilesystemContext(context.Background())
+}
+
+// GrowFilesystemContext grows the root file system of a Machine, like
+// GrowFilesystem. If the context is done before the operation completes,
+// the operation is abandoned and the context's error is returned.
+func (vh *Machine) GrowFilesystemContext(ctx context.Context) (int64, error) {
+	if vh.Status() != drivercore.MachineStatusRunning || vh.IPAddress() == "" {
+		return 0, fmt.Errorf("could not grow file system of the host '%v': host is not running", vh.Name())
+	}
+
+	output, err := vh.runwithresults(
+		ctx,
+		"/usr/bin/sudo",
+		"/bin/sh",
+		"-c",
+		"'"+growfsscript+"'",
+	)
+	if err != nil {
+		return 0, fmt.Errorf("could not grow file system of the host '%v': %w", vh.Name(), commanderror(err, output))
+	}
+
+	lines := strings.Fields(output)
+	if len(lines) == 0 {
+		return 0, fmt.Errorf("could not grow file system of the host '%v': no size reported", vh.Name())
+	}
+	sizebytes, err := strconv.ParseInt(lines[len(lines)-1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not grow file system of the host '%v': invalid size reported: %v", vh.Name(), err)
+	}
+
+	err = vh.setgrowfspending(false)
+	if err != nil {
+		return sizebytes, err
+	}
+
+	kuttilog.Printf(kuttilog.Info, "File system of host '%v' is now %v.", vh.Name(), formatbytes(sizebytes))
+
+	return sizebytes, nil
+}
+
+// growpendingfilesystem grows the file system of a running Machine if
+// its disk has been grown since it last ran. Failures are logged, and
+// the growth is tried again next time.
+func (vh *Machine) growpendingfilesystem(ctx context.Context) {
+	if !vh.FilesystemGrowthPending() {
+		return
+	}
+
+	_, err := vh.GrowFilesystemContext(ctx)
+	if err != nil {
+		kuttilog.Printf(kuttilog.Info, "Warning: %v. It will be tried again when the host next starts.", err)
+	}
+}
@@ -0,0 +1,81 @@
+package driverhyperv_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	driverhyperv "github.com/kuttiproject/driver-hyperv"
+	"github.com/kuttiproject/drivercore"
+)
+
+func TestResizeDisk(t *testing.T) {
+	driver, fe := newtestdriver(t)
+	qname := driver.QualifiedMachineName("node1", "test")
+
+	spec := driverhyperv.MachineSpec{ProcessorCount: 2, MemoryStartupMB: 2048, DiskSizeGB: 20}
+	machine, err := driver.NewMachineWithSpec("node1", "test", "1.27", spec)
+	if err != nil {
+		t.Fatalf("Error creating machine: %v", err)
+	}
+	if fe.disks[qname] != 20<<30 {
+		t.Errorf("Expected disk of 20 GiB, got %v bytes", fe.disks[qname])
+	}
+
+	growcount := func() int {
+		count := 0
+		for _, command := range fe.commands {
+			if strings.Contains(command, "growpart") {
+				count++
+			}
+		}
+		return count
+	}
+	if growcount() != 1 {
+		t.Errorf("Expected file system to be grown once while creating, got %v", growcount())
+	}
+	if machine.FilesystemGrowthPending() {
+		t.Errorf("Expected no pending file system growth after creating")
+	}
+
+	err = machine.ResizeDisk(10)
+	if !errors.Is(err, driverhyperv.ErrInvalidArgument) {
+		t.Errorf("Expected ErrInvalidArgument shrinking disk, got %v", err)
+	}
+
+	err = machine.ResizeDisk(30)
+	if err != nil {
+		t.Fatalf("Error resizing disk: %v", err)
+	}
+	if !machine.FilesystemGrowthPending() {
+		t.Errorf("Expected pending file system growth after resizing")
+	}
+	if machine.Spec().DiskSizeGB != 30 {
+		t.Errorf("Expected disk size 30 GB, got %v", machine.Spec().DiskSizeGB)
+	}
+
+	err = machine.Start()
+	if err != nil {
+		t.Fatalf("Error starting machine: %v", err)
+	}
+	machine.WaitForStateChange(25)
+	if machine.Status() != drivercore.MachineStatusRunning {
+		t.Fatalf("Expected status %v, got %v", drivercore.MachineStatusRunning, machine.Status())
+	}
+	if growcount() != 2 {
+		t.Errorf("Expected file system to be grown on start, got %v growths", growcount())
+	}
+	if machine.FilesystemGrowthPending() {
+		t.Errorf("Expected no pending file system growth after start")
+	}
+
+	size, err := machine.GrowFilesystem()
+	if err != nil || size != 20<<30 {
+		t.Errorf("Expected reported size %v, got %v, %v", int64(20<<30), size, err)
+	}
+
+	err = machine.ResizeDisk(40)
+	if !errors.Is(err, driverhyperv.ErrInvalidState) {
+		t.Errorf("Expected ErrInvalidState resizing disk of running machine, got %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package driverhyperv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/kuttiproject/drivercore"
+)
+
+// ReadinessProbe is a check that a Machine is ready for use. See
+// WaitForReady.
+type ReadinessProbe struct {
+	name  string
+	check func(ctx context.Context, vh *Machine) error
+}
+
+// Name returns the name of the probe.
+func (rp ReadinessProbe) Name() string {
+	return rp.name
+}
+
+// The predefined readiness probes. They are listed in the order in which
+// they can be expected to pass.
+var (
+	// ProbeRunning checks that the Hyper-V VM of the Machine is running.
+	ProbeRunning = ReadinessProbe{name: "running", check: proberunning}
+	// ProbeIPv4 checks that the Machine has an IPv4 address.
+	ProbeIPv4 = ReadinessProbe{name: "ipv4", check: probeipv4}
+	// ProbeSSHPort checks that TCP port 22 of the Machine accepts
+	// connections. If the Executor of the driver runs SSH commands
+	// itself, it is the same as ProbeSSHLogin.
+	ProbeSSHPort = ReadinessProbe{name: "sshport", check: probesshport}
+	// ProbeSSHLogin checks that a command can be run in the Machine
+	// over SSH.
+	ProbeSSHLogin = ReadinessProbe{name: "sshlogin", check: probesshlogin}
+)
+
+// ProbeCommand returns a readiness probe that checks that the specified
+// command succeeds when run in the Machine over SSH.
+func ProbeCommand(command string) ReadinessProbe {
+	return ReadinessProbe{
+		name: fmt.Sprintf("command '%v'", command),
+		check: func(ctx context.Context, vh *Machine) error {
+			_, err := vh.runwithresults(ctx, command)
+			return err
+		},
+	}
+}
+
+// readinessinterval is the time between rounds of readiness probes.
+const readinessinterval = 2 * time.Second
+
+func proberunning(ctx context.Context, vh *Machine) error {
+	if status := vh.Status(); status != drivercore.MachineStatusRunning {
+		return fmt.Errorf("machine status is %v", status)
+	}
+
+	return nil
+}
+
+func probeipv4(ctx context.Context, vh *Machine) error {
+	ipaddress := vh.currentipaddress()
+	if ipaddress == "" {
+		return errors.New("no IP address")
+	}
+
+	if parsedip := net.ParseIP(ipaddress); parsedip == nil || parsedip.To4() == nil {
+		return fmt.Errorf("IP address '%v' is not an IPv4 address", ipaddress)
+	}
+
+	return nil
+}
+
+func probesshport(ctx context.Context, vh *Machine) error {
+	if _, ok := vh.driver.currentexecutor().(SSHExecutor); ok {
+		return probesshlogin(ctx, vh)
+	}
+
+	ipaddress := vh.currentipaddress()
+	if ipaddress == "" {
+		return errors.New("no IP address")
+	}
+
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ipaddress, "22"))
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+func probesshlogin(ctx context.Context, vh *Machine) error {
+	if vh.currentipaddress() == "" {
+		return errors.New("no IP address")
+	}
+
+	_, err := vh.runwithresults(ctx, "true")
+	return err
+}
+
+// WaitForReady waits the specified number of seconds, or until all the
+// specified readiness probes pass, in order. The state of the Machine is
+// fetched before each round of probes. If no probes are specified,
+// ProbeRunning and ProbeIPv4 are used.
+// If the probes do not pass in time, a *ReadinessError describing the
+// last probe that failed is returned.
+func (vh *Machine) WaitForReady(timeoutinseconds int, probes ...ReadinessProbe) error {
+	return vh.WaitForReadyContext(context.Background(), timeoutinseconds, probes...)
+}
+
+// WaitForReadyContext waits for a Machine to be ready, like WaitForReady.
+// If the context is done before the Machine is ready, the wait is
+// abandoned and the context's error is returned.
+// If timeoutinseconds is zero or less, the WaitTimeoutSeconds setting of
+// the driver configuration is used.
+func (vh *Machine) WaitForReadyContext(ctx context.Context, timeoutinseconds int, probes ...ReadinessProbe) error {
+	if timeoutinseconds <= 0 {
+		config, err := loaddriverconfig()
+		if err != nil {
+			return err
+		}
+		timeoutinseconds = config.WaitTimeoutSeconds
+	}
+
+	if len(probes) == 0 {
+		probes = []ReadinessProbe{ProbeRunning, ProbeIPv4}
+	}
+
+	waitctx, cancel := context.WithTimeout(ctx, time.Duration(timeoutinseconds)*time.Second)
+	defer cancel()
+
+	var (
+		lastprobe string
+		lasterr   error
+	)
+	for {
+		probe, err := vh.runprobes(waitctx, probes)
+		if err == nil {
+			return nil
+		}
+
+		// A round cut short by the timeout says nothing about the
+		// machine, so the result of the previous round is kept
+		if waitctx.Err() == nil || lasterr == nil {
+			lastprobe, lasterr = probe, err
+		}
+
+		// A machine that does not exist will never be ready
+		if errors.Is(lasterr, ErrMachineNotFound) || ctx.Err() != nil {
+			break
+		}
+
+		if sleepcontext(waitctx, readinessinterval) != nil {
+			break
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return &ReadinessError{
+		MachineName: vh.Name(),
+		Probe:       lastprobe,
+		Err:         lasterr,
+	}
+}
+
+// runprobes fetches the state of the machine, and runs the probes in
+// order. It returns the name and the result of the first probe that
+// fails, or an empty name and nil if they all pass.
+func (vh *Machine) runprobes(ctx context.Context, probes []ReadinessProbe) (string, error) {
+	err := vh.get(ctx)
+	if err != nil {
+		return "state", err
+	}
+
+	for _, probe := range probes {
+		err = probe.check(ctx, vh)
+		if err != nil {
+			return probe.name, err
+		}
+	}
+
+	return "", nil
+}
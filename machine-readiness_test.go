@@ -0,0 +1,118 @@
+package driverhyperv_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	driverhyperv "github.com/kuttiproject/driver-hyperv"
+)
+
+func TestWaitForReady(t *testing.T) {
+	driver, fe := newtestdriver(t)
+
+	newmachine, err := driver.NewMachine("node1", "test", "1.27")
+	if err != nil {
+		t.Fatalf("Error creating machine: %v", err)
+	}
+	machine := newmachine.(*driverhyperv.Machine)
+
+	// The machine is stopped after it is created
+	err = machine.WaitForReady(1, driverhyperv.ProbeRunning, driverhyperv.ProbeIPv4)
+	if !errors.Is(err, driverhyperv.ErrNotReady) {
+		t.Fatalf("Expected ErrNotReady waiting for a stopped machine, got %v", err)
+	}
+	var readinesserror *driverhyperv.ReadinessError
+	if !errors.As(err, &readinesserror) || readinesserror.Probe != driverhyperv.ProbeRunning.Name() {
+		t.Errorf("Expected probe %v to fail, got %v", driverhyperv.ProbeRunning.Name(), err)
+	}
+
+	err = machine.Start()
+	if err != nil {
+		t.Fatalf("Error starting machine: %v", err)
+	}
+
+	fe.sshmutex.Lock()
+	commandcount := len(fe.commands)
+	fe.sshmutex.Unlock()
+
+	err = machine.WaitForReady(
+		5,
+		driverhyperv.ProbeRunning,
+		driverhyperv.ProbeIPv4,
+		driverhyperv.ProbeSSHPort,
+		driverhyperv.ProbeSSHLogin,
+		driverhyperv.ProbeCommand("systemctl is-active kubelet"),
+	)
+	if err != nil {
+		t.Fatalf("Error waiting for running machine: %v", err)
+	}
+
+	fe.sshmutex.Lock()
+	commands := fe.commands[commandcount:]
+	fe.sshmutex.Unlock()
+	if len(commands) != 3 || commands[2] != "systemctl is-active kubelet" {
+		t.Errorf("Expected SSH probes to run three commands, got %v", commands)
+	}
+
+	// A machine that does not exist fails without waiting
+	missingmachine, err := driver.GetMachine("node1", "test")
+	if err != nil {
+		t.Fatalf("Error getting machine: %v", err)
+	}
+	err = driver.DeleteMachine("node1", "test")
+	if err != nil {
+		t.Fatalf("Error deleting machine: %v", err)
+	}
+	err = missingmachine.(*driverhyperv.Machine).WaitForReady(60)
+	if !errors.Is(err, driverhyperv.ErrMachineNotFound) {
+		t.Errorf("Expected ErrMachineNotFound waiting for a deleted machine, got %v", err)
+	}
+}
+
+// slowstateexecutor makes the "getmachine" command wait until its
+// context is done, once slow is set and the command has run once more.
+type slowstateexecutor struct {
+	*sshfakeexecutor
+	slow      atomic.Bool
+	slowcalls atomic.Int32
+}
+
+func (se *slowstateexecutor) Execute(ctx context.Context, request *driverhyperv.ScriptRequest) (*driverhyperv.DriverResult, error) {
+	if request.Command == "getmachine" && se.slow.Load() && se.slowcalls.Add(1) > 1 {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	return se.sshfakeexecutor.Execute(ctx, request)
+}
+
+func TestWaitForReadyTimeoutDuringState(t *testing.T) {
+	newtestworkspace(t)
+
+	se := &slowstateexecutor{sshfakeexecutor: &sshfakeexecutor{fakeexecutor: newfakeexecutor()}}
+	driver := driverhyperv.NewDriverWithExecutor(se)
+
+	newmachine, err := driver.NewMachine("node1", "test", "1.27")
+	if err != nil {
+		t.Fatalf("Error creating machine: %v", err)
+	}
+	machine := newmachine.(*driverhyperv.Machine)
+
+	// The machine is stopped, and the timeout expires while its state
+	// is fetched for the second round of probes. The result of the
+	// first round should be reported.
+	se.slow.Store(true)
+	err = machine.WaitForReady(3, driverhyperv.ProbeRunning)
+	var readinesserror *driverhyperv.ReadinessError
+	if !errors.As(err, &readinesserror) {
+		t.Fatalf("Expected *ReadinessError, got %v", err)
+	}
+	if readinesserror.Probe != driverhyperv.ProbeRunning.Name() || errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the result of probe %v to be reported, got %v", driverhyperv.ProbeRunning.Name(), err)
+	}
+	if se.slowcalls.Load() < 2 {
+		t.Errorf("Expected the timeout to expire while fetching the state")
+	}
+}
@@ -0,0 +1,127 @@
+package driverhyperv
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MachineSpec describes the virtual processors and memory of a machine.
+// Memory sizes are in megabytes, and should be even numbers.
+type MachineSpec struct {
+	// ProcessorCount is the number of virtual processors.
+	ProcessorCount int
+	// MemoryStartupMB is the memory of the machine when it starts. Without
+	// dynamic memory, the machine always has this much memory. It should
+	// be at least 512.
+	MemoryStartupMB int
+	// DynamicMemory lets Hyper-V adjust the memory of a running machine
+	// between MemoryMinimumMB and MemoryMaximumMB, depending on demand.
+	// The minimum and maximum are ignored without dynamic memory.
+	DynamicMemory   bool
+	MemoryMinimumMB int
+	MemoryMaximumMB int
+	// MemoryWeight is the priority of the machine when Hyper-V does not
+	// have enough memory for all machines, from 1 to 10000. If zero, the
+	// Hyper-V default of 5000 is used.
+	MemoryWeight int
+	// DiskSizeGB is the size of the disk of the machine, in gigabytes.
+	// When creating a machine, zero means the size of the image. A disk
+	// can be grown, but not shrunk. See Machine.ResizeDisk.
+	DiskSizeGB int
+}
+
+// Validate returns an error if the spec is invalid.
+func (ms *MachineSpec) Validate() error {
+	if ms.ProcessorCount < 1 {
+		return fmt.Errorf("invalid processor count %v: should be at least 1", ms.ProcessorCount)
+	}
+
+	if ms.MemoryStartupMB < 512 || ms.MemoryStartupMB%2 != 0 {
+		return fmt.Errorf("invalid startup memory %v MB: should be an even number, at least 512", ms.MemoryStartupMB)
+	}
+
+	if ms.DynamicMemory {
+		if ms.MemoryMinimumMB < 32 || ms.MemoryMinimumMB%2 != 0 {
+			return fmt.Errorf("invalid minimum memory %v MB: should be an even number, at least 32", ms.MemoryMinimumMB)
+		}
+
+		if ms.MemoryMaximumMB%2 != 0 {
+			return fmt.Errorf("invalid maximum memory %v MB: should be an even number", ms.MemoryMaximumMB)
+		}
+
+		if ms.MemoryMinimumMB > ms.MemoryStartupMB || ms.MemoryStartupMB > ms.MemoryMaximumMB {
+			return errors.New("invalid dynamic memory: minimum, startup and maximum memory should be in increasing order")
+		}
+	}
+
+	if ms.MemoryWeight < 0 || ms.MemoryWeight > 10000 {
+		return fmt.Errorf("invalid memory weight %v: should be between 1 and 10000, or 0 for the default", ms.MemoryWeight)
+	}
+
+	if ms.DiskSizeGB < 0 {
+		return fmt.Errorf("invalid disk size %v GB: should not be negative", ms.DiskSizeGB)
+	}
+
+	return nil
+}
+
+// scriptparams returns the interface script parameters for creating a
+// machine with this spec.
+func (ms *MachineSpec) scriptparams() scriptparams {
+	params := scriptparams{
+		"MemoryBytes":    int64(ms.MemoryStartupMB) << 20,
+		"ProcessorCount": ms.ProcessorCount,
+	}
+
+	if ms.DynamicMemory {
+		params["DynamicMemory"] = true
+		params["MemoryMinimumBytes"] = int64(ms.MemoryMinimumMB) << 20
+		params["MemoryMaximumBytes"] = int64(ms.MemoryMaximumMB) << 20
+	}
+
+	if ms.MemoryWeight > 0 {
+		params["MemoryWeight"] = ms.MemoryWeight
+	}
+
+	return params
+}
+
+// hypervmachinespec is the spec of a machine as reported by the
+// interface script.
+type hypervmachinespec struct {
+	ProcessorCount       int
+	MemoryStartupBytes   int64
+	DynamicMemoryEnabled bool
+	MemoryMinimumBytes   int64
+	MemoryMaximumBytes   int64
+	MemoryWeight         int
+	DiskSizeBytes        int64
+}
+
+func (hms *hypervmachinespec) MachineSpec() MachineSpec {
+	spec := MachineSpec{
+		ProcessorCount:  hms.ProcessorCount,
+		MemoryStartupMB: int(hms.MemoryStartupBytes >> 20),
+		DynamicMemory:   hms.DynamicMemoryEnabled,
+		MemoryWeight:    hms.MemoryWeight,
+		DiskSizeGB:      int(hms.DiskSizeBytes >> 30),
+	}
+
+	if spec.DynamicMemory {
+		spec.MemoryMinimumMB = int(hms.MemoryMinimumBytes >> 20)
+		spec.MemoryMaximumMB = int(hms.MemoryMaximumBytes >> 20)
+	}
+
+	return spec
+}
+
+// Spec returns the processors and memory of the machine, as last read
+// from Hyper-V. Hyper-V keeps these settings with the machine, so they
+// are available for machines returned by GetMachine as well as machines
+// created by this driver. The spec is zero if it could not be read.
+func (vh *Machine) Spec() MachineSpec {
+	vh.mutex.Lock()
+	defer vh.mutex.Unlock()
+
+	return vh.spec
+}
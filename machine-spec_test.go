@@ -0,0 +1,72 @@
+package driverhyperv_test
+
+import (
+	"testing"
+
+	driverhyperv "github.com/kuttiproject/driver-hyperv"
+)
+
+func TestNewMachineWithSpec(t *testing.T) {
+	driver, fe := newtestdriver(t)
+
+	invalidspecs := []driverhyperv.MachineSpec{
+		{ProcessorCount: 0, MemoryStartupMB: 2048},
+		{ProcessorCount: 2, MemoryStartupMB: 2047},
+		{ProcessorCount: 2, MemoryStartupMB: 2048, DynamicMemory: true, MemoryMinimumMB: 4096, MemoryMaximumMB: 8192},
+		{ProcessorCount: 2, MemoryStartupMB: 2048, MemoryWeight: 10001},
+	}
+	for _, spec := range invalidspecs {
+		_, err := driver.NewMachineWithSpec("node1", "test", "1.27", spec)
+		if err == nil {
+			t.Errorf("Expected error creating machine with invalid spec %+v", spec)
+		}
+	}
+
+	spec := driverhyperv.MachineSpec{
+		ProcessorCount:  4,
+		MemoryStartupMB: 1024,
+		DynamicMemory:   true,
+		MemoryMinimumMB: 512,
+		MemoryMaximumMB: 4096,
+		MemoryWeight:    8000,
+	}
+	machine, err := driver.NewMachineWithSpec("node1", "test", "1.27", spec)
+	if err != nil {
+		t.Fatalf("Error creating machine: %v", err)
+	}
+	if machine.Spec() != spec {
+		t.Errorf("Expected spec %+v, got %+v", spec, machine.Spec())
+	}
+
+	var newmachinerequest *driverhyperv.ScriptRequest
+	for _, request := range fe.requests {
+		if request.Command == "newmachine" {
+			newmachinerequest = request
+		}
+	}
+	if newmachinerequest == nil {
+		t.Fatalf("Expected a newmachine request")
+	}
+	if newmachinerequest.Parameter("MemoryMaximumBytes") != int64(4096)<<20 {
+		t.Errorf("Expected MemoryMaximumBytes %v, got %v", int64(4096)<<20, newmachinerequest.Parameter("MemoryMaximumBytes"))
+	}
+
+	// The spec is read back from Hyper-V
+	gotmachine, err := driver.GetMachine("node1", "test")
+	if err != nil {
+		t.Fatalf("Error getting machine: %v", err)
+	}
+	if gotmachine.(*driverhyperv.Machine).Spec() != spec {
+		t.Errorf("Expected spec %+v, got %+v", spec, gotmachine.(*driverhyperv.Machine).Spec())
+	}
+
+	// Machines created without a spec use the configured defaults
+	machine2, err := driver.NewMachine("node2", "test", "1.27")
+	if err != nil {
+		t.Fatalf("Error creating machine: %v", err)
+	}
+	defaultspec := driverhyperv.MachineSpec{ProcessorCount: 2, MemoryStartupMB: 2048}
+	if machine2.(*driverhyperv.Machine).Spec() != defaultspec {
+		t.Errorf("Expected spec %+v, got %+v", defaultspec, machine2.(*driverhyperv.Machine).Spec())
+	}
+}
@@ -0,0 +1,89 @@
+package driverhyperv
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kuttiproject/drivercore"
+)
+
+// Pause pauses a running Machine. The Machine keeps its memory, but its
+// processors are stopped.
+// It does this by running the Cmdlet:
+//
+//	Suspend-VM -Name <machinename>
+//
+// through an interface script.
+// This operation will set the status to MachineStatusPaused.
+func (vh *Machine) Pause() error {
+	return vh.PauseContext(context.Background())
+}
+
+// PauseContext pauses a Machine, like Pause. If the context is done before
+// the operation completes, the operation is abandoned and the context's
+// error is returned.
+func (vh *Machine) PauseContext(ctx context.Context) error {
+	return vh.changestate(ctx, "pausemachine", "pause the host", MachineStatusPaused)
+}
+
+// Resume resumes a paused Machine.
+// It does this by running the Cmdlet:
+//
+//	Resume-VM -Name <machinename>
+//
+// through an interface script.
+// This operation will set the status to drivercore.MachineStatusRunning.
+func (vh *Machine) Resume() error {
+	return vh.ResumeContext(context.Background())
+}
+
+// ResumeContext resumes a Machine, like Resume. If the context is done
+// before the operation completes, the operation is abandoned and the
+// context's error is returned.
+func (vh *Machine) ResumeContext(ctx context.Context) error {
+	return vh.changestate(ctx, "resumemachine", "resume the host", drivercore.MachineStatusRunning)
+}
+
+// Save saves the memory and device state of a running or paused Machine
+// to disk, and turns it off. Start restores the Machine from the saved
+// state, and Stop discards it.
+// It does this by running the Cmdlet:
+//
+//	Save-VM -Name <machinename>
+//
+// through an interface script.
+// This operation will set the status to MachineStatusSaved.
+func (vh *Machine) Save() error {
+	return vh.SaveContext(context.Background())
+}
+
+// SaveContext saves a Machine, like Save. If the context is done before
+// the operation completes, the operation is abandoned and the context's
+// error is returned.
+func (vh *Machine) SaveContext(ctx context.Context) error {
+	return vh.changestate(ctx, "savemachine", "save the host", MachineStatusSaved)
+}
+
+// changestate runs an interface script command that changes the state of
+// the machine, and sets the status of the machine if it succeeds.
+func (vh *Machine) changestate(ctx context.Context, command string, operation string, status drivercore.MachineStatus) error {
+	output, err := vh.driver.runwithresults(
+		ctx,
+		command,
+		scriptparams{
+			"MachineName": vh.qname(),
+		},
+	)
+
+	if err != nil {
+		return fmt.Errorf("could not %s '%s': %w", operation, vh.Name(), err)
+	}
+
+	if !output.Success {
+		return newoperationerror(operation, vh.Name(), output)
+	}
+
+	vh.setstatus(status)
+
+	return nil
+}
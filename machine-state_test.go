@@ -0,0 +1,115 @@
+package driverhyperv_test
+
+import (
+	"errors"
+	"testing"
+
+	driverhyperv "github.com/kuttiproject/driver-hyperv"
+	"github.com/kuttiproject/drivercore"
+	"github.com/kuttiproject/workspace"
+)
+
+func TestPauseResumeSave(t *testing.T) {
+	driver, _ := newtestdriver(t)
+
+	newmachine, err := driver.NewMachine("node1", "test", "1.27")
+	if err != nil {
+		t.Fatalf("Error creating machine: %v", err)
+	}
+	machine := newmachine.(*driverhyperv.Machine)
+
+	err = machine.Pause()
+	if !errors.Is(err, driverhyperv.ErrInvalidState) {
+		t.Errorf("Expected ErrInvalidState pausing a stopped machine, got %v", err)
+	}
+
+	err = machine.Start()
+	if err != nil {
+		t.Fatalf("Error starting machine: %v", err)
+	}
+	machine.WaitForStateChange(25)
+
+	err = machine.Pause()
+	if err != nil {
+		t.Fatalf("Error pausing machine: %v", err)
+	}
+	if machine.Status() != driverhyperv.MachineStatusPaused {
+		t.Errorf("Expected status %v after pausing, got %v", driverhyperv.MachineStatusPaused, machine.Status())
+	}
+
+	err = machine.Resume()
+	if err != nil {
+		t.Fatalf("Error resuming machine: %v", err)
+	}
+	if machine.Status() != drivercore.MachineStatusRunning {
+		t.Errorf("Expected status %v after resuming, got %v", drivercore.MachineStatusRunning, machine.Status())
+	}
+
+	err = machine.Save()
+	if err != nil {
+		t.Fatalf("Error saving machine: %v", err)
+	}
+	if machine.Status() != driverhyperv.MachineStatusSaved {
+		t.Errorf("Expected status %v after saving, got %v", driverhyperv.MachineStatusSaved, machine.Status())
+	}
+
+	// A saved machine is restored by Start
+	err = machine.Start()
+	if err != nil {
+		t.Fatalf("Error starting saved machine: %v", err)
+	}
+	machine.WaitForStateChange(25)
+	if machine.Status() != drivercore.MachineStatusRunning {
+		t.Errorf("Expected status %v after starting saved machine, got %v", drivercore.MachineStatusRunning, machine.Status())
+	}
+}
+
+func TestMachineStateMapping(t *testing.T) {
+	err := workspace.Set(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error setting workspace: %v", err)
+	}
+
+	fe := newfakeexecutor()
+	driver := driverhyperv.NewDriverWithExecutor(fe)
+
+	tests := []struct {
+		state  string
+		status drivercore.MachineStatus
+	}{
+		{"Off", drivercore.MachineStatusStopped},
+		{"Running", drivercore.MachineStatusRunning},
+		{"Starting", driverhyperv.MachineStatusStarting},
+		{"Stopping", driverhyperv.MachineStatusStopping},
+		{"Saving", driverhyperv.MachineStatusSaving},
+		{"FastSaving", driverhyperv.MachineStatusSaving},
+		{"Saved", driverhyperv.MachineStatusSaved},
+		{"FastSaved", driverhyperv.MachineStatusSaved},
+		{"Pausing", driverhyperv.MachineStatusPausing},
+		{"Paused", driverhyperv.MachineStatusPaused},
+		{"Resuming", driverhyperv.MachineStatusResuming},
+		{"Reset", driverhyperv.MachineStatusResetting},
+		{"RunningCritical", drivercore.MachineStatusError},
+		{"SavedCritical", drivercore.MachineStatusError},
+		{"Other", drivercore.MachineStatusUnknown},
+	}
+
+	qname := driver.QualifiedMachineName("node1", "test")
+	for _, test := range tests {
+		fe.mutex.Lock()
+		fe.machines[qname] = test.state
+		fe.mutex.Unlock()
+
+		machine, err := driver.GetMachine("node1", "test")
+		if err != nil {
+			t.Errorf("Error getting machine in state %v: %v", test.state, err)
+			continue
+		}
+		if machine.Status() != test.status {
+			t.Errorf("Expected status %v for state %v, got %v", test.status, test.state, machine.Status())
+		}
+		if test.status == drivercore.MachineStatusError && machine.Error() == "" {
+			t.Errorf("Expected error message for state %v", test.state)
+		}
+	}
+}
@@ -1,9 +1,11 @@
 package driverhyperv
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/kuttiproject/drivercore"
 )
@@ -16,34 +18,66 @@ type hypervmachinedata struct {
 
 // The MachineStatus* constants add some Hyper-V specific statuses.
 const (
-	MachineStatusStarting = drivercore.MachineStatus("Starting")
-	MachineStatusStopping = drivercore.MachineStatus("Stopping")
-	MachineStatusCreating = drivercore.MachineStatus("Creating")
+	MachineStatusStarting  = drivercore.MachineStatus("Starting")
+	MachineStatusStopping  = drivercore.MachineStatus("Stopping")
+	MachineStatusCreating  = drivercore.MachineStatus("Creating")
+	MachineStatusSaving    = drivercore.MachineStatus("Saving")
+	MachineStatusSaved     = drivercore.MachineStatus("Saved")
+	MachineStatusPausing   = drivercore.MachineStatus("Pausing")
+	MachineStatusPaused    = drivercore.MachineStatus("Paused")
+	MachineStatusResuming  = drivercore.MachineStatus("Resuming")
+	MachineStatusResetting = drivercore.MachineStatus("Resetting")
 )
 
-// Machine implements the drivercore.Machine interface for VirtualBox
+// machinestatuses maps Hyper-V VM states to Machine statuses. The
+// "Critical" variants of these states are mapped separately.
+var machinestatuses = map[string]drivercore.MachineStatus{
+	"Off":        drivercore.MachineStatusStopped,
+	"Running":    drivercore.MachineStatusRunning,
+	"Starting":   MachineStatusStarting,
+	"Stopping":   MachineStatusStopping,
+	"Saving":     MachineStatusSaving,
+	"FastSaving": MachineStatusSaving,
+	"Saved":      MachineStatusSaved,
+	"FastSaved":  MachineStatusSaved,
+	"Pausing":    MachineStatusPausing,
+	"Paused":     MachineStatusPaused,
+	"Resuming":   MachineStatusResuming,
+	"Reset":      MachineStatusResetting,
+}
+
+// Machine implements the drivercore.Machine interface for VirtualBox.
+// A Machine is safe for concurrent use by multiple goroutines.
 type Machine struct {
 	driver *Driver
+	mutex  sync.Mutex
 
 	name           string
 	clustername    string
 	savedipaddress string
 	status         drivercore.MachineStatus
 	errormessage   string
+	spec           MachineSpec
 }
 
 func (hmd *hypervmachinedata) Machine(driver *Driver) *Machine {
 	var clustername string
 	var machinename string
-	var machinestatus drivercore.MachineStatus
-
-	switch hmd.State {
-	case "Off":
-		machinestatus = drivercore.MachineStatusStopped
-	case "Running":
-		machinestatus = drivercore.MachineStatusRunning
-	default:
-		machinestatus = drivercore.MachineStatus("Unknown")
+	var errormessage string
+
+	machinestatus, ok := machinestatuses[hmd.State]
+	if !ok {
+		machinestatus = drivercore.MachineStatusUnknown
+	}
+
+	// Hyper-V reports a "Critical" state, such as "RunningCritical",
+	// when it cannot reach the storage of a VM.
+	if strings.HasSuffix(hmd.State, "Critical") {
+		machinestatus = drivercore.MachineStatusError
+		errormessage = fmt.Sprintf(
+			"the Hyper-V state of the machine is '%v', which usually means that its storage is not accessible",
+			hmd.State,
+		)
 	}
 
 	nameparts := strings.Split(hmd.Name, "-")
@@ -61,29 +95,52 @@ func (hmd *hypervmachinedata) Machine(driver *Driver) *Machine {
 		clustername:    clustername,
 		savedipaddress: hmd.IPAddress,
 		status:         machinestatus,
+		errormessage:   errormessage,
 	}
 }
 
 // Name is the name of the machine.
 func (vh *Machine) Name() string {
+	vh.mutex.Lock()
+	defer vh.mutex.Unlock()
+
 	return vh.name
 }
 
 func (vh *Machine) qname() string {
-	return vh.driver.QualifiedMachineName(vh.name, vh.clustername)
+	vh.mutex.Lock()
+	name, clustername := vh.name, vh.clustername
+	vh.mutex.Unlock()
+
+	return vh.driver.QualifiedMachineName(name, clustername)
 }
 
 // Status can be drivercore.MachineStatusRunning, drivercore.MachineStatusStopped
-// drivercore.MachineStatusUnknown, drivercore.MachineStatusError,
-// driverhyperv.MachineStatusStarting or driverhyperv.MachineStatusStopping.
+// drivercore.MachineStatusUnknown, drivercore.MachineStatusError, or one of
+// the driverhyperv.MachineStatus* statuses, such as MachineStatusSaved or
+// MachineStatusPaused. A Machine whose storage Hyper-V cannot reach has the
+// status drivercore.MachineStatusError, and Error() describes the problem.
 func (vh *Machine) Status() drivercore.MachineStatus {
+	vh.mutex.Lock()
+	defer vh.mutex.Unlock()
+
 	return vh.status
 }
 
+func (vh *Machine) setstatus(status drivercore.MachineStatus) {
+	vh.mutex.Lock()
+	defer vh.mutex.Unlock()
+
+	vh.status = status
+}
+
 // Error returns the last error caused when manipulating this machine.
 // A valid value can be expected only when Status() returns
 // drivercore.MachineStatusError.
 func (vh *Machine) Error() string {
+	vh.mutex.Lock()
+	defer vh.mutex.Unlock()
+
 	return vh.errormessage
 }
 
@@ -112,25 +169,55 @@ func (vh *Machine) SSHAddress() string {
 // Start starts a Machine.
 // It does this by running the command:
 //   Start-VM -Name <machinename>
-// through an interface script.
+// through an interface script. A saved Machine is restored from its saved
+// state, and a paused Machine is resumed.
 // Note that a Machine may not be ready for further operations at the end of this,
 // and therefore its status will Starting, not Started.
 // See WaitForStateChange().
+// Before starting a stopped or saved Machine, it checks that the host has
+// enough free memory and logical processors for it, and returns an
+// *InsufficientResourcesError if not. See DriverConfig.AllowOvercommit.
 func (vh *Machine) Start() error {
+	return vh.StartContext(context.Background())
+}
+
+// StartContext starts a Machine, like Start. If the context is done before
+// the operation completes, the operation is abandoned and the context's
+// error is returned.
+func (vh *Machine) StartContext(ctx context.Context) error {
+	config, err := loaddriverconfig()
+	if err != nil {
+		return err
+	}
+
+	if !config.AllowOvercommit {
+		err = vh.preflightstart(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return vh.start(ctx)
+}
+
+func (vh *Machine) start(ctx context.Context) error {
 	output, err := vh.driver.runwithresults(
+		ctx,
 		"startmachine",
-		vh.qname(),
+		scriptparams{
+			"MachineName": vh.qname(),
+		},
 	)
 
 	if err != nil {
-		return fmt.Errorf("could not start the host '%s': %v", vh.name, err)
+		return fmt.Errorf("could not start the host '%s': %w", vh.Name(), err)
 	}
 
 	if !output.Success {
-		return fmt.Errorf("could not start the host '%s': %v", vh.name, output.ErrorMessage)
+		return newoperationerror("start the host", vh.Name(), output)
 	}
 
-	vh.status = MachineStatusStarting
+	vh.setstatus(MachineStatusStarting)
 
 	return nil
 }
@@ -138,24 +225,36 @@ func (vh *Machine) Start() error {
 // Stop stops a Machine.
 // It does this by running the command:
 //   Stop-VM -Name <machinename> -Force
+// A paused Machine is resumed first, so that it can shut down. The saved
+// state of a saved Machine is discarded.
 // Note that a Machine may not be ready for further operations at the end of this,
 // and therefore its status will be Stopping, not Stopped.
 // See WaitForStateChange().
 func (vh *Machine) Stop() error {
+	return vh.StopContext(context.Background())
+}
+
+// StopContext stops a Machine, like Stop. If the context is done before
+// the operation completes, the operation is abandoned and the context's
+// error is returned.
+func (vh *Machine) StopContext(ctx context.Context) error {
 	output, err := vh.driver.runwithresults(
+		ctx,
 		"stopmachine",
-		vh.qname(),
+		scriptparams{
+			"MachineName": vh.qname(),
+		},
 	)
 
 	if err != nil {
-		return fmt.Errorf("could not stop the host '%s': %v", vh.name, err)
+		return fmt.Errorf("could not stop the host '%s': %w", vh.Name(), err)
 	}
 
 	if !output.Success {
-		return fmt.Errorf("could not stop the host '%s': %v", vh.name, output.ErrorMessage)
+		return newoperationerror("stop the host", vh.Name(), output)
 	}
 
-	vh.status = MachineStatusStopping
+	vh.setstatus(MachineStatusStopping)
 
 	return nil
 }
@@ -167,19 +266,22 @@ func (vh *Machine) Stop() error {
 // This operation will set the status to drivercore.MachineStatusStopped.
 func (vh *Machine) ForceStop() error {
 	output, err := vh.driver.runwithresults(
+		context.Background(),
 		"forcestopmachine",
-		vh.qname(),
+		scriptparams{
+			"MachineName": vh.qname(),
+		},
 	)
 
 	if err != nil {
-		return fmt.Errorf("could not force stop the host '%s': %v", vh.name, err)
+		return fmt.Errorf("could not force stop the host '%s': %w", vh.Name(), err)
 	}
 
 	if !output.Success {
-		return fmt.Errorf("could not force stop the host '%s': %v", vh.name, output.ErrorMessage)
+		return newoperationerror("force stop the host", vh.Name(), output)
 	}
 
-	vh.status = drivercore.MachineStatusStopped
+	vh.setstatus(drivercore.MachineStatusStopped)
 	return nil
 }
 
@@ -192,11 +294,52 @@ func (vh *Machine) ForceStop() error {
 // if the Machine is stopping.
 // WaitForStateChange should be called after a call to Start, before
 // any other operation. From observation, it should not be called _before_ Stop.
+// If the disk of the Machine has been grown, the file system inside it is
+// grown once it is found running. See ResizeDisk.
+// WaitForStateChange does not report errors. To wait for a Machine to be
+// ready for use, and find out why it is not, use WaitForReady.
 func (vh *Machine) WaitForStateChange(timeoutinseconds int) {
-	result, _ := vh.driver.runwithresults("waitmachine", vh.qname(), string(vh.status), "25")
+	vh.WaitForStateChangeContext(context.Background(), timeoutinseconds)
+}
+
+// WaitForStateChangeContext waits for the Machine status to change, like
+// WaitForStateChange. If the context is done before the status changes,
+// the wait is abandoned and the context's error is returned.
+// If timeoutinseconds is zero or less, the WaitTimeoutSeconds setting of
+// the driver configuration is used.
+func (vh *Machine) WaitForStateChangeContext(ctx context.Context, timeoutinseconds int) error {
+	if timeoutinseconds <= 0 {
+		config, err := loaddriverconfig()
+		if err != nil {
+			return err
+		}
+		timeoutinseconds = config.WaitTimeoutSeconds
+	}
+
+	result, err := vh.driver.runwithresults(
+		ctx,
+		"waitmachine",
+		scriptparams{
+			"MachineName":    vh.qname(),
+			"MachineStatus":  string(vh.Status()),
+			"TimeoutSeconds": timeoutinseconds,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
 	if result.Success {
 		vh.fromdriverresult(result)
 	}
+
+	// The IP address may not be known yet, in which case growing
+	// the file system is left to a later call.
+	if vh.Status() == drivercore.MachineStatusRunning && vh.IPAddress() != "" {
+		vh.growpendingfilesystem(ctx)
+	}
+
+	return nil
 }
 
 // ForwardPort is not supported for the Hyper-V driver.
@@ -235,16 +378,26 @@ func (vh *Machine) ExecuteCommand(command drivercore.PredefinedCommand, params .
 	return commandfunc(vh, params...)
 }
 
-func (vh *Machine) get() error {
-	output, err := vh.driver.runwithresults("getmachine", vh.qname())
+func (vh *Machine) get(ctx context.Context) error {
+	output, err := vh.driver.runwithresults(
+		ctx,
+		"getmachine",
+		scriptparams{
+			"MachineName": vh.qname(),
+		},
+	)
 	if err != nil {
 		return err
 	}
 
+	if !output.Success {
+		return newoperationerror("get the host", vh.Name(), output)
+	}
+
 	return vh.fromdriverresult(output)
 }
 
-func (vh *Machine) fromdriverresult(output *driverresult) error {
+func (vh *Machine) fromdriverresult(output *DriverResult) error {
 	machinedatamap, ok := output.Payload["Machine"].(map[string]interface{})
 	if !ok {
 		return errors.New("could not get machine data: interface error")
@@ -261,20 +414,49 @@ func (vh *Machine) fromdriverresult(output *driverresult) error {
 
 	tempResult := machinedata.Machine(vh.driver)
 
-	vh.name = tempResult.name
-	vh.clustername = tempResult.clustername
+	// The spec is optional
+	var spec *MachineSpec
+	if specmap, ok := machinedatamap["Spec"].(map[string]interface{}); ok {
+		var hypervspec hypervmachinespec
+		if decodepayload(specmap, &hypervspec) == nil {
+			machinespec := hypervspec.MachineSpec()
+			spec = &machinespec
+		}
+	}
+
+	vh.mutex.Lock()
+	defer vh.mutex.Unlock()
+
+	// The name and cluster name are kept as they are, because they
+	// cannot be parsed back out of a qualified name that contains
+	// hyphens
 	vh.savedipaddress = tempResult.savedipaddress
 	vh.status = tempResult.status
+	if tempResult.status == drivercore.MachineStatusError {
+		vh.errormessage = tempResult.errormessage
+	}
+	if spec != nil {
+		vh.spec = *spec
+	}
 
 	return nil
 }
 
+// currentipaddress returns the saved IP address, without fetching it.
+func (vh *Machine) currentipaddress() string {
+	vh.mutex.Lock()
+	defer vh.mutex.Unlock()
+
+	return vh.savedipaddress
+}
+
 func (vh *Machine) savedipAddress() string {
 	// This guestproperty is set when the VM is created
-	if vh.savedipaddress != "" {
-		return vh.savedipaddress
+	savedipaddress := vh.currentipaddress()
+	if savedipaddress != "" {
+		return savedipaddress
 	}
-	vh.get()
+	vh.get(context.Background())
 
-	return vh.savedipaddress
+	return vh.currentipaddress()
 }